@@ -1,6 +1,6 @@
 module LearnGo
 
-go 1.16
+go 1.20
 
 require (
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
@@ -175,6 +175,7 @@ func (b *ByteBuf) ensureWritable(minWritableBytes uint32) {
 	var newCapacity = b.calculateNewCapacity(minNewCapacity)
 	var expandData = make([]byte, newCapacity - b.Capacity)
 	b.Data = append(b.Data, expandData...)
+	b.Capacity = newCapacity
 }
 
 func (b *ByteBuf) calculateNewCapacity(minNewCapacity uint32) uint32 {
@@ -23,6 +23,11 @@ func (dbutils *DBUtils) Open(db string, host string, port int, user string, pass
 	dbutils.db = dbInstance
 }
 
+// DB 返回底层的连接池，用于需要参数化查询的场景
+func (dbutils *DBUtils) DB() *sql.DB {
+	return dbutils.db
+}
+
 func (dbutils *DBUtils) Query(sql string) []map[string]string {
 	rows, err := dbutils.db.Query(sql)
 	defer rows.Close()
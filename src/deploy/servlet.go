@@ -1,6 +1,8 @@
 package deploy
 
 import (
+	"LearnGo/src/graceful"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -59,5 +61,20 @@ func Startup(port int) {
 	chain := alice.New(loggerHandler, recoverHandler)
 	var addr = fmt.Sprintf(":%d", port)
 	http.Handle("/", chain.Then(router))
-	http.ListenAndServe(addr, nil)
+
+	ln, err := graceful.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: addr}
+	graceful.OnShutdown(func(ctx context.Context) {
+		server.Shutdown(ctx)
+	})
+	graceful.Watch()
+
+	err = server.Serve(ln)
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	graceful.Wait()
 }
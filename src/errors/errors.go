@@ -7,4 +7,16 @@ var (
 	HandleAlreadyExists = errors.New("handler exists already")
 	// NotSupport 不支持该操作
 	NotSupport = errors.New("not support this operation")
+	// SessionNotFound session不存在或者已经失效
+	SessionNotFound = errors.New("session not found")
+	// NotPushable session没有可用的推送通道
+	NotPushable = errors.New("session is not pushable")
+	// PushQueueOverflow 离线推送队列已满，session被丢弃
+	PushQueueOverflow = errors.New("push queue overflow")
+	// DecompressTooLarge 解压之后的内容超过了限制
+	DecompressTooLarge = errors.New("decompressed content too large")
+	// ReplayedMessage 加密消息的计数器重复或者过旧
+	ReplayedMessage = errors.New("replayed message")
+	// SslPendingOverflow TLS握手完成之前等待写出的数据超过了限制
+	SslPendingOverflow = errors.New("ssl pending writes overflow")
 )
@@ -0,0 +1,283 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 这里的环境变量不能使用servlet.EnvPrefix（LEARNGO_）前缀，否则子进程加载配置时会被当作未知的配置项
+const (
+	// envInheritAddrs 子进程继承的监听地址列表，顺序与ExtraFiles一致
+	envInheritAddrs = "GRACEFUL_INHERIT_ADDRS"
+	// envReusePortAddrs 子进程需要通过SO_REUSEPORT重新绑定的地址列表
+	envReusePortAddrs = "GRACEFUL_REUSEPORT_ADDRS"
+	// envParentPid 父进程pid，子进程就绪后通知父进程退出
+	envParentPid = "GRACEFUL_PARENT_PID"
+	// firstInheritFd ExtraFiles在子进程中的起始fd
+	firstInheritFd = 3
+)
+
+var (
+	// DefaultShutdownTimeout 等待已有连接处理完毕的最长时间
+	DefaultShutdownTimeout = 30 * time.Second
+
+	mutex      sync.Mutex
+	inherited  map[string]*os.File
+	pending    map[string]bool
+	files      = make(map[string]*os.File)
+	addrs      []string
+	reuseAddrs []string
+	// exclusiveAddrs 没有开启SO_REUSEPORT的地址，子进程无法在父进程退出前绑定
+	exclusiveAddrs []string
+	hooks          []func(ctx context.Context)
+
+	watchOnce    sync.Once
+	readyOnce    sync.Once
+	shutdownOnce sync.Once
+	shuttingDown = make(chan struct{})
+	done         = make(chan struct{})
+)
+
+func init() {
+	inherited = make(map[string]*os.File)
+	pending = make(map[string]bool)
+	if value := os.Getenv(envInheritAddrs); value != "" {
+		for i, addr := range strings.Split(value, ",") {
+			inherited[addr] = os.NewFile(uintptr(firstInheritFd+i), addr)
+			pending[addr] = true
+		}
+	}
+	if value := os.Getenv(envReusePortAddrs); value != "" {
+		for _, addr := range strings.Split(value, ",") {
+			pending[addr] = true
+		}
+	}
+}
+
+// IsChild 当前进程是否由平滑重启fork出来
+func IsChild() bool {
+	return os.Getenv(envParentPid) != ""
+}
+
+// Listen 监听tcp地址，如果父进程传递了该地址的句柄则直接复用
+func Listen(network string, addr string) (net.Listener, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var ln net.Listener
+	var err error
+	if file, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		ln, err = net.FileListener(file)
+		file.Close()
+	} else {
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, ok := ln.(*net.TCPListener)
+	if !ok {
+		return ln, nil
+	}
+	file, err := tcpListener.File()
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if old, ok := files[addr]; ok {
+		old.Close()
+	} else {
+		addrs = append(addrs, addr)
+	}
+	files[addr] = file
+	claim(addr)
+	return ln, nil
+}
+
+// BindReusePort 登记自行通过SO_REUSEPORT绑定端口的地址(例如gnet)，
+// 平滑重启时子进程会在父进程关闭之前重新绑定同一端口，因此不需要传递句柄
+func BindReusePort(addr string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	found := false
+	for _, a := range reuseAddrs {
+		found = found || a == addr
+	}
+	if !found {
+		reuseAddrs = append(reuseAddrs, addr)
+	}
+	claim(addr)
+}
+
+// BindExclusive 登记没有开启SO_REUSEPORT、也不能传递句柄的地址，存在这样的地址时Restart返回错误
+func BindExclusive(addr string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	found := false
+	for _, a := range exclusiveAddrs {
+		found = found || a == addr
+	}
+	if !found {
+		exclusiveAddrs = append(exclusiveAddrs, addr)
+	}
+	claim(addr)
+}
+
+// claim 标记继承的地址已经开始接收连接，全部就绪后通知父进程。
+// 父进程没有传递任何地址时，子进程第一次开始监听就通知父进程
+func claim(addr string) {
+	delete(pending, addr)
+	if len(pending) == 0 {
+		go ready()
+	}
+}
+
+// OnShutdown 注册平滑关闭回调，回调需要在ctx结束前处理完已有连接
+func OnShutdown(hook func(ctx context.Context)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	hooks = append(hooks, hook)
+}
+
+// Restart 以相同参数启动新的子进程，并把所有监听句柄交给它，有地址没有开启SO_REUSEPORT时返回错误
+func Restart() (int, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(exclusiveAddrs) > 0 {
+		return 0, fmt.Errorf("%s not bound with SO_REUSEPORT, the child could not listen on it", strings.Join(exclusiveAddrs, ","))
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	extraFiles := make([]*os.File, 0, len(addrs))
+	for _, addr := range addrs {
+		extraFiles = append(extraFiles, files[addr])
+	}
+
+	env := make([]string, 0, len(os.Environ())+3)
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, envInheritAddrs+"=") || strings.HasPrefix(e, envReusePortAddrs+"=") ||
+			strings.HasPrefix(e, envParentPid+"=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	env = append(env, fmt.Sprintf("%s=%s", envInheritAddrs, strings.Join(addrs, ",")))
+	env = append(env, fmt.Sprintf("%s=%s", envReusePortAddrs, strings.Join(reuseAddrs, ",")))
+	env = append(env, fmt.Sprintf("%s=%d", envParentPid, os.Getpid()))
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+	return cmd.Process.Pid, nil
+}
+
+// ready 子进程继承的所有地址都开始接收连接后，通知父进程进入平滑关闭
+func ready() {
+	readyOnce.Do(func() {
+		if !IsChild() {
+			return
+		}
+		var pid int
+		if _, err := fmt.Sscan(os.Getenv(envParentPid), &pid); err != nil {
+			log.Println("graceful: invalid parent pid", err)
+			return
+		}
+		process, err := os.FindProcess(pid)
+		if err == nil {
+			err = process.Signal(syscall.SIGTERM)
+		}
+		if err != nil {
+			log.Println("graceful: notify parent failed", err)
+		}
+	})
+}
+
+// Shutdown 依次停止接收新连接并等待已有连接处理完毕
+func Shutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		close(shuttingDown)
+
+		mutex.Lock()
+		callbacks := make([]func(ctx context.Context), len(hooks))
+		copy(callbacks, hooks)
+		mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		for _, hook := range callbacks {
+			wg.Add(1)
+			go func(hook func(ctx context.Context)) {
+				defer wg.Done()
+				hook(ctx)
+			}(hook)
+		}
+		wg.Wait()
+		close(done)
+	})
+}
+
+// Wait 如果正在平滑关闭，则阻塞到所有回调执行完毕
+func Wait() {
+	select {
+	case <-shuttingDown:
+		<-done
+	default:
+	}
+}
+
+// Watch 监听进程信号：restartSignal触发平滑重启，SIGINT/SIGTERM触发平滑关闭
+func Watch() {
+	watchOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signals := []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+		if restartSignal != nil {
+			signals = append(signals, restartSignal)
+		}
+		signal.Notify(ch, signals...)
+
+		go func() {
+			for sig := range ch {
+				if sig == restartSignal {
+					pid, err := Restart()
+					if err != nil {
+						log.Println("graceful: restart failed", err)
+						continue
+					}
+					log.Println("graceful: started child process", pid)
+					continue
+				}
+				signal.Stop(ch)
+				log.Println("graceful: shutting down on", sig)
+				Shutdown(DefaultShutdownTimeout)
+				return
+			}
+		}()
+	})
+}
@@ -0,0 +1,119 @@
+//go:build !windows
+// +build !windows
+
+package graceful
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadyWithoutInheritedAddrs(t *testing.T) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	os.Setenv(envParentPid, strconv.Itoa(os.Getpid()))
+	defer os.Unsetenv(envParentPid)
+
+	// 父进程没有传递地址，第一次监听就通知父进程，readyOnce只能触发一次，需要在其他调用Listen的测试之前
+	ln, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	select {
+	case <-signals:
+	case <-time.After(time.Second):
+		t.Fatal("parent not notified")
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := origin.Addr().String()
+	file, err := origin.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin.Close()
+
+	mutex.Lock()
+	inherited[addr] = file
+	pending[addr] = true
+	mutex.Unlock()
+
+	ln, err := Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	mutex.Lock()
+	_, stillInherited := inherited[addr]
+	_, stillPending := pending[addr]
+	_, registered := files[addr]
+	mutex.Unlock()
+	if stillInherited || stillPending || !registered {
+		t.Fatal("inherited listener not claimed", stillInherited, stillPending, registered)
+	}
+
+	// 继承的socket仍然是同一个监听
+	go func() {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+		}
+	}()
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestShutdownRunsHooks(t *testing.T) {
+	finished := make(chan struct{})
+	OnShutdown(func(ctx context.Context) {
+		close(finished)
+	})
+	timedOut := false
+	OnShutdown(func(ctx context.Context) {
+		<-ctx.Done()
+		timedOut = true
+	})
+
+	Shutdown(50 * time.Millisecond)
+	Wait()
+	select {
+	case <-finished:
+	default:
+		t.Fatal("hook not called")
+	}
+	if !timedOut {
+		t.Fatal("shutdown returned before hooks finished")
+	}
+}
+
+func TestRestartWithoutReusePort(t *testing.T) {
+	BindExclusive("127.0.0.1:1")
+	defer func() {
+		mutex.Lock()
+		exclusiveAddrs = nil
+		mutex.Unlock()
+	}()
+
+	if _, err := Restart(); err == nil {
+		t.Fatal("restart should fail when an address is not bound with SO_REUSEPORT")
+	}
+}
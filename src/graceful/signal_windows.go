@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package graceful
+
+import "os"
+
+// restartSignal windows不支持SIGUSR2，也无法向子进程传递监听句柄
+var restartSignal os.Signal
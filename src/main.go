@@ -6,6 +6,7 @@ import (
 	//"LearnGo/src/test"
 
 	//"fmt"
+	"os"
 	"strings"
 
 	//"LearnGo/src/test"
@@ -55,7 +56,7 @@ func (m *MessageDecoder) CallDecode(ctx servlet.ConnHandlerContext, in *buffer.B
 	var message servlet.RequestMessage
 	bytes := in.ReadBytes(32)
 	message.Command = strings.Trim(string(bytes), "\x00")
-	message.RequestId = int(in.ReadInt32())
+	message.RequestId, message.Flags = servlet.DecodeRequestId(uint32(in.ReadInt32()))
 	message.Content = in.ReadBytes(dataLen - 36)
 
 	*output = append(*output, message)
@@ -72,7 +73,7 @@ func (m *MyServerHandler) Init(servlet servlet.Servlet, config servlet.ServletCo
 	m.Handler = &MessageHandler{Servlet: servlet, ServletConfig: config, ServletContext: ctx}
 }
 
-func (m *MyServerHandler) InitConn(conn gnet.Conn) {
+func (m *MyServerHandler) InitConn(conn servlet.Conn) {
 	v, ok := conn.Context().(*servlet.ConnPipeline)
 	if ok {
 		var coder servlet.InboundHandler = &servlet.ByteToMessageDecoder {Decoder: &MessageDecoder{}}
@@ -97,6 +98,6 @@ func main() {
 	var handler MyServerHandler
 
 
-	servlet.StartTcpServer(&handler)
+	servlet.StartTcpServer(&handler, os.Args[1:])
 	//test.TestSlice()
 }
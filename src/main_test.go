@@ -73,7 +73,7 @@ func (m *MyServerHandler) Init(servlet servlet.Servlet, config servlet.ServletCo
 	m.Handler = &MessageHandler{Servlet: servlet, ServletConfig: config, ServletContext: ctx}
 }
 
-func (m *MyServerHandler) InitConn(conn gnet.Conn) {
+func (m *MyServerHandler) InitConn(conn servlet.Conn) {
 	v, ok := conn.Context().(*servlet.ConnPipeline)
 	if ok {
 		var coder servlet.InboundHandler = &servlet.ByteToMessageDecoder {Decoder: &MessageDecoder{}}
@@ -98,7 +98,7 @@ func TestTcp(t *testing.T) {
 		var handler MyServerHandler
 
 
-		go servlet.StartTcpServer(&handler)
+		go servlet.StartTcpServer(&handler, nil)
 	})
 	t.Run("finish", func(t *testing.T) {
 		time.Sleep(time.Minute * 2)
@@ -0,0 +1,428 @@
+package servlet
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// paramTag 参数名
+	paramTag = "param"
+	// defaultTag 参数不存在时使用的默认值
+	defaultTag = "default"
+	// layoutTag time.Time字段的时间格式，默认为RFC3339，纯数字按unix秒解析
+	layoutTag = "layout"
+	// validateTag 校验规则，多个规则用逗号分隔：required,min=1,max=10,enum=a|b,regex=^[a-z]+$，
+	// regex会使用等号之后的所有内容，所以只能放在最后
+	validateTag = "validate"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+	regexpCache  sync.Map
+	// bindTypes 已经检查过的结构体类型以及检查的结果
+	bindTypes sync.Map
+)
+
+// ParseForm 按application/x-www-form-urlencoded解析参数，键和值都会做url解码，+解码为空格，
+// 没有=的键对应空字符串。解码失败的键值对会被跳过，返回第一个错误
+func ParseForm(content string) (map[string][]string, error) {
+	form := make(map[string][]string)
+	var firstErr error
+	for _, pair := range strings.Split(content, "&") {
+		if pair == "" {
+			continue
+		}
+
+		key, value := pair, ""
+		if i := strings.Index(pair, "="); i >= 0 {
+			key, value = pair[:i], pair[i+1:]
+		}
+		key, err := url.QueryUnescape(key)
+		if err == nil {
+			value, err = url.QueryUnescape(value)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		form[key] = append(form[key], value)
+	}
+	return form, firstErr
+}
+
+// FieldError 一个字段的绑定或者校验错误
+type FieldError struct {
+	// Field 结构体字段名
+	Field string `json:"field"`
+	// Param 参数名
+	Param string `json:"param"`
+	// Rule 没有通过的规则，类型转换失败时为type
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// BindError BindParams返回的所有字段错误，通过AsServletError转换成ErrorCodeBadRequest，
+// 字段错误放在响应的details中
+type BindError struct {
+	Fields []FieldError
+}
+
+func (e *BindError) Error() string {
+	messages := make([]string, 0, len(e.Fields))
+	for _, field := range e.Fields {
+		messages = append(messages, field.Param+": "+field.Message)
+	}
+	return "invalid parameters: " + strings.Join(messages, "; ")
+}
+
+// BindParams 按字段的param标签把请求参数填充到dst指向的结构体中，支持字符串、数字、bool、
+// time.Time、time.Duration、它们的切片和指针，重复的参数填充到切片中。没有param标签的匿名结构体字段会递归绑定。
+// 字段错误以*BindError返回，标签本身写错或者字段类型不支持时返回普通错误，AsServletError转换成ErrorCodeInternal
+func BindParams(request Request, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("BindParams needs a pointer to struct")
+	}
+	if err := checkBindType(v.Elem().Type()); err != nil {
+		return err
+	}
+
+	bindErr := &BindError{}
+	if err := bindStruct(request.ParameterMap(), v.Elem(), bindErr); err != nil {
+		return err
+	}
+	if len(bindErr.Fields) > 0 {
+		return bindErr
+	}
+	return nil
+}
+
+// checkBindType 第一次绑定结构体时检查字段的类型，不支持的类型是结构体的问题，不能当作参数错误返回给客户端
+func checkBindType(t reflect.Type) error {
+	if err, ok := bindTypes.Load(t); ok {
+		if err == nil {
+			return nil
+		}
+		return err.(error)
+	}
+	err := checkBindStruct(t)
+	bindTypes.Store(t, err)
+	return err
+}
+
+func checkBindStruct(t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup(paramTag)
+		if !ok {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				if err := checkBindStruct(field.Type); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if !bindableType(field.Type) {
+			return fmt.Errorf("field %s of %s: unsupported type %s", field.Name, t, field.Type)
+		}
+	}
+	return nil
+}
+
+// bindableType 与setField支持的类型一致
+func bindableType(t reflect.Type) bool {
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return bindableType(t.Elem())
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		return bindableValueType(t.Elem())
+	}
+	return bindableValueType(t)
+}
+
+// bindableValueType 与setValue支持的类型一致
+func bindableValueType(t reflect.Type) bool {
+	if t == durationType || t == timeType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
+	return false
+}
+
+func bindStruct(params map[string][]string, v reflect.Value, bindErr *BindError) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, ok := field.Tag.Lookup(paramTag)
+		if !ok {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				if err := bindStruct(params, v.Field(i), bindErr); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+
+		values, present := params[name]
+		if !present {
+			if def, ok := field.Tag.Lookup(defaultTag); ok {
+				values, present = []string{def}, true
+			}
+		}
+		fieldErr := func(rule string, message string) {
+			bindErr.Fields = append(bindErr.Fields, FieldError{Field: field.Name, Param: name, Rule: rule, Message: message})
+		}
+
+		if present {
+			if err := setField(v.Field(i), values, field.Tag.Get(layoutTag)); err != nil {
+				fieldErr("type", err.Error())
+				continue
+			}
+		}
+		if err := validateField(v.Field(i), present, field.Tag.Get(validateTag), fieldErr); err != nil {
+			return fmt.Errorf("field %s: %v", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func setField(v reflect.Value, values []string, layout string) error {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		ptr := reflect.New(v.Type().Elem())
+		if err := setField(ptr.Elem(), values, layout); err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		slice := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setValue(slice.Index(i), value, layout); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+		return nil
+	}
+	return setValue(v, values[len(values)-1], layout)
+}
+
+func setValue(v reflect.Value, value string, layout string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		v.SetInt(int64(d))
+		return nil
+	case v.Type() == timeType:
+		t, err := parseTime(value, layout)
+		if err != nil {
+			return fmt.Errorf("invalid time %q", value)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", value)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		v.SetBytes([]byte(value))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func parseTime(value string, layout string) (time.Time, error) {
+	if layout != "" {
+		return time.ParseInLocation(layout, value, time.Local)
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// validateField 执行校验规则，没有通过的规则通过fieldErr记录，规则本身错误时返回error
+func validateField(v reflect.Value, present bool, rules string, fieldErr func(rule string, message string)) error {
+	for rules != "" {
+		rule := rules
+		if strings.HasPrefix(rules, "regex=") {
+			rules = ""
+		} else if i := strings.Index(rules, ","); i >= 0 {
+			rule, rules = rules[:i], rules[i+1:]
+		} else {
+			rules = ""
+		}
+
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+		if name == "required" {
+			if !present {
+				fieldErr(name, "is required")
+				return nil
+			}
+			continue
+		}
+		if !present {
+			continue
+		}
+
+		ok, message, err := checkRule(v, name, arg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			fieldErr(name, message)
+		}
+	}
+	return nil
+}
+
+func checkRule(v reflect.Value, name string, arg string) (bool, string, error) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	switch name {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid %s %q", name, arg)
+		}
+		n, isLength := ruleNumber(v)
+		what := "value"
+		if isLength {
+			what = "length"
+		}
+		if name == "min" && n < limit {
+			return false, fmt.Sprintf("%s must be at least %s", what, arg), nil
+		}
+		if name == "max" && n > limit {
+			return false, fmt.Sprintf("%s must be at most %s", what, arg), nil
+		}
+	case "enum":
+		options := strings.Split(arg, "|")
+		for _, value := range ruleStrings(v) {
+			if !containsString(options, value) {
+				return false, fmt.Sprintf("must be one of %s", strings.Join(options, ", ")), nil
+			}
+		}
+	case "regex":
+		re, err := cachedRegexp(arg)
+		if err != nil {
+			return false, "", err
+		}
+		for _, value := range ruleStrings(v) {
+			if !re.MatchString(value) {
+				return false, "must match " + arg, nil
+			}
+		}
+	default:
+		return false, "", fmt.Errorf("unknown rule %q", name)
+	}
+	return true, "", nil
+}
+
+// ruleNumber min/max比较的值，字符串和切片使用长度
+func ruleNumber(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	case reflect.String, reflect.Slice:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+// ruleStrings enum和regex检查的值，切片检查每一个元素
+func ruleStrings(v reflect.Value) []string {
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		values := make([]string, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, fmt.Sprint(v.Index(i).Interface()))
+		}
+		return values
+	}
+	return []string{fmt.Sprint(v.Interface())}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func cachedRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	regexpCache.Store(pattern, re)
+	return re, nil
+}
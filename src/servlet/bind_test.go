@@ -0,0 +1,86 @@
+package servlet
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseForm(t *testing.T) {
+	form, err := ParseForm("name=a%20b+c&flag&tag=1&tag=2&&bad=%zz&k%3D=v%26")
+	if err == nil {
+		t.Fatal("malformed escape should be reported")
+	}
+	expected := map[string][]string{"name": {"a b c"}, "flag": {""}, "tag": {"1", "2"}, "k=": {"v&"}}
+	if !reflect.DeepEqual(form, expected) {
+		t.Fatalf("unexpected form %v", form)
+	}
+}
+
+type pageParams struct {
+	Page int `param:"page" default:"1" validate:"min=1"`
+}
+
+type searchParams struct {
+	pageParams
+	Name    string        `param:"name" validate:"required,min=2,regex=^[a-z,]+$"`
+	Sort    string        `param:"sort" default:"asc" validate:"enum=asc|desc"`
+	Ids     []int64       `param:"id" validate:"max=3"`
+	Online  *bool         `param:"online"`
+	Since   time.Time     `param:"since" layout:"2006-01-02"`
+	Timeout time.Duration `param:"timeout"`
+	Level   int           `param:"level" validate:"required,max=100"`
+}
+
+func TestBindParams(t *testing.T) {
+	var params searchParams
+	request := NewTcpquest(&recordConn{}, nil, RequestMessage{
+		Content: []byte("name=ab,c&id=1&id=2&online=true&since=2021-07-01&timeout=1.5s&level=3"),
+	})
+	if err := BindParams(request, &params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Page != 1 || params.Name != "ab,c" || params.Sort != "asc" || !reflect.DeepEqual(params.Ids, []int64{1, 2}) ||
+		params.Online == nil || !*params.Online || params.Since.Day() != 1 || params.Timeout != 1500*time.Millisecond || params.Level != 3 {
+		t.Fatalf("unexpected binding %+v", params)
+	}
+
+	request = NewTcpquest(&recordConn{}, nil, RequestMessage{
+		Content: []byte("page=0&name=A&sort=up&id=1&id=2&id=3&id=4&level=x"),
+	})
+	err := BindParams(request, &searchParams{})
+	bindErr, ok := err.(*BindError)
+	if !ok {
+		t.Fatalf("expected BindError, got %v", err)
+	}
+	var rules []string
+	for _, field := range bindErr.Fields {
+		rules = append(rules, field.Param+":"+field.Rule)
+	}
+	expected := []string{"page:min", "name:min", "name:regex", "sort:enum", "id:max", "level:type"}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("unexpected field errors %v", rules)
+	}
+	if servletErr := AsServletError(err); servletErr.Code != ErrorCodeBadRequest || servletErr.Details == nil {
+		t.Fatalf("BindError should map to a bad request with details, got %+v", servletErr)
+	}
+
+	if err := BindParams(NewTcpquest(&recordConn{}, nil, RequestMessage{}), &searchParams{}); err == nil {
+		t.Fatal("missing required params should fail")
+	}
+}
+
+type mapParams struct {
+	Name  string            `param:"name"`
+	Attrs map[string]string `param:"attrs"`
+}
+
+func TestBindUnsupportedType(t *testing.T) {
+	// 即使请求中没有这个参数，也应该作为服务端的错误返回
+	for _, content := range []string{"name=a", "name=a&attrs=x"} {
+		err := BindParams(NewTcpquest(&recordConn{}, nil, RequestMessage{Content: []byte(content)}), &mapParams{})
+		if servletErr := AsServletError(err); err == nil || servletErr.Code != ErrorCodeInternal {
+			t.Fatalf("%s: expected internal error, got %v", content, err)
+		}
+	}
+}
@@ -2,21 +2,32 @@ package servlet
 
 import (
 	"LearnGo/src/buffer"
+	"LearnGo/src/graceful"
+	"context"
 	"errors"
-	"github.com/panjf2000/gnet"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// TcpServer 把传输层事件转换成ConnPipeline上的事件，与具体的Transport实现无关
 type TcpServer struct {
-	*gnet.EventServer
-	onNewConn func(conn gnet.Conn)
-	InitConn func(conn gnet.Conn)
+	onNewConn func(conn Conn)
+	InitConn func(conn Conn)
+	Transport Transport
+	// SslContext 不为nil时在每个连接的pipeline最前面加上SslHandler
+	SslContext *SslContext
 }
 
 type ConnPipeline struct {
-	conn gnet.Conn
+	conn Conn
 	Head *ConnHandlerContext
 	Tail *ConnHandlerContext
+	attrMutex sync.RWMutex
+	attrs map[string]interface{}
+	closed bool
 }
 
 type ConnHandlerContext struct {
@@ -27,9 +38,9 @@ type ConnHandlerContext struct {
 	Prev *ConnHandlerContext
 }
 
-func NewTcpServer() *TcpServer {
-	tcpServer := TcpServer{}
-	tcpServer.onNewConn = func(conn gnet.Conn) {
+func NewTcpServer(transport Transport) *TcpServer {
+	tcpServer := TcpServer{Transport: transport}
+	tcpServer.onNewConn = func(conn Conn) {
 		var pipeline = NewConnPipeline(conn)
 		conn.SetContext(pipeline)
 	}
@@ -46,7 +57,7 @@ func isConnHandler(handler interface{}) bool {
 	return true
 }
 
-func NewConnPipeline(conn gnet.Conn) *ConnPipeline {
+func NewConnPipeline(conn Conn) *ConnPipeline {
 	var pipeline ConnPipeline
 	pipeline.conn = conn
 	pipeline.Head = &ConnHandlerContext{Name: "internal_head_handler", Handler: nil, Pipeline: &pipeline}
@@ -58,6 +69,47 @@ func NewConnPipeline(conn gnet.Conn) *ConnPipeline {
 	return &pipeline
 }
 
+// Conn 返回pipeline所属的连接
+func (pipeline *ConnPipeline) Conn() Conn {
+	return pipeline.conn
+}
+
+// IsActive 连接是否还没有关闭
+func (pipeline *ConnPipeline) IsActive() bool {
+	pipeline.attrMutex.RLock()
+	defer pipeline.attrMutex.RUnlock()
+
+	return !pipeline.closed
+}
+
+// Write 从pipeline尾部写出消息，会经过所有的OutboundHandler
+func (pipeline *ConnPipeline) Write(msg interface{}) {
+	pipeline.Tail.FireWrite(msg)
+}
+
+// Attr 获取连接上的属性，可以在任意goroutine中调用
+func (pipeline *ConnPipeline) Attr(key string) interface{} {
+	pipeline.attrMutex.RLock()
+	defer pipeline.attrMutex.RUnlock()
+
+	return pipeline.attrs[key]
+}
+
+// SetAttr 设置连接上的属性，value为nil时删除
+func (pipeline *ConnPipeline) SetAttr(key string, value interface{}) {
+	pipeline.attrMutex.Lock()
+	defer pipeline.attrMutex.Unlock()
+
+	if value == nil {
+		delete(pipeline.attrs, key)
+		return
+	}
+	if pipeline.attrs == nil {
+		pipeline.attrs = make(map[string]interface{})
+	}
+	pipeline.attrs[key] = value
+}
+
 func (pipeline *ConnPipeline) AddFirst(name string, handler interface{}) error  {
 	if !isConnHandler(handler) {
 		return errors.New("only support inboundhandler or outboundhandler")
@@ -186,37 +238,45 @@ type Decoder interface {
 	CallDecode(ctx ConnHandlerContext, in *buffer.ByteBuf, output *[]interface{})
 }
 
-func (es *TcpServer) OnInitComplete(svr gnet.Server) (action gnet.Action) {
-	return
+// Serve 在protoAddr上启动传输层，阻塞到服务停止
+func (es *TcpServer) Serve(protoAddr string) error {
+	return es.Transport.Serve(protoAddr, es)
 }
 
-func (es *TcpServer) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+// drain 平滑关闭时停止传输层
+func (es *TcpServer) drain(ctx context.Context) {
+	if err := es.Transport.Stop(ctx); err != nil {
+		log.Println("stop transport failed", err)
+	}
+}
+
+func (es *TcpServer) OnOpened(c Conn) {
 	es.onNewConn(c)
 	es.InitConn(c)
 	pipeline, ok := c.Context().(*ConnPipeline)
 	if ok {
+		if es.SslContext != nil {
+			pipeline.AddFirst(SslHandlerName, NewSslHandler(es.SslContext))
+		}
 		pipeline.Head.FireConnOpen()
 	}
-	return
 }
 
-func (es *TcpServer) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+func (es *TcpServer) OnClosed(c Conn, err error) {
 	pipeline, ok := c.Context().(*ConnPipeline)
 	if ok {
+		pipeline.attrMutex.Lock()
+		pipeline.closed = true
+		pipeline.attrMutex.Unlock()
 		pipeline.Head.FireConnClose(err)
 	}
-	return
 }
 
-func (es *TcpServer) PreWrite() {
-}
-
-func (es *TcpServer) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+func (es *TcpServer) OnData(c Conn, frame []byte) {
 	pipeline, ok := c.Context().(*ConnPipeline)
 	if ok {
 		pipeline.Head.FireMessageRead(&buffer.ByteBuffer { Data: frame })
 	}
-	return
 }
 
 func (c *ConnHandlerContext) FireConnOpen() {
@@ -276,19 +336,93 @@ func (c *ConnHandlerContext) getPrevOutboundHandlerContext() *ConnHandlerContext
 
 type TcpServerHandler interface {
 	Init(servlet Servlet, config ServletConfig, ctx ServletContext)
-	InitConn(conn gnet.Conn)
+	InitConn(conn Conn)
 }
 
-func StartTcpServer(handler TcpServerHandler) {
-	var servlet Servlet = &DispatchServlet{}
-	var servletConfig = NewXmlServletConfig("server.xml")
-	var context = &DefaultServletContext{}
+// StartTcpServer 使用gnet传输层启动服务，args为命令行中的配置参数，通常为os.Args[1:]
+func StartTcpServer(handler TcpServerHandler, args []string) {
+	StartServer(handler, NewGnetTransport(), "tcp://:9000", args)
+}
+
+// StartUdpServer 启动udp服务，pipeline中需要使用DatagramToMessageDecoder按数据报解码
+func StartUdpServer(handler TcpServerHandler, args []string) {
+	StartServer(handler, NewUdpTransport(), "udp://:9001", args)
+}
 
+// StartServer 使用指定的传输层启动服务，同一套handler和servlet可以运行在任意Transport上，
+// args中的--key=value作为配置加载，见LoadFlags
+func StartServer(handler TcpServerHandler, transport Transport, protoAddr string, args []string) {
+	servletConfig, err := LoadServletConfig(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if servletConfig.GetBool(DumpConfigKey, false) {
+		servletConfig.Dump(os.Stdout)
+	}
+	if servletConfig.GetBool(ConfigReferenceKey, false) {
+		WriteConfigReference(os.Stdout)
+		return
+	}
+	report := ValidateConfig(servletConfig)
+	for _, issue := range report.Unknown {
+		log.Println("config warning:", issue)
+	}
+	if err := report.Err(); err != nil {
+		log.Fatal(err)
+	}
+	servletConfig.SetValidator(func(config ServletConfig) error {
+		return ValidateConfig(config).Err()
+	})
+	servlet, err := loadServlet(servletConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var context = NewServletContext()
+	var sessionManager = NewSessionManager(servletConfig)
+	sessionStore, err := NewSessionStoreFromConfig(servletConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionManager.SetStore(sessionStore)
+	context.Set(SessionManagerKey, sessionManager)
+	context.Set(PushServiceKey, NewPushService(sessionManager))
+	context.Set(PubSubKey, NewPubSub(sessionManager))
+	var sslContext *SslContext
+	if servletConfig.GetString(SslCertFileKey, "") != "" {
+		if !strings.HasPrefix(protoAddr, "tcp") {
+			log.Fatal("ssl is only supported on tcp, not ", protoAddr)
+		}
+		if sslContext, err = NewSslContext(servletConfig); err != nil {
+			log.Fatal(err)
+		}
+		context.Set(SslContextKey, sslContext)
+	}
+	// handler自己实现了监听器接口时也会被注册
+	serverListeners.Add(handler)
+	serverListeners.bind(sessionManager)
+	sessionManager.Start()
+	servletConfig.Watch(servletConfig.GetDuration(ConfigReloadIntervalKey, 5*time.Second))
+
+	serverListeners.fireContextInitialized(context)
 	servlet.Init(servletConfig, context)
+	servlet = withListeners(servlet, serverListeners)
 	handler.Init(servlet, servletConfig, context)
 
-	var tcpServer = NewTcpServer()
+	var tcpServer = NewTcpServer(transport)
 	tcpServer.InitConn = handler.InitConn
-	log.Fatal(gnet.Serve(tcpServer, "tcp://:9000", gnet.WithMulticore(true), gnet.WithReusePort(true)))
-	log.Println("start suss")
+	tcpServer.SslContext = sslContext
+	graceful.OnShutdown(tcpServer.drain)
+	graceful.Watch()
+
+	err = tcpServer.Serve(protoAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	graceful.Wait()
+	servlet.Destroy()
+	servletConfig.StopWatch()
+	sessionManager.Stop()
+	serverListeners.fireContextDestroyed(context)
+	context.Stop()
+	log.Println("server stopped")
 }
\ No newline at end of file
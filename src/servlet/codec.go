@@ -0,0 +1,100 @@
+package servlet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"sync"
+)
+
+// CodecKey 配置中typed handler使用的编码方式，默认为json
+const CodecKey = "codec"
+
+// Codec typed handler请求内容和返回值的编码方式
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	codecMutex sync.RWMutex
+	codecs     = map[string]Codec{
+		"json":   JsonCodec{},
+		"gob":    GobCodec{},
+		"binary": BinaryCodec{},
+	}
+)
+
+// RegisterCodec 注册编码方式，同名的会被替换
+func RegisterCodec(codec Codec) {
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+
+	codecs[codec.Name()] = codec
+}
+
+// CodecByName 按名字获取编码方式，不存在时返回nil
+func CodecByName(name string) Codec {
+	codecMutex.RLock()
+	defer codecMutex.RUnlock()
+
+	return codecs[name]
+}
+
+// JsonCodec json编码
+type JsonCodec struct{}
+
+func (JsonCodec) Name() string {
+	return "json"
+}
+
+func (JsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec gob编码
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinaryCodec 按大端序把定长结构体的字段依次编码，与请求帧使用相同的字节序，
+// 结构体中只能包含定长的数字、bool和它们的数组
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, v)
+	return buf.Bytes(), err
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	return binary.Read(bytes.NewReader(data), binary.BigEndian, v)
+}
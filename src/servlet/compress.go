@@ -0,0 +1,211 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	CompressGzip    = "gzip"
+	CompressDeflate = "deflate"
+
+	// CompressAttr 握手协商的Compressor保存在连接pipeline上的属性名
+	CompressAttr = "servlet.compress"
+
+	CompressAlgorithmsKey  = "compressAlgorithms"
+	CompressThresholdKey   = "compressThreshold"
+	CompressLevelKey       = "compressLevel"
+	MaxDecompressedSizeKey = "maxDecompressedSize"
+)
+
+// compressConfigKeys 压缩使用的配置项，热加载关闭compress之后已经协商的连接仍然可以发送压缩的请求
+var compressConfigKeys = []ConfigKey{
+	{Key: CompressAlgorithmsKey, Type: ConfigTypeList, Default: []string{CompressGzip, CompressDeflate}, Description: "compression algorithms in order of preference"},
+	{Key: CompressThresholdKey, Type: ConfigTypeSize, Default: "1KB", Min: int64(0), Description: "responses smaller than this are not compressed"},
+	{Key: CompressLevelKey, Type: ConfigTypeInt, Default: flate.DefaultCompression, Min: flate.HuffmanOnly, Max: flate.BestCompression, Description: "compression level, -1 for default"},
+	{Key: MaxDecompressedSizeKey, Type: ConfigTypeSize, Default: "4MB", Min: int64(1), Description: "max size of a decompressed request"},
+}
+
+// CompressOptions 压缩参数，配置热加载之后整体替换
+type CompressOptions struct {
+	Enabled             bool
+	Algorithms          []string
+	Threshold           int64
+	Level               int
+	MaxDecompressedSize int64
+}
+
+// NewCompressOptions 从配置中读取压缩参数，不认识的压缩方式和不合法的level会被忽略
+func NewCompressOptions(config ServletConfig) *CompressOptions {
+	options := &CompressOptions{
+		Enabled:             config.GetBool(ActionCompress, false),
+		Threshold:           config.GetSize(CompressThresholdKey, 1<<10),
+		Level:               config.GetInt(CompressLevelKey, flate.DefaultCompression),
+		MaxDecompressedSize: config.GetSize(MaxDecompressedSizeKey, 4<<20),
+	}
+	for _, algorithm := range config.GetStringList(CompressAlgorithmsKey, []string{CompressGzip, CompressDeflate}) {
+		algorithm = strings.ToLower(algorithm)
+		if algorithm == CompressGzip || algorithm == CompressDeflate {
+			options.Algorithms = append(options.Algorithms, algorithm)
+		}
+	}
+	if options.Level < flate.HuffmanOnly || options.Level > flate.BestCompression {
+		options.Level = flate.DefaultCompression
+	}
+	return options
+}
+
+// negotiate 按服务器的偏好选择客户端也支持的压缩方式，没有时返回空字符串
+func (o *CompressOptions) negotiate(offered []string) string {
+	for _, algorithm := range o.Algorithms {
+		for _, value := range offered {
+			for _, name := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(name), algorithm) {
+					return algorithm
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Compressor 连接握手时协商的压缩方式，压缩参数每次从servlet读取，配置热加载之后立即生效
+type Compressor struct {
+	algorithm string
+	options   func() *CompressOptions
+}
+
+// NewCompressor 创建压缩方式为algorithm的Compressor，options返回当前的压缩参数
+func NewCompressor(algorithm string, options func() *CompressOptions) *Compressor {
+	return &Compressor{algorithm: algorithm, options: options}
+}
+
+func (c *Compressor) Algorithm() string {
+	return c.algorithm
+}
+
+// Compress 启用了压缩并且内容不小于阈值时压缩，压缩之后没有变小时返回原内容，第二个返回值表示是否压缩了
+func (c *Compressor) Compress(data []byte) ([]byte, bool) {
+	options := c.options()
+	if !options.Enabled || int64(len(data)) < options.Threshold || len(data) == 0 {
+		return data, false
+	}
+
+	pool := compressWriterPool(c.algorithm, options.Level)
+	var buf bytes.Buffer
+	writer := pool.Get().(compressWriter)
+	writer.Reset(&buf)
+	_, err := writer.Write(data)
+	if err == nil {
+		err = writer.Close()
+	}
+	pool.Put(writer)
+	if err != nil || buf.Len() >= len(data) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+// Decompress 解压请求内容，解压之后超过maxDecompressedSize时返回DecompressTooLarge
+func (c *Compressor) Decompress(data []byte) ([]byte, error) {
+	var reader io.ReadCloser
+	switch c.algorithm {
+	case CompressGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		reader = r
+	case CompressDeflate:
+		reader = flate.NewReader(bytes.NewReader(data))
+	default:
+		return nil, internalErrors.NotSupport
+	}
+	defer reader.Close()
+
+	max := c.options().MaxDecompressedSize
+	content, err := ioutil.ReadAll(io.LimitReader(reader, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > max {
+		return nil, internalErrors.DecompressTooLarge
+	}
+	return content, nil
+}
+
+// compressWriter gzip.Writer和flate.Writer共同的方法
+type compressWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compressWriterPools 按压缩方式和level复用writer，创建writer的开销远大于压缩一个小消息
+var compressWriterPools sync.Map
+
+type compressPoolKey struct {
+	algorithm string
+	level     int
+}
+
+func compressWriterPool(algorithm string, level int) *sync.Pool {
+	key := compressPoolKey{algorithm: algorithm, level: level}
+	if pool, ok := compressWriterPools.Load(key); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := compressWriterPools.LoadOrStore(key, &sync.Pool{New: func() interface{} {
+		// level已经在NewCompressOptions中检查过，不会返回错误
+		if algorithm == CompressGzip {
+			writer, _ := gzip.NewWriterLevel(ioutil.Discard, level)
+			return writer
+		}
+		writer, _ := flate.NewWriter(ioutil.Discard, level)
+		return writer
+	}})
+	return pool.(*sync.Pool)
+}
+
+// compressorOf 连接上协商的Compressor，没有握手或者没有选择压缩方式时返回nil
+func compressorOf(conn Conn) *Compressor {
+	if conn == nil {
+		return nil
+	}
+	pipeline, ok := conn.Context().(*ConnPipeline)
+	if !ok {
+		return nil
+	}
+	compressor, _ := pipeline.Attr(CompressAttr).(*Compressor)
+	return compressor
+}
+
+// compressBody 按连接协商的方式压缩响应或者推送的内容
+func compressBody(conn Conn, body []byte) ([]byte, bool) {
+	if compressor := compressorOf(conn); compressor != nil {
+		return compressor.Compress(body)
+	}
+	return body, false
+}
+
+// decompress 内容经过压缩时使用连接协商的方式解压
+func (t *TcpRequest) decompress() error {
+	if !t.flags.Compressed() {
+		return nil
+	}
+	compressor := compressorOf(t.conn)
+	if compressor == nil {
+		return NewServletError(ErrorCodeBadRequest, "compression was not negotiated")
+	}
+	content, err := compressor.Decompress(t.content)
+	if err != nil {
+		return &ServletError{Code: ErrorCodeBadRequest, Message: "invalid compressed content", Err: err}
+	}
+	t.content = content
+	t.parseFlag = false
+	return nil
+}
@@ -0,0 +1,125 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newCompressServlet(t *testing.T, args ...string) *DispatchServlet {
+	config := NewLayeredServletConfig()
+	config.LoadFlags(args)
+	servlet := &DispatchServlet{}
+	servlet.Init(config, NewServletContext())
+	return servlet
+}
+
+func TestCompressor(t *testing.T) {
+	servlet := newCompressServlet(t, "-compress=true", "-compressThreshold=64", "-maxDecompressedSize=4KB")
+	data := []byte(strings.Repeat("hello world ", 100))
+
+	for _, algorithm := range []string{CompressGzip, CompressDeflate} {
+		compressor := NewCompressor(algorithm, servlet.CompressOptions)
+		compressed, ok := compressor.Compress(data)
+		if !ok || len(compressed) >= len(data) {
+			t.Fatalf("%s: compressed %v, %d bytes", algorithm, ok, len(compressed))
+		}
+		content, err := compressor.Decompress(compressed)
+		if err != nil || !bytes.Equal(content, data) {
+			t.Fatalf("%s: decompress %v", algorithm, err)
+		}
+
+		if _, ok := compressor.Compress(data[:63]); ok {
+			t.Errorf("%s: compressed below threshold", algorithm)
+		}
+		bomb, _ := compressor.Compress(make([]byte, 4<<10+1))
+		if _, err := compressor.Decompress(bomb); !errors.Is(err, internalErrors.DecompressTooLarge) {
+			t.Errorf("%s: decompress bomb %v", algorithm, err)
+		}
+	}
+
+	if _, ok := NewCompressor(CompressGzip, newCompressServlet(t).CompressOptions).Compress(data); ok {
+		t.Error("compressed while compress is disabled")
+	}
+}
+
+func TestHandshakeCompress(t *testing.T) {
+	servlet := newCompressServlet(t, "-compress=true", "-compressAlgorithms=deflate,gzip", "-compressThreshold=16")
+	servlet.AddHandler("echo", func(request Request, response Response) {
+		WriteMessage(request, response, "echo", request.Content())
+	})
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	content := []byte(strings.Repeat("a", 100))
+	request := NewTcpquest(conn, nil, RequestMessage{Command: "echo", RequestId: 1, Content: content})
+	if err := servlet.Service(request, NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if reply := decodeTcpMessage(t, conn.last()); reply.Flags.Compressed() || !bytes.Equal(reply.Content, content) {
+		t.Fatalf("compressed before handshake: %+v", reply)
+	}
+
+	handshake := NewTcpquest(conn, nil, RequestMessage{Command: HandshakeCommand, RequestId: 2, Content: []byte("compress=gzip")})
+	if err := servlet.Service(handshake, NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if reply := decodeTcpMessage(t, conn.last()); reply.Flags.Compressed() || string(reply.Content) != "compress=gzip" {
+		t.Fatalf("handshake reply %+v", reply)
+	}
+
+	compressor := NewCompressor(CompressGzip, servlet.CompressOptions)
+	compressed, _ := compressor.Compress(content)
+	request = NewTcpquest(conn, nil, RequestMessage{Command: "echo", RequestId: 3, Content: compressed, Flags: MessageFlagCompressed})
+	if err := servlet.Service(request, NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	reply := decodeTcpMessage(t, conn.last())
+	if !reply.Flags.Compressed() || reply.RequestId != 3 {
+		t.Fatalf("reply %+v", reply)
+	}
+	if body, err := compressor.Decompress(reply.Content); err != nil || !bytes.Equal(body, content) {
+		t.Fatalf("reply content %v", err)
+	}
+
+	other := &recordConn{}
+	other.SetContext(NewConnPipeline(other))
+	request = NewTcpquest(other, nil, RequestMessage{Command: "echo", Content: compressed, Flags: MessageFlagCompressed})
+	var servletErr *ServletError
+	if err := servlet.Service(request, NewTcpResponse(other)); !errors.As(err, &servletErr) || servletErr.Code != ErrorCodeBadRequest {
+		t.Errorf("compressed request without handshake: %v", err)
+	}
+}
+
+// serviceRecorder 记录Service返回的错误，http的分发handler只打印错误
+type serviceRecorder struct {
+	*DispatchServlet
+	err error
+}
+
+func (r *serviceRecorder) Service(request Request, response Response) error {
+	r.err = r.DispatchServlet.Service(request, response)
+	return r.err
+}
+
+func TestHandshakeCompressHttp(t *testing.T) {
+	servlet := &serviceRecorder{DispatchServlet: newCompressServlet(t, "-compress=true")}
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	AddHttpHandlers(pipeline, servlet, nil)
+
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte("GET /handshake?compress=gzip HTTP/1.1\r\nHost: x\r\n\r\n")})
+	if servlet.err != nil {
+		t.Fatal(servlet.err)
+	}
+	if len(conn.writes) != 1 || !strings.HasPrefix(string(conn.last()), "HTTP/1.1 200 OK\r\n") {
+		t.Fatalf("http handshake %q", conn.writes)
+	}
+	if pipeline.Attr(CompressAttr) != nil {
+		t.Error("http handshake should not negotiate on the connection")
+	}
+}
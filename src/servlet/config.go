@@ -0,0 +1,410 @@
+package servlet
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigError 配置文件中一个属性的解析错误
+type ConfigError struct {
+	File string
+	Line int
+	Key  string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s:%d: %s: %v", e.File, e.Line, e.Key, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigErrors 一个配置文件中的所有解析错误
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// XmlServletConfig xml类型配置文件，属性可以放在init-param的props中，也可以放在section中，
+// section中的属性key为section名加上.，例如<section name="network"><property name="port"/></section>的key为network.port，
+// section可以嵌套，属性值中的${ENV:default}会替换成环境变量
+type XmlServletConfig struct {
+	configGetter
+	config map[string]interface{}
+}
+
+func newXmlServletConfig() *XmlServletConfig {
+	config := &XmlServletConfig{config: make(map[string]interface{})}
+	config.get = config.Get
+	return config
+}
+
+// NewXmlServletConfig 创建新的xml配置文件，文件不存在时为空配置，解析错误会打印日志，
+// 解析失败的属性不会被设置
+func NewXmlServletConfig(path string) *XmlServletConfig {
+	config, err := LoadXmlServletConfig(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	return config
+}
+
+// LoadXmlServletConfig 读取xml配置文件，返回的配置总是可用的，只包含解析成功的属性，
+// 解析错误以ConfigErrors返回
+func LoadXmlServletConfig(path string) (*XmlServletConfig, error) {
+	config := newXmlServletConfig()
+	return config, config.parse(path)
+}
+
+// xmlProperty <property name="" type="">value</property>，
+// list类型可以使用<value>子元素，map类型使用<entry key="">子元素
+type xmlProperty struct {
+	Name    string   `xml:"name,attr"`
+	Type    string   `xml:"type,attr"`
+	Value   string   `xml:",chardata"`
+	Values  []string `xml:"value"`
+	Entries []struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"entry"`
+}
+
+func (servlet *XmlServletConfig) parse(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return servlet.parseContent(path, content)
+}
+
+// parseContent 解析配置文件的内容，path只用于错误信息
+func (servlet *XmlServletConfig) parseContent(path string, content []byte) error {
+	var errs ConfigErrors
+	var sections []string
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{File: path, Line: lineAt(content, decoder.InputOffset()), Err: err})
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "servlet", "init-param", "props":
+			case "section":
+				sections = append(sections, attrValue(t, "name"))
+			case "property":
+				var p xmlProperty
+				if err := decoder.DecodeElement(&p, &t); err != nil {
+					errs = append(errs, &ConfigError{File: path, Line: lineAt(content, offset), Err: err})
+					break
+				}
+				key := strings.Join(append(append([]string{}, sections...), p.Name), ".")
+				value, err := parsePropertyValue(&p)
+				if err != nil {
+					errs = append(errs, &ConfigError{File: path, Line: lineAt(content, offset), Key: key, Err: err})
+					break
+				}
+				servlet.config[key] = value
+			default:
+				decoder.Skip()
+			}
+		case xml.EndElement:
+			if t.Name.Local == "section" && len(sections) > 0 {
+				sections = sections[:len(sections)-1]
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// lineAt offset所在的行，从1开始
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+func attrValue(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func parsePropertyValue(p *xmlProperty) (interface{}, error) {
+	raw := interpolate(p.Value)
+	value := strings.TrimSpace(raw)
+	switch p.Type {
+	case "", "string":
+		return raw, nil
+	case "bool", "boolean":
+		return strconv.ParseBool(value)
+	case "int", "integer":
+		return strconv.Atoi(value)
+	case "int64", "long":
+		return strconv.ParseInt(value, 10, 64)
+	case "float", "double":
+		return strconv.ParseFloat(value, 64)
+	case "duration":
+		return time.ParseDuration(value)
+	case "size":
+		return ParseSize(value)
+	case "list":
+		if len(p.Values) > 0 {
+			values := make([]string, 0, len(p.Values))
+			for _, v := range p.Values {
+				values = append(values, strings.TrimSpace(interpolate(v)))
+			}
+			return values, nil
+		}
+		return splitList(value), nil
+	case "map":
+		values := make(map[string]string, len(p.Entries))
+		for _, entry := range p.Entries {
+			values[entry.Key] = strings.TrimSpace(interpolate(entry.Value))
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown type %q", p.Type)
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	values := strings.Split(value, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
+// ParseSize 解析大小，例如512、64KB、64MB、1GB，单位不区分大小写，按1024换算，KiB等写法也可以使用
+func ParseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.Replace(s, "IB", "B", 1), "B")
+
+	multiple := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			multiple = 1 << 10
+		case 'M':
+			multiple = 1 << 20
+		case 'G':
+			multiple = 1 << 30
+		case 'T':
+			multiple = 1 << 40
+		}
+		if multiple > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(n * float64(multiple)), nil
+}
+
+func (servlet *XmlServletConfig) Get(key string) interface{} {
+	v, ok := servlet.config[key]
+	if ok {
+		return v
+	}
+	return nil
+}
+
+// Keys 所有解析成功的key
+func (servlet *XmlServletConfig) Keys() []string {
+	keys := make([]string, 0, len(servlet.config))
+	for key := range servlet.config {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Section section下的所有属性，key去掉了section的前缀
+func (servlet *XmlServletConfig) Section(name string) *XmlServletConfig {
+	prefix := name + "."
+	section := newXmlServletConfig()
+	for key, value := range servlet.config {
+		if strings.HasPrefix(key, prefix) {
+			section.config[key[len(prefix):]] = value
+		}
+	}
+	return section
+}
+
+// configGetter 基于get实现ServletConfig中的类型转换方法，字符串类型的值会按需要的类型解析
+type configGetter struct {
+	get func(key string) interface{}
+}
+
+// GetString 获取字符串，数字等其它类型会格式化成字符串，不存在时返回defaultValue
+func (c configGetter) GetString(key string, defaultValue string) string {
+	switch v := c.get(key).(type) {
+	case nil:
+		return defaultValue
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// GetInt 获取int，与GetInt64的转换规则相同，不存在或者无法转换时返回defaultValue
+func (c configGetter) GetInt(key string, defaultValue int) int {
+	return int(c.GetInt64(key, int64(defaultValue)))
+}
+
+// GetInt64 获取int64，字符串会被解析，time.Duration按毫秒转换，与GetDuration把整数作为毫秒对应，
+// 不存在或者无法转换时返回defaultValue
+func (c configGetter) GetInt64(key string, defaultValue int64) int64 {
+	switch v := c.get(key).(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case time.Duration:
+		return int64(v / time.Millisecond)
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n
+		}
+	}
+	return defaultValue
+}
+
+// GetFloat 获取float64，不存在或者无法转换时返回defaultValue
+func (c configGetter) GetFloat(key string, defaultValue float64) float64 {
+	switch v := c.get(key).(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f
+		}
+	}
+	return defaultValue
+}
+
+// GetBool 获取bool，不存在或者无法转换时返回defaultValue
+func (c configGetter) GetBool(key string, defaultValue bool) bool {
+	switch v := c.get(key).(type) {
+	case bool:
+		return v
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// GetDuration 获取时间长度，int类型的值按毫秒处理，字符串按time.ParseDuration解析，
+// 不存在或者无法转换时返回defaultValue
+func (c configGetter) GetDuration(key string, defaultValue time.Duration) time.Duration {
+	switch v := c.get(key).(type) {
+	case time.Duration:
+		return v
+	case int:
+		return time.Duration(v) * time.Millisecond
+	case int64:
+		return time.Duration(v) * time.Millisecond
+	case string:
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// GetSize 获取字节数，字符串按ParseSize解析，不存在或者无法转换时返回defaultValue
+func (c configGetter) GetSize(key string, defaultValue int64) int64 {
+	if v, ok := c.get(key).(string); ok {
+		if n, err := ParseSize(v); err == nil {
+			return n
+		}
+		return defaultValue
+	}
+	return c.GetInt64(key, defaultValue)
+}
+
+// GetStringList 获取字符串列表，字符串按逗号分割，不存在时返回defaultValue
+func (c configGetter) GetStringList(key string, defaultValue []string) []string {
+	switch v := c.get(key).(type) {
+	case []string:
+		return v
+	case string:
+		return splitList(v)
+	}
+	return defaultValue
+}
+
+// GetStringMap 获取字符串map，不存在时返回defaultValue
+func (c configGetter) GetStringMap(key string, defaultValue map[string]string) map[string]string {
+	if v, ok := c.get(key).(map[string]string); ok {
+		return v
+	}
+	return defaultValue
+}
+
+func (c configGetter) GetSessionTickTime() int {
+	return c.GetInt("sessionTickTime", 20000)
+}
+
+func (c configGetter) GetSessionTimeoutMillis() int {
+	return c.GetInt("sessionTimeoutTime", 180000)
+}
+
+func (c configGetter) GetSessionEmptyTimeoutMillis() int {
+	return c.GetInt("sessionEmptyTimeoutTime", 40000)
+}
+
+func (c configGetter) GetSessionInvalidateMillis() int {
+	return c.GetInt("sessionInvalidateMillis", 86400000)
+}
+
+func (c configGetter) GetSessionNextDayInvalidateMillis() int {
+	return c.GetInt("sessionNextDayInvalidateMillis", 1800000)
+}
@@ -0,0 +1,380 @@
+package servlet
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigType 配置项的类型，与xml中property的type一致
+type ConfigType string
+
+const (
+	ConfigTypeString   ConfigType = "string"
+	ConfigTypeBool     ConfigType = "bool"
+	ConfigTypeInt      ConfigType = "int"
+	ConfigTypeFloat    ConfigType = "float"
+	ConfigTypeDuration ConfigType = "duration"
+	ConfigTypeSize     ConfigType = "size"
+	ConfigTypeList     ConfigType = "list"
+	ConfigTypeMap      ConfigType = "map"
+)
+
+// ConfigKey 一个配置项的声明，Key以.*结尾时声明的是一组前缀相同的配置项，例如rateLimit.*。
+// Min和Max为nil时不限制，类型与配置项相同，例如duration使用time.Duration，size使用字节数
+type ConfigKey struct {
+	Key         string
+	Type        ConfigType
+	Default     interface{}
+	Min         interface{}
+	Max         interface{}
+	Enum        []string
+	Description string
+}
+
+func (k ConfigKey) prefix() (string, bool) {
+	if strings.HasSuffix(k.Key, ".*") {
+		return k.Key[:len(k.Key)-1], true
+	}
+	return "", false
+}
+
+var (
+	schemaMutex  sync.RWMutex
+	configSchema = map[string]ConfigKey{}
+)
+
+func init() {
+	DeclareConfig(servletConfigKeys...)
+	DeclareConfig(compressConfigKeys...)
+	DeclareConfig(encryptConfigKeys...)
+	DeclareConfig(sslConfigKeys...)
+	DeclareConfig(websocketConfigKeys...)
+	DeclareConfig(sessionConfigKeys...)
+	DeclareConfig(sessionStoreConfigKeys...)
+	DeclareConfig(pushConfigKeys...)
+	DeclareConfig(loaderConfigKeys...)
+	DeclareConfig(descriptorConfigKeys...)
+}
+
+// DeclareConfig 声明组件使用的配置项，同名的会被替换。StartServer在启动时校验配置，其它包的组件需要在init中声明
+func DeclareConfig(keys ...ConfigKey) {
+	schemaMutex.Lock()
+	defer schemaMutex.Unlock()
+
+	for _, key := range keys {
+		configSchema[normalizeConfigKey(key.Key)] = key
+	}
+}
+
+// ConfigSchema 按key排序的所有声明
+func ConfigSchema() []ConfigKey {
+	schemaMutex.RLock()
+	keys := make([]ConfigKey, 0, len(configSchema))
+	for _, key := range configSchema {
+		keys = append(keys, key)
+	}
+	schemaMutex.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// lookupConfigKey 查找key的声明，忽略大小写以及.、_、-，没有精确的声明时使用最长的前缀声明
+func lookupConfigKey(key string) (ConfigKey, bool) {
+	schemaMutex.RLock()
+	defer schemaMutex.RUnlock()
+
+	normalized := normalizeConfigKey(key)
+	if declared, ok := configSchema[normalized]; ok {
+		return declared, true
+	}
+
+	var found ConfigKey
+	longest := -1
+	for _, declared := range configSchema {
+		prefix, ok := declared.prefix()
+		if !ok {
+			continue
+		}
+		if p := normalizeConfigKey(prefix); strings.HasPrefix(normalized, p) && len(p) > longest {
+			found, longest = declared, len(p)
+		}
+	}
+	return found, longest >= 0
+}
+
+// ConfigIssue 校验时发现的一个问题
+type ConfigIssue struct {
+	Key     string
+	Source  string
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	if i.Source == "" {
+		return i.Key + ": " + i.Message
+	}
+	return fmt.Sprintf("%s (%s): %s", i.Key, i.Source, i.Message)
+}
+
+// ConfigReport 配置的校验结果，Invalid为值不合法的配置项，Unknown为没有声明的配置项
+type ConfigReport struct {
+	Invalid []ConfigIssue
+	Unknown []ConfigIssue
+}
+
+// Err 有不合法的配置项时返回错误，没有声明的配置项只需要提示
+func (r *ConfigReport) Err() error {
+	if len(r.Invalid) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(r.Invalid))
+	for _, issue := range r.Invalid {
+		messages = append(messages, issue.String())
+	}
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(messages, "\n  "))
+}
+
+// configKeys 可以列出所有key的ServletConfig
+type configKeys interface {
+	Keys() []string
+}
+
+// configSource 可以给出配置来源的ServletConfig
+type configSource interface {
+	Source(key string) string
+}
+
+// ValidateConfig 按声明检查config中所有的配置项，config需要实现Keys才能检查没有声明的配置项，
+// 否则只检查已经声明的配置项
+func ValidateConfig(config ServletConfig) *ConfigReport {
+	report := &ConfigReport{}
+	source := func(key string) string {
+		if s, ok := config.(configSource); ok {
+			return s.Source(key)
+		}
+		return ""
+	}
+
+	var keys []string
+	if k, ok := config.(configKeys); ok {
+		keys = k.Keys()
+	} else {
+		for _, declared := range ConfigSchema() {
+			if _, ok := declared.prefix(); !ok {
+				keys = append(keys, declared.Key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := config.Get(key)
+		if value == nil {
+			continue
+		}
+		declared, ok := lookupConfigKey(key)
+		if !ok {
+			message := "unknown key"
+			if suggestion := suggestConfigKey(key); suggestion != "" {
+				message += ", did you mean " + suggestion + "?"
+			}
+			report.Unknown = append(report.Unknown, ConfigIssue{Key: key, Source: source(key), Message: message})
+			continue
+		}
+		if err := declared.validate(value); err != nil {
+			report.Invalid = append(report.Invalid, ConfigIssue{Key: key, Source: source(key), Message: err.Error()})
+		}
+	}
+	return report
+}
+
+// validate 检查值能否按声明的类型读取，以及是否在范围内
+func (k ConfigKey) validate(value interface{}) error {
+	var n float64
+	var numeric bool
+	switch k.Type {
+	case "", ConfigTypeString:
+		if s, ok := value.(string); ok && len(k.Enum) > 0 && !containsString(k.Enum, s) {
+			return fmt.Errorf("%q is not one of %s", s, strings.Join(k.Enum, ", "))
+		}
+		return nil
+	case ConfigTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return nil
+		case string:
+			if _, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return nil
+			}
+		}
+	case ConfigTypeInt:
+		switch v := value.(type) {
+		case int:
+			n, numeric = float64(v), true
+		case int64:
+			n, numeric = float64(v), true
+		case time.Duration:
+			// type="duration"的属性，按GetInt64的方式转换成毫秒
+			n, numeric = float64(v/time.Millisecond), true
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				n, numeric = float64(i), true
+			}
+		}
+	case ConfigTypeFloat:
+		switch v := value.(type) {
+		case float64:
+			n, numeric = v, true
+		case int:
+			n, numeric = float64(v), true
+		case int64:
+			n, numeric = float64(v), true
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				n, numeric = f, true
+			}
+		}
+	case ConfigTypeDuration:
+		switch v := value.(type) {
+		case time.Duration:
+			n, numeric = float64(v), true
+		case int:
+			n, numeric = float64(time.Duration(v)*time.Millisecond), true
+		case int64:
+			n, numeric = float64(time.Duration(v)*time.Millisecond), true
+		case string:
+			if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+				n, numeric = float64(d), true
+			}
+		}
+	case ConfigTypeSize:
+		switch v := value.(type) {
+		case int:
+			n, numeric = float64(v), true
+		case int64:
+			n, numeric = float64(v), true
+		case string:
+			if size, err := ParseSize(v); err == nil {
+				n, numeric = float64(size), true
+			}
+		}
+	case ConfigTypeList:
+		switch value.(type) {
+		case []string, string:
+			return nil
+		}
+	case ConfigTypeMap:
+		if _, ok := value.(map[string]string); ok {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown type %q in schema", k.Type)
+	}
+
+	if !numeric {
+		return fmt.Errorf("%v is not a valid %s", value, k.Type)
+	}
+	if min, ok := schemaNumber(k.Min); ok && n < min {
+		return fmt.Errorf("%v is less than %v", value, k.Min)
+	}
+	if max, ok := schemaNumber(k.Max); ok && n > max {
+		return fmt.Errorf("%v is greater than %v", value, k.Max)
+	}
+	return nil
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Duration:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// suggestConfigKey 找到与key最接近的声明，编辑距离不超过2或者只是大小写、分隔符不同时返回
+func suggestConfigKey(key string) string {
+	best, bestDistance := "", 3
+	lower := strings.ToLower(key)
+	for _, declared := range ConfigSchema() {
+		if _, ok := declared.prefix(); ok {
+			continue
+		}
+		distance := editDistance(lower, strings.ToLower(declared.Key))
+		if strings.HasPrefix(strings.ToLower(declared.Key), lower) || strings.HasPrefix(lower, strings.ToLower(declared.Key)) {
+			distance = 1
+		}
+		if distance < bestDistance {
+			best, bestDistance = declared.Key, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(prev[j]+1, current[j-1]+1), prev[j-1]+cost)
+		}
+		prev, current = current, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// WriteConfigReference 按key的顺序输出所有声明的配置项，格式为markdown表格
+func WriteConfigReference(w io.Writer) {
+	fmt.Fprintln(w, "| Key | Type | Default | Range | Description |")
+	fmt.Fprintln(w, "| --- | --- | --- | --- | --- |")
+	for _, key := range ConfigSchema() {
+		configType := key.Type
+		if configType == "" {
+			configType = ConfigTypeString
+		}
+		def := ""
+		if key.Default != nil {
+			def = fmt.Sprint(key.Default)
+		}
+
+		var ranges []string
+		if key.Min != nil {
+			ranges = append(ranges, fmt.Sprintf(">= %v", key.Min))
+		}
+		if key.Max != nil {
+			ranges = append(ranges, fmt.Sprintf("<= %v", key.Max))
+		}
+		if len(key.Enum) > 0 {
+			ranges = append(ranges, strings.Join(key.Enum, " \\| "))
+		}
+		fmt.Fprintf(w, "| %s | %s | %s | %s | %s |\n", key.Key, configType, def, strings.Join(ranges, ", "), key.Description)
+	}
+}
@@ -0,0 +1,121 @@
+package servlet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// declareTestConfig 声明测试使用的配置项，测试结束之后从全局的声明中删除
+func declareTestConfig(t *testing.T, keys ...ConfigKey) {
+	DeclareConfig(keys...)
+	t.Cleanup(func() {
+		schemaMutex.Lock()
+		defer schemaMutex.Unlock()
+		for _, key := range keys {
+			delete(configSchema, normalizeConfigKey(key.Key))
+		}
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := NewLayeredServletConfig()
+	config.LoadEnv(EnvPrefix, []string{"LEARNGO_SESSION_TICK_TIME=0", "LEARNGO_PUSH_QUEUE_TTL=1h"})
+	config.LoadFlags([]string{"--compress=maybe", "--pushQueueOverflow=block", "--rateLimit.player.login=-1", "--codec=gob"})
+	path := writeConfig(t, `<servlet><props>
+		<property name="sessionTimeout" type="int">100000</property>
+		<property name="testMaxBody" type="size">1MB</property>
+	</props></servlet>`)
+	if err := config.LoadXml(path); err != nil {
+		t.Fatal(err)
+	}
+
+	report := ValidateConfig(config)
+	invalid := map[string]bool{}
+	for _, issue := range report.Invalid {
+		invalid[issue.Key] = true
+	}
+	for _, key := range []string{"session.tick.time", "compress", "pushQueueOverflow", "rateLimit.player.login"} {
+		if !invalid[key] {
+			t.Errorf("%s should be invalid: %v", key, report.Invalid)
+		}
+	}
+	if len(report.Invalid) != 4 || report.Err() == nil {
+		t.Errorf("invalid %v", report.Invalid)
+	}
+
+	if len(report.Unknown) != 2 {
+		t.Fatalf("unknown %v", report.Unknown)
+	}
+	if issue := report.Unknown[0]; issue.Key != "sessionTimeout" || !strings.Contains(issue.Message, "did you mean sessionTimeoutTime?") ||
+		issue.Source != "xml:"+path {
+		t.Errorf("unknown %v", issue)
+	}
+
+	declareTestConfig(t, ConfigKey{Key: "testMaxBody", Type: ConfigTypeSize, Max: int64(512 << 10)})
+	if report := ValidateConfig(config); len(report.Unknown) != 1 || len(report.Invalid) != 5 {
+		t.Errorf("testMaxBody should be checked against declaration: %v %v", report.Unknown, report.Invalid)
+	}
+}
+
+func TestReloadRejectedBySchema(t *testing.T) {
+	path := writeConfig(t, `<servlet><props><property name="sessionTickTime" type="int">1000</property></props></servlet>`)
+	config := NewLayeredServletConfig()
+	config.LoadXml(path)
+	config.SetValidator(func(config ServletConfig) error {
+		return ValidateConfig(config).Err()
+	})
+
+	rewriteConfig(t, path, `<servlet><props><property name="sessionTickTime" type="int">-1</property></props></servlet>`, time.Now().Add(time.Second))
+	if err := config.Reload(); err == nil {
+		t.Fatal("expect reload to be rejected")
+	}
+	if v := config.GetSessionTickTime(); v != 1000 {
+		t.Errorf("sessionTickTime %d", v)
+	}
+}
+
+func TestWriteConfigReference(t *testing.T) {
+	var reference strings.Builder
+	WriteConfigReference(&reference)
+	if !strings.Contains(reference.String(), "| pushQueueOverflow | string | dropOldest | dropOldest \\| disconnect |") ||
+		!strings.Contains(reference.String(), "| sessionTickTime | int | 20000 | >= 1 |") {
+		t.Error(reference.String())
+	}
+}
+
+func TestSchemaDefaults(t *testing.T) {
+	config := NewLayeredServletConfig()
+	config.SetDefault("sessionTickTime", 500)
+	config.LoadSchemaDefaults()
+	config.LoadFlags([]string{"--compressThreshold=2KB"})
+
+	if v := config.GetSessionTickTime(); v != 500 {
+		t.Errorf("SetDefault should not be replaced: %d", v)
+	}
+	if v := config.GetSessionTimeoutMillis(); v != 180000 || config.Source("sessionTimeoutTime") != "default" {
+		t.Errorf("sessionTimeoutTime %d %s", v, config.Source("sessionTimeoutTime"))
+	}
+	if options := NewCompressOptions(config); options.Threshold != 2<<10 || options.MaxDecompressedSize != 4<<20 {
+		t.Errorf("compress options %+v", options)
+	}
+	if report := ValidateConfig(config); len(report.Unknown) != 0 || len(report.Invalid) != 0 {
+		t.Errorf("schema defaults should be valid: %v %v", report.Unknown, report.Invalid)
+	}
+}
+
+func TestValidateDurationAsInt(t *testing.T) {
+	config := NewLayeredServletConfig()
+	path := writeConfig(t, `<servlet><props>
+		<property name="sessionTimeoutTime" type="duration">5m</property>
+	</props></servlet>`)
+	if err := config.LoadXml(path); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := config.GetInt("sessionTimeoutTime", 0); timeout != 300000 {
+		t.Fatalf("unexpected sessionTimeoutTime %d", timeout)
+	}
+	if report := ValidateConfig(config); len(report.Invalid) != 0 {
+		t.Fatalf("duration should be accepted by int keys: %v", report.Invalid)
+	}
+}
@@ -0,0 +1,113 @@
+package servlet
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testServerXml = `<?xml version="1.0" encoding="UTF-8" ?>
+<servlet>
+    <init-param>
+        <props>
+            <property name="compress" type="bool">true</property>
+            <property name="sessionTimeoutTime" type="int">1000</property>
+            <property name="ratio" type="float">0.75</property>
+            <property name="idle" type="duration">30s</property>
+            <property name="maxBody" type="size">64MB</property>
+            <property name="hosts" type="list">a, b ,c</property>
+            <property name="codecs" type="list"><value>json</value><value>gob</value></property>
+            <property name="weights" type="map"><entry key="a">1</entry><entry key="b">2</entry></property>
+        </props>
+    </init-param>
+    <section name="network">
+        <property name="port" type="int">8010</property>
+        <section name="tcp">
+            <property name="reuseAddress" type="boolean">true</property>
+        </section>
+    </section>
+</servlet>
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "server.xml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestXmlServletConfigTypes(t *testing.T) {
+	config, err := LoadXmlServletConfig(writeConfig(t, testServerXml))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !config.GetBool("compress", false) || config.GetSessionTimeoutMillis() != 1000 || config.GetFloat("ratio", 0) != 0.75 ||
+		config.GetDuration("idle", 0) != 30*time.Second || config.GetSize("maxBody", 0) != 64<<20 {
+		t.Fatalf("unexpected scalar values %v", config.config)
+	}
+	if !reflect.DeepEqual(config.GetStringList("hosts", nil), []string{"a", "b", "c"}) ||
+		!reflect.DeepEqual(config.GetStringList("codecs", nil), []string{"json", "gob"}) ||
+		!reflect.DeepEqual(config.GetStringMap("weights", nil), map[string]string{"a": "1", "b": "2"}) {
+		t.Fatalf("unexpected collection values %v", config.config)
+	}
+	if config.GetInt("network.port", 0) != 8010 || !config.Section("network").GetBool("tcp.reuseAddress", false) {
+		t.Fatalf("unexpected section values %v", config.config)
+	}
+	if config.GetInt("compress", -1) != -1 || config.GetString("missing", "def") != "def" || config.GetSessionTickTime() != 20000 {
+		t.Fatal("mismatched types and missing keys should use defaults")
+	}
+}
+
+func TestXmlServletConfigErrors(t *testing.T) {
+	path := writeConfig(t, `<servlet>
+    <init-param><props>
+        <property name="port" type="int">80a</property>
+        <property name="idle" type="duration">30</property>
+        <property name="name" type="string">game</property>
+    </props></init-param>
+</servlet>`)
+	config, err := LoadXmlServletConfig(path)
+	var errs ConfigErrors
+	if !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("expected 2 config errors, got %v", err)
+	}
+	if errs[0].File != path || errs[0].Line != 3 || errs[0].Key != "port" || errs[1].Line != 4 {
+		t.Fatalf("unexpected error positions %v", err)
+	}
+	if config.GetString("name", "") != "game" || config.Get("port") != nil {
+		t.Fatal("valid properties should still be loaded")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"512": 512, "64KB": 64 << 10, "1.5m": 3 << 19, "2GiB": 2 << 30, "10B": 10} {
+		if n, err := ParseSize(value); err != nil || n != expected {
+			t.Fatalf("%s: expected %d, got %d %v", value, expected, n, err)
+		}
+	}
+	if _, err := ParseSize("MB"); err == nil {
+		t.Fatal("size without number should fail")
+	}
+}
+
+func TestConfigDurationAsInt(t *testing.T) {
+	config := NewLayeredServletConfig()
+	config.SetDefault("pushQueueTTL", 90*time.Second)
+	config.SetDefault("tickMillis", 1500)
+
+	// 整数与时间长度之间都按毫秒转换
+	if config.GetInt64("pushQueueTTL", 0) != 90000 || config.GetInt("pushQueueTTL", 0) != 90000 {
+		t.Fatalf("duration should convert to millis, got %d", config.GetInt64("pushQueueTTL", 0))
+	}
+	if config.GetDuration("tickMillis", 0) != 1500*time.Millisecond {
+		t.Fatalf("int should convert to a duration in millis, got %v", config.GetDuration("tickMillis", 0))
+	}
+	if time.Duration(config.GetInt64("pushQueueTTL", 0))*time.Millisecond != config.GetDuration("pushQueueTTL", 0) {
+		t.Fatal("GetInt64 and GetDuration should agree on the unit")
+	}
+}
@@ -0,0 +1,224 @@
+package servlet
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ConfigReloadIntervalKey 检查配置文件是否修改的间隔，不大于0时不检查
+const ConfigReloadIntervalKey = "configReloadInterval"
+
+// ConfigChangeListener 配置变化的回调，keys为值发生变化的key，包括新增和删除的，按字典序排列
+type ConfigChangeListener func(keys []string)
+
+// ConfigWatcher 支持热加载的ServletConfig，DispatchServlet和SessionManager通过它获取新的配置
+type ConfigWatcher interface {
+	OnConfigChange(listener ConfigChangeListener)
+}
+
+// watchedFile 已经加载的配置文件，modTime和size用于快速判断文件是否修改，
+// checksum相同时只是修改时间变化，不需要重新解析
+type watchedFile struct {
+	path     string
+	modTime  time.Time
+	size     int64
+	checksum [sha256.Size]byte
+}
+
+// statFile 读取配置文件以及它的状态
+func statFile(path string) (*watchedFile, []byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &watchedFile{path: path, modTime: info.ModTime(), size: info.Size(), checksum: sha256.Sum256(content)}, content, nil
+}
+
+func (f *watchedFile) modified() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size, nil
+}
+
+// configKeyChanged keys中是否有key，忽略大小写以及.、_、-
+func configKeyChanged(keys []string, key string) bool {
+	key = normalizeConfigKey(key)
+	for _, k := range keys {
+		if normalizeConfigKey(k) == key {
+			return true
+		}
+	}
+	return false
+}
+
+// configPrefixChanged keys中是否有以prefix开头的key，忽略大小写以及.、_、-
+func configPrefixChanged(keys []string, prefix string) bool {
+	prefix = normalizeConfigKey(prefix)
+	for _, k := range keys {
+		if strings.HasPrefix(normalizeConfigKey(k), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func fireConfigChange(listeners []ConfigChangeListener, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, listener := range listeners {
+		listener(keys)
+	}
+}
+
+// OnConfigChange 增加配置变化的回调，回调在锁外执行，可以在回调中读取新的配置
+func (c *LayeredServletConfig) OnConfigChange(listener ConfigChangeListener) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.listeners = append(c.listeners, listener)
+}
+
+// Reload 重新解析修改过的配置文件，修改时间或者大小变化并且内容不同时才会解析。
+// 所有修改过的文件都解析成功之后一次性替换，任意一个文件不存在或者解析失败时保留原来的配置并返回错误
+func (c *LayeredServletConfig) Reload() error {
+	c.mutex.RLock()
+	files := c.files
+	c.mutex.RUnlock()
+
+	var updatedFiles [layerCount]*watchedFile
+	var updatedLayers [layerCount]map[string]configValue
+	for layer, file := range files {
+		if file == nil {
+			continue
+		}
+		modified, err := file.modified()
+		if err != nil {
+			return err
+		}
+		if !modified {
+			continue
+		}
+
+		updated, content, err := statFile(file.path)
+		if err != nil {
+			return err
+		}
+		updatedFiles[layer] = updated
+		if updated.checksum == file.checksum {
+			continue
+		}
+		values, err := parseLayer(ConfigLayer(layer), file.path, content)
+		if err != nil {
+			return err
+		}
+		updatedLayers[layer] = values
+	}
+	if err := c.validateLayers(updatedLayers); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	for layer := range updatedFiles {
+		// 期间重新调用了LoadXml或者LoadJson时以它们的结果为准
+		if updatedFiles[layer] == nil || c.files[layer] != files[layer] {
+			continue
+		}
+		c.files[layer] = updatedFiles[layer]
+		if updatedLayers[layer] != nil {
+			c.layers[layer] = updatedLayers[layer]
+		}
+	}
+	keys := c.merge()
+	listeners := c.listeners
+	c.mutex.Unlock()
+
+	if len(keys) > 0 {
+		log.Println("config reloaded", keys)
+	}
+	fireConfigChange(listeners, keys)
+	return nil
+}
+
+// SetValidator 设置热加载时的校验，校验失败时保留原来的配置，例如使用ValidateConfig检查配置项的声明
+func (c *LayeredServletConfig) SetValidator(validator func(config ServletConfig) error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.validator = validator
+}
+
+// validateLayers 使用替换之后的配置层创建临时的配置并校验
+func (c *LayeredServletConfig) validateLayers(updatedLayers [layerCount]map[string]configValue) error {
+	candidate := NewLayeredServletConfig()
+	c.mutex.RLock()
+	validator := c.validator
+	candidate.layers = c.layers
+	c.mutex.RUnlock()
+
+	if validator == nil {
+		return nil
+	}
+	for layer, values := range updatedLayers {
+		if values != nil {
+			candidate.layers[layer] = values
+		}
+	}
+	candidate.merge()
+	return validator(candidate)
+}
+
+// Watch 每隔interval调用一次Reload，相同的错误只打印一次，重复调用时只有第一次生效
+func (c *LayeredServletConfig) Watch(interval time.Duration) {
+	c.mutex.Lock()
+	if c.stopWatch != nil || interval <= 0 {
+		c.mutex.Unlock()
+		return
+	}
+	c.stopWatch = make(chan struct{})
+	stop := c.stopWatch
+	c.mutex.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastErr := ""
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := c.Reload()
+				if err != nil && err.Error() != lastErr {
+					log.Println("reject config reload:", err)
+				}
+				lastErr = ""
+				if err != nil {
+					lastErr = err.Error()
+				}
+			}
+		}
+	}()
+}
+
+// StopWatch 停止检查配置文件
+func (c *LayeredServletConfig) StopWatch() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stopWatch != nil {
+		close(c.stopWatch)
+		c.stopWatch = nil
+	}
+}
@@ -0,0 +1,73 @@
+package servlet
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func rewriteConfig(t *testing.T, path string, content string, modTime time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path := writeConfig(t, `<servlet><props>
+		<property name="compress" type="bool">false</property>
+		<property name="sessionTimeoutTime" type="int">1000</property>
+	</props></servlet>`)
+	config := NewLayeredServletConfig()
+	if err := config.LoadXml(path); err != nil {
+		t.Fatal(err)
+	}
+
+	servlet := &DispatchServlet{}
+	servlet.Init(config, NewServletContext())
+	route, _ := servlet.Router().Handle("login", func(Request, Response) {}, RouteMeta{RateLimit: 10})
+	var changed []string
+	config.OnConfigChange(func(keys []string) {
+		changed = keys
+	})
+
+	now := time.Now()
+	rewriteConfig(t, path, `<servlet><props>
+		<property name="compress" type="bool">true</property>
+		<property name="sessionTimeoutTime" type="int">1000</property>
+		<section name="rateLimit"><property name="login" type="int">2</property></section>
+	</props></servlet>`, now.Add(time.Second))
+	if err := config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"compress", "rateLimit.login"}) {
+		t.Errorf("changed keys %v", changed)
+	}
+	if !servlet.Compress() || route.limiter.Rate() != 2 {
+		t.Errorf("compress %v rate %d", servlet.Compress(), route.limiter.Rate())
+	}
+
+	// 非法的文件被拒绝，原来的配置保持不变
+	changed = nil
+	rewriteConfig(t, path, `<servlet><props><property name="compress" type="bool">maybe</property></props></servlet>`, now.Add(2*time.Second))
+	if err := config.Reload(); err == nil {
+		t.Fatal("expect invalid config to be rejected")
+	}
+	if changed != nil || !config.GetBool("compress", false) || config.GetSessionTimeoutMillis() != 1000 {
+		t.Errorf("config changed after rejected reload: %v", changed)
+	}
+
+	// 内容没有变化时不会通知
+	rewriteConfig(t, path, `<servlet><props>
+		<property name="compress" type="bool">true</property>
+		<property name="sessionTimeoutTime" type="int">1000</property>
+		<section name="rateLimit"><property name="login" type="int">2</property></section>
+	</props></servlet>`, now.Add(3*time.Second))
+	if err := config.Reload(); err != nil || changed != nil {
+		t.Errorf("reload unchanged content: %v %v", err, changed)
+	}
+}
@@ -0,0 +1,300 @@
+package servlet
+
+import (
+	"sync"
+	"time"
+)
+
+// ServletContextAttributeListener ServletContext属性变化的监听器，回调在锁外按注册顺序执行
+type ServletContextAttributeListener interface {
+	AttributeAdded(key string, value interface{})
+	AttributeReplaced(key string, oldValue interface{}, newValue interface{})
+	AttributeRemoved(key string, value interface{})
+}
+
+// ContextAttributeListenerFuncs 函数形式的ServletContextAttributeListener，没有设置的回调会被忽略
+type ContextAttributeListenerFuncs struct {
+	Added    func(key string, value interface{})
+	Replaced func(key string, oldValue interface{}, newValue interface{})
+	Removed  func(key string, value interface{})
+}
+
+func (f ContextAttributeListenerFuncs) AttributeAdded(key string, value interface{}) {
+	if f.Added != nil {
+		f.Added(key, value)
+	}
+}
+
+func (f ContextAttributeListenerFuncs) AttributeReplaced(key string, oldValue interface{}, newValue interface{}) {
+	if f.Replaced != nil {
+		f.Replaced(key, oldValue, newValue)
+	}
+}
+
+func (f ContextAttributeListenerFuncs) AttributeRemoved(key string, value interface{}) {
+	if f.Removed != nil {
+		f.Removed(key, value)
+	}
+}
+
+type contextEntry struct {
+	value interface{}
+	// expire 过期时间，零值表示不过期
+	expire time.Time
+}
+
+func (e contextEntry) expiredAt(now time.Time) bool {
+	return !e.expire.IsZero() && !now.Before(e.expire)
+}
+
+// defaultContextPurgeInterval 定时移除过期属性的默认间隔
+const defaultContextPurgeInterval = time.Second
+
+// DefaultServletContext 并发安全的ServletContext，可以在多个gnet event loop中同时访问，
+// 属性可以设置TTL，过期的属性在访问或者Purge时移除并通知AttributeRemoved。
+// 第一次设置带TTL的属性之后每隔PurgeInterval执行一次Purge，没有被访问的属性也会按时通知，Stop停止定时Purge
+type DefaultServletContext struct {
+	// PurgeInterval 定时Purge的间隔，需要在设置带TTL的属性之前修改
+	PurgeInterval time.Duration
+
+	mutex      sync.RWMutex
+	contextMap map[string]contextEntry
+	listeners  []ServletContextAttributeListener
+	purging    chan struct{}
+	stopped    bool
+}
+
+// NewServletContext 创建ServletContext
+func NewServletContext() *DefaultServletContext {
+	return &DefaultServletContext{PurgeInterval: defaultContextPurgeInterval, contextMap: make(map[string]contextEntry)}
+}
+
+// AddListener 增加属性变化的监听器
+func (d *DefaultServletContext) AddListener(listener ServletContextAttributeListener) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.listeners = append(d.listeners, listener)
+}
+
+func (d *DefaultServletContext) Get(key string, defaultValue interface{}) interface{} {
+	value, ok := d.Lookup(key)
+	if ok {
+		return value
+	}
+	return defaultValue
+}
+
+// Lookup 获取属性，第二个返回值表示属性是否存在
+func (d *DefaultServletContext) Lookup(key string) (interface{}, bool) {
+	d.mutex.RLock()
+	entry, ok := d.contextMap[key]
+	d.mutex.RUnlock()
+
+	if !ok {
+		return nil, false
+	}
+	if entry.expiredAt(time.Now()) {
+		d.removeExpired(key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (d *DefaultServletContext) Set(key string, value interface{}) {
+	d.SetWithTTL(key, value, 0)
+}
+
+// SetWithTTL 设置属性，ttl大于0时属性在ttl之后过期
+func (d *DefaultServletContext) SetWithTTL(key string, value interface{}, ttl time.Duration) {
+	now := time.Now()
+	entry := contextEntry{value: value}
+	if ttl > 0 {
+		entry.expire = now.Add(ttl)
+	}
+
+	d.mutex.Lock()
+	if d.contextMap == nil {
+		d.contextMap = make(map[string]contextEntry)
+	}
+	old, replaced := d.contextMap[key]
+	if replaced && old.expiredAt(now) {
+		replaced = false
+	}
+	d.contextMap[key] = entry
+	if ttl > 0 {
+		d.startPurge()
+	}
+	listeners := d.listeners
+	d.mutex.Unlock()
+
+	for _, listener := range listeners {
+		if replaced {
+			listener.AttributeReplaced(key, old.value, value)
+		} else {
+			listener.AttributeAdded(key, value)
+		}
+	}
+}
+
+func (d *DefaultServletContext) Delete(key string) {
+	d.mutex.Lock()
+	entry, ok := d.contextMap[key]
+	delete(d.contextMap, key)
+	listeners := d.listeners
+	d.mutex.Unlock()
+
+	if ok {
+		d.fireRemoved(listeners, key, entry.value)
+	}
+}
+
+// removeExpired 只在属性依然过期时移除，避免删除刚刚重新设置的属性
+func (d *DefaultServletContext) removeExpired(key string) {
+	d.mutex.Lock()
+	entry, ok := d.contextMap[key]
+	ok = ok && entry.expiredAt(time.Now())
+	if ok {
+		delete(d.contextMap, key)
+	}
+	listeners := d.listeners
+	d.mutex.Unlock()
+
+	if ok {
+		d.fireRemoved(listeners, key, entry.value)
+	}
+}
+
+func (d *DefaultServletContext) fireRemoved(listeners []ServletContextAttributeListener, key string, value interface{}) {
+	for _, listener := range listeners {
+		listener.AttributeRemoved(key, value)
+	}
+}
+
+// Purge 移除所有过期的属性
+func (d *DefaultServletContext) Purge() {
+	now := time.Now()
+	var expired []string
+
+	d.mutex.RLock()
+	for key, entry := range d.contextMap {
+		if entry.expiredAt(now) {
+			expired = append(expired, key)
+		}
+	}
+	d.mutex.RUnlock()
+
+	for _, key := range expired {
+		d.removeExpired(key)
+	}
+}
+
+// startPurge 启动定时Purge，调用时需要持有d.mutex
+func (d *DefaultServletContext) startPurge() {
+	if d.purging != nil || d.stopped {
+		return
+	}
+	interval := d.PurgeInterval
+	if interval <= 0 {
+		interval = defaultContextPurgeInterval
+	}
+	d.purging = make(chan struct{})
+	go d.purgeLoop(interval, d.purging)
+}
+
+func (d *DefaultServletContext) purgeLoop(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Purge()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop 停止定时Purge，之后过期的属性只在访问或者手动Purge时移除
+func (d *DefaultServletContext) Stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stopped = true
+	if d.purging != nil {
+		close(d.purging)
+		d.purging = nil
+	}
+}
+
+// Range 遍历所有没有过期的属性，f返回false时停止，遍历的是调用时的快照
+func (d *DefaultServletContext) Range(f func(key string, value interface{}) bool) {
+	now := time.Now()
+
+	d.mutex.RLock()
+	snapshot := make(map[string]interface{}, len(d.contextMap))
+	for key, entry := range d.contextMap {
+		if !entry.expiredAt(now) {
+			snapshot[key] = entry.value
+		}
+	}
+	d.mutex.RUnlock()
+
+	for key, value := range snapshot {
+		if !f(key, value) {
+			return
+		}
+	}
+}
+
+// GetString 获取字符串属性，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetString(key string, defaultValue string) string {
+	if v, ok := d.Get(key, nil).(string); ok {
+		return v
+	}
+	return defaultValue
+}
+
+// GetInt 获取int属性，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetInt(key string, defaultValue int) int {
+	if v, ok := d.Get(key, nil).(int); ok {
+		return v
+	}
+	return defaultValue
+}
+
+// GetInt64 获取int64属性，int类型的属性也会转换，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetInt64(key string, defaultValue int64) int64 {
+	switch v := d.Get(key, nil).(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return defaultValue
+}
+
+// GetFloat64 获取float64属性，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetFloat64(key string, defaultValue float64) float64 {
+	if v, ok := d.Get(key, nil).(float64); ok {
+		return v
+	}
+	return defaultValue
+}
+
+// GetBool 获取bool属性，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetBool(key string, defaultValue bool) bool {
+	if v, ok := d.Get(key, nil).(bool); ok {
+		return v
+	}
+	return defaultValue
+}
+
+// GetDuration 获取time.Duration属性，不存在或者类型不符时返回defaultValue
+func (d *DefaultServletContext) GetDuration(key string, defaultValue time.Duration) time.Duration {
+	if v, ok := d.Get(key, nil).(time.Duration); ok {
+		return v
+	}
+	return defaultValue
+}
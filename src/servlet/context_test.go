@@ -0,0 +1,95 @@
+package servlet
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServletContextListeners(t *testing.T) {
+	context := NewServletContext()
+	defer context.Stop()
+	var events []string
+	context.AddListener(ContextAttributeListenerFuncs{
+		Added:    func(key string, value interface{}) { events = append(events, "added:"+key) },
+		Replaced: func(key string, old interface{}, value interface{}) { events = append(events, "replaced:"+key) },
+		Removed:  func(key string, value interface{}) { events = append(events, "removed:"+key) },
+	})
+
+	context.Set("port", 9000)
+	context.Set("port", 9001)
+	context.SetWithTTL("token", "abc", time.Millisecond)
+	context.Delete("port")
+	context.Delete("missing")
+	time.Sleep(5 * time.Millisecond)
+	if context.GetString("token", "expired") != "expired" {
+		t.Fatal("token should have expired")
+	}
+
+	if got := strings.Join(events, ","); got != "added:port,replaced:port,added:token,removed:port,removed:token" {
+		t.Fatalf("unexpected events %s", got)
+	}
+}
+
+func TestServletContextTypedAndRange(t *testing.T) {
+	var context DefaultServletContext
+	context.Set("name", "game")
+	context.Set("workers", 4)
+	context.Set("debug", true)
+	context.Set("tick", time.Second)
+
+	if context.GetString("name", "") != "game" || context.GetInt("workers", 0) != 4 || context.GetInt64("workers", 0) != 4 ||
+		!context.GetBool("debug", false) || context.GetDuration("tick", 0) != time.Second || context.GetInt("name", -1) != -1 {
+		t.Fatal("unexpected typed values")
+	}
+
+	count := 0
+	context.Range(func(key string, value interface{}) bool {
+		count++
+		return true
+	})
+	if count != 4 {
+		t.Fatalf("expected 4 attributes, got %d", count)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				context.Set("counter", j)
+				context.Get("counter", nil)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestServletContextScheduledPurge(t *testing.T) {
+	context := NewServletContext()
+	context.PurgeInterval = 10 * time.Millisecond
+	defer context.Stop()
+
+	removed := make(chan string, 1)
+	context.AddListener(ContextAttributeListenerFuncs{
+		Removed: func(key string, value interface{}) { removed <- key },
+	})
+	// 没有被访问的过期属性也会按时移除
+	context.SetWithTTL("token", "abc", 20*time.Millisecond)
+	select {
+	case key := <-removed:
+		if key != "token" {
+			t.Fatalf("unexpected removed key %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expired attribute not purged")
+	}
+
+	var servletContext ServletContext = context
+	servletContext.Set("port", 9000)
+	if servletContext.GetInt("port", 0) != 9000 || servletContext.GetInt64("port", 0) != 9000 {
+		t.Fatal("typed getters should be available on ServletContext")
+	}
+}
@@ -0,0 +1,518 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DescriptorKey 部署描述文件的路径
+const DescriptorKey = "descriptor"
+
+// descriptorConfigKeys 部署描述文件使用的配置项
+var descriptorConfigKeys = []ConfigKey{
+	{Key: DescriptorKey, Type: ConfigTypeString, Default: "web.xml", Description: "path of the deployment descriptor, a single DispatchServlet is used when it does not exist"},
+}
+
+// ServletFactory 创建Servlet，部署描述文件中的每个servlet调用一次
+type ServletFactory func() Servlet
+
+// FilterFactory 创建过滤器，config只包含filter自己的init-param
+type FilterFactory func(config ServletConfig) (Filter, error)
+
+var (
+	factoryMutex     sync.RWMutex
+	servletFactories = map[string]ServletFactory{
+		"dispatch": func() Servlet { return &DispatchServlet{} },
+	}
+	filterFactories = map[string]FilterFactory{}
+)
+
+// RegisterServletFactory 注册servlet-class对应的工厂，同名的会被替换，需要在加载部署描述文件之前调用
+func RegisterServletFactory(name string, factory ServletFactory) {
+	factoryMutex.Lock()
+	defer factoryMutex.Unlock()
+
+	servletFactories[name] = factory
+}
+
+// RegisterFilterFactory 注册filter-class对应的工厂，同名的会被替换，需要在加载部署描述文件之前调用
+func RegisterFilterFactory(name string, factory FilterFactory) {
+	factoryMutex.Lock()
+	defer factoryMutex.Unlock()
+
+	filterFactories[name] = factory
+}
+
+// InitParam <init-param><param-name/><param-value/></init-param>，值中的${ENV:default}会替换成环境变量
+type InitParam struct {
+	Name  string `xml:"param-name"`
+	Value string `xml:"param-value"`
+}
+
+// ServletDef 一个servlet的声明，LoadOnStartup不小于0时按从小到大的顺序在启动时初始化，
+// 没有设置或者小于0时在第一次使用时初始化
+type ServletDef struct {
+	Name          string      `xml:"servlet-name"`
+	Class         string      `xml:"servlet-class"`
+	InitParams    []InitParam `xml:"init-param"`
+	LoadOnStartup *int        `xml:"load-on-startup"`
+}
+
+// ServletMapping servlet处理的命令，使用与Router相同的通配符，例如battle.**
+type ServletMapping struct {
+	ServletName string   `xml:"servlet-name"`
+	Patterns    []string `xml:"command-pattern"`
+}
+
+// FilterDef 一个过滤器的声明
+type FilterDef struct {
+	Name       string      `xml:"filter-name"`
+	Class      string      `xml:"filter-class"`
+	InitParams []InitParam `xml:"init-param"`
+}
+
+// FilterMapping 过滤器匹配的命令或者servlet，命令使用与servlet-mapping相同的通配符，与Servlet.AddFilter相同。
+// 匹配命令的过滤器先执行，然后是匹配servlet的，同一类按声明的顺序执行
+type FilterMapping struct {
+	FilterName   string   `xml:"filter-name"`
+	Patterns     []string `xml:"command-pattern"`
+	ServletNames []string `xml:"servlet-name"`
+}
+
+// Descriptor web.xml格式的部署描述文件
+type Descriptor struct {
+	XMLName         xml.Name         `xml:"web-app"`
+	Servlets        []ServletDef     `xml:"servlet"`
+	ServletMappings []ServletMapping `xml:"servlet-mapping"`
+	Filters         []FilterDef      `xml:"filter"`
+	FilterMappings  []FilterMapping  `xml:"filter-mapping"`
+}
+
+// LoadDescriptor 读取部署描述文件
+func LoadDescriptor(path string) (*Descriptor, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	descriptor := &Descriptor{}
+	if err := xml.Unmarshal(content, descriptor); err != nil {
+		line := 1
+		if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+			line = syntaxErr.Line
+		}
+		return nil, &ConfigError{File: path, Line: line, Err: err}
+	}
+	return descriptor, nil
+}
+
+// loadServlet 部署描述文件存在时使用ServletContainer，否则使用一个DispatchServlet
+func loadServlet(config ServletConfig) (Servlet, error) {
+	path := config.GetString(DescriptorKey, "")
+	explicit := path != ""
+	if !explicit {
+		path = "web.xml"
+	}
+
+	descriptor, err := LoadDescriptor(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return &DispatchServlet{}, nil
+		}
+		return nil, err
+	}
+	return NewServletContainer(descriptor)
+}
+
+// initParamConfig servlet或者filter的配置，init-param优先，没有时使用parent
+type initParamConfig struct {
+	configGetter
+	name   string
+	parent ServletConfig
+	params map[string]string
+}
+
+func newInitParamConfig(name string, params []InitParam) *initParamConfig {
+	config := &initParamConfig{name: name, params: make(map[string]string, len(params))}
+	for _, param := range params {
+		config.params[param.Name] = interpolate(param.Value)
+	}
+	config.get = config.Get
+	return config
+}
+
+func (c *initParamConfig) Get(key string) interface{} {
+	if value, ok := c.params[key]; ok {
+		return value
+	}
+	if c.parent == nil {
+		return nil
+	}
+	return c.parent.Get(key)
+}
+
+// Name servlet或者filter的名字
+func (c *initParamConfig) Name() string {
+	return c.name
+}
+
+// OnConfigChange 全局配置支持热加载时转发给它，init-param本身不会变化
+func (c *initParamConfig) OnConfigChange(listener ConfigChangeListener) {
+	if watcher, ok := c.parent.(ConfigWatcher); ok {
+		watcher.OnConfigChange(listener)
+	}
+}
+
+type containerServlet struct {
+	name          string
+	servlet       Servlet
+	config        *initParamConfig
+	loadOnStartup int
+	once          sync.Once
+	// initErr Init发生panic时的错误，之后的请求都返回这个错误，不会再次初始化
+	initErr error
+	// filters 通过servlet-name匹配的过滤器
+	filters []Filter
+}
+
+type servletMapping struct {
+	servlet *containerServlet
+	pattern *topicPattern
+}
+
+// ServletContainer 按部署描述文件管理多个servlet，命令按servlet-mapping分发给对应的servlet，
+// 精确的命令优先，其它的按通配符中固定的段的数量排序
+type ServletContainer struct {
+	servlets     []*containerServlet
+	byName       map[string]*containerServlet
+	exact        map[string]*containerServlet
+	patterns     []*servletMapping
+	filters      []*filterMapping
+	errorHandler ErrorHandler
+	config       ServletConfig
+	context      ServletContext
+	// initialized 按初始化顺序排列的servlet，Destroy时按相反的顺序销毁
+	initMutex   sync.Mutex
+	initialized []*containerServlet
+}
+
+// NewServletContainer 按部署描述文件创建servlet和过滤器，servlet在Init时初始化
+func NewServletContainer(descriptor *Descriptor) (*ServletContainer, error) {
+	container := &ServletContainer{
+		byName:       make(map[string]*containerServlet),
+		exact:        make(map[string]*containerServlet),
+		errorHandler: DefaultErrorHandler,
+	}
+
+	factoryMutex.RLock()
+	defer factoryMutex.RUnlock()
+
+	for _, def := range descriptor.Servlets {
+		if def.Name == "" {
+			return nil, errors.New("servlet without name")
+		}
+		if _, ok := container.byName[def.Name]; ok {
+			return nil, fmt.Errorf("duplicate servlet %s", def.Name)
+		}
+		factory, ok := servletFactories[def.Class]
+		if !ok {
+			return nil, fmt.Errorf("servlet %s: unknown servlet-class %q", def.Name, def.Class)
+		}
+
+		s := &containerServlet{name: def.Name, servlet: factory(), config: newInitParamConfig(def.Name, def.InitParams), loadOnStartup: -1}
+		if def.LoadOnStartup != nil {
+			s.loadOnStartup = *def.LoadOnStartup
+		}
+		container.servlets = append(container.servlets, s)
+		container.byName[def.Name] = s
+	}
+
+	for _, mapping := range descriptor.ServletMappings {
+		s, ok := container.byName[mapping.ServletName]
+		if !ok {
+			return nil, fmt.Errorf("servlet-mapping: unknown servlet %s", mapping.ServletName)
+		}
+		for _, pattern := range mapping.Patterns {
+			if err := container.addMapping(s, strings.TrimSpace(pattern)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.SliceStable(container.patterns, func(i, j int) bool {
+		return container.patterns[i].pattern.specificity() > container.patterns[j].pattern.specificity()
+	})
+
+	filters := make(map[string]Filter, len(descriptor.Filters))
+	for _, def := range descriptor.Filters {
+		if _, ok := filters[def.Name]; ok || def.Name == "" {
+			return nil, fmt.Errorf("duplicate or empty filter name %q", def.Name)
+		}
+		factory, ok := filterFactories[def.Class]
+		if !ok {
+			return nil, fmt.Errorf("filter %s: unknown filter-class %q", def.Name, def.Class)
+		}
+		filter, err := factory(newInitParamConfig(def.Name, def.InitParams))
+		if err != nil {
+			return nil, fmt.Errorf("filter %s: %v", def.Name, err)
+		}
+		filters[def.Name] = filter
+	}
+
+	for _, mapping := range descriptor.FilterMappings {
+		filter, ok := filters[mapping.FilterName]
+		if !ok {
+			return nil, fmt.Errorf("filter-mapping: unknown filter %s", mapping.FilterName)
+		}
+		if len(mapping.Patterns) > 0 {
+			commandMapping, err := newFilterMapping(filter, mapping.Patterns)
+			if err != nil {
+				return nil, fmt.Errorf("filter-mapping %s: %v", mapping.FilterName, err)
+			}
+			container.filters = append(container.filters, commandMapping)
+		}
+		for _, name := range mapping.ServletNames {
+			s, ok := container.byName[name]
+			if !ok {
+				return nil, fmt.Errorf("filter-mapping %s: unknown servlet %s", mapping.FilterName, name)
+			}
+			s.filters = append(s.filters, filter)
+		}
+	}
+	return container, nil
+}
+
+func (c *ServletContainer) addMapping(s *containerServlet, pattern string) error {
+	segments, wildcard, err := parseTopic(pattern)
+	if err != nil {
+		return fmt.Errorf("servlet-mapping %s: %v", s.name, err)
+	}
+	if !wildcard {
+		if exists, ok := c.exact[pattern]; ok {
+			return fmt.Errorf("command %s is mapped to both %s and %s", pattern, exists.name, s.name)
+		}
+		c.exact[pattern] = s
+		return nil
+	}
+
+	for _, exists := range c.patterns {
+		if strings.Join(exists.pattern.segments, topicSeparator) == pattern {
+			return fmt.Errorf("command pattern %s is mapped to both %s and %s", pattern, exists.servlet.name, s.name)
+		}
+	}
+	c.patterns = append(c.patterns, &servletMapping{servlet: s, pattern: &topicPattern{segments: segments}})
+	return nil
+}
+
+// Init 按load-on-startup的顺序初始化servlet，servlet的配置为init-param加上config
+func (c *ServletContainer) Init(config ServletConfig, context ServletContext) {
+	c.config = config
+	c.context = context
+
+	var startup []*containerServlet
+	for _, s := range c.servlets {
+		s.config.parent = config
+		if s.loadOnStartup >= 0 {
+			startup = append(startup, s)
+		}
+	}
+	sort.SliceStable(startup, func(i, j int) bool {
+		return startup[i].loadOnStartup < startup[j].loadOnStartup
+	})
+	for _, s := range startup {
+		if _, err := c.initServlet(s); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// initServlet 初始化servlet并返回，每个servlet只初始化一次。Init发生panic时servlet标记为失败，
+// 返回错误并且不会被销毁
+func (c *ServletContainer) initServlet(s *containerServlet) (Servlet, error) {
+	s.once.Do(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("init servlet %s panic: %v\n%s", s.name, r, debug.Stack())
+				s.initErr = &ServletError{Code: ErrorCodeInternal, Message: "servlet " + s.name + " is unavailable", Err: fmt.Errorf("init panic: %v", r)}
+			}
+		}()
+		s.servlet.Init(s.config, c.context)
+		c.initMutex.Lock()
+		c.initialized = append(c.initialized, s)
+		c.initMutex.Unlock()
+		log.Println("servlet initialized", s.name)
+	})
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	return s.servlet, nil
+}
+
+// Destroy 按初始化的相反顺序销毁已经初始化的servlet，没有初始化的servlet不会被创建
+func (c *ServletContainer) Destroy() {
+	c.initMutex.Lock()
+	initialized := c.initialized
+	c.initialized = nil
+	c.initMutex.Unlock()
+
+	for i := len(initialized) - 1; i >= 0; i-- {
+		c.destroyServlet(initialized[i])
+	}
+}
+
+// destroyServlet 一个servlet的panic不影响其它servlet的销毁
+func (c *ServletContainer) destroyServlet(s *containerServlet) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("destroy servlet %s panic: %v\n%s", s.name, r, debug.Stack())
+		}
+	}()
+	s.servlet.Destroy()
+	log.Println("servlet destroyed", s.name)
+}
+
+// Servlet 按名字获取servlet，还没有初始化时先初始化，不存在或者初始化失败时返回nil
+func (c *ServletContainer) Servlet(name string) Servlet {
+	s, ok := c.byName[name]
+	if !ok {
+		return nil
+	}
+	servlet, _ := c.initServlet(s)
+	return servlet
+}
+
+// ServletFor 命令对应的servlet名字，没有时返回空字符串
+func (c *ServletContainer) ServletFor(command string) string {
+	if s := c.match(command); s != nil {
+		return s.name
+	}
+	return ""
+}
+
+func (c *ServletContainer) match(command string) *containerServlet {
+	if s, ok := c.exact[command]; ok {
+		return s
+	}
+	if len(c.patterns) == 0 {
+		return nil
+	}
+
+	segments := strings.Split(command, topicSeparator)
+	for _, mapping := range c.patterns {
+		if mapping.pattern.match(segments) {
+			return mapping.servlet
+		}
+	}
+	return nil
+}
+
+// Service 执行匹配的过滤器之后交给命令对应的servlet，servlet自己写出错误响应，
+// 过滤器返回的错误以及没有对应servlet的命令由容器的errorHandler处理
+func (c *ServletContainer) Service(request Request, response Response) (err error) {
+	handled := false
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("filter of %s panic: %v\n%s", request.Command(), r, debug.Stack())
+			err = &ServletError{Code: ErrorCodeInternal, Message: "internal error", Err: fmt.Errorf("panic: %v", r)}
+		}
+		if err != nil && !handled {
+			handleError(c.errorHandler, request, response, err)
+		}
+	}()
+
+	if err := openRequest(request); err != nil {
+		return err
+	}
+
+	command := request.Command()
+	s := c.match(command)
+	if s == nil && command == HandshakeCommand {
+		// 没有映射握手命令时由第一个servlet处理
+		s = c.primary()
+	}
+	var servletFilters []Filter
+	if s != nil {
+		servletFilters = s.filters
+	}
+	return newFilterChain(c.filters, command, servletFilters, func(request Request, response Response) error {
+		if s == nil {
+			return NewServletError(ErrorCodeUnknownCommand, fmt.Sprintf("%s is not mapped to any servlet", command))
+		}
+		servlet, err := c.initServlet(s)
+		if err != nil {
+			return err
+		}
+		handled = true
+		return servlet.Service(request, response)
+	}).DoFilter(request, response)
+}
+
+// AddHandler 把handler加到命令对应的servlet
+func (c *ServletContainer) AddHandler(command string, handler func(Request, Response)) error {
+	s := c.match(command)
+	if s == nil {
+		return internalErrors.NotSupport
+	}
+	servlet, err := c.initServlet(s)
+	if err != nil {
+		return err
+	}
+	return servlet.AddHandler(command, handler)
+}
+
+// AddTypedHandler 把typed handler加到命令对应的servlet
+func (c *ServletContainer) AddTypedHandler(command string, handler interface{}) error {
+	s := c.match(command)
+	if s == nil {
+		return internalErrors.NotSupport
+	}
+	servlet, err := c.initServlet(s)
+	if err != nil {
+		return err
+	}
+	return servlet.AddTypedHandler(command, handler)
+}
+
+// Router 第一个servlet的Router，按load-on-startup排序，没有设置的排在最后，
+// 需要操作其它servlet的路由时使用Servlet(name).Router()，初始化失败时返回nil
+func (c *ServletContainer) Router() *Router {
+	if first := c.primary(); first != nil {
+		if servlet, err := c.initServlet(first); err == nil {
+			return servlet.Router()
+		}
+	}
+	return nil
+}
+
+// primary load-on-startup最小的servlet，都没有设置时为第一个
+func (c *ServletContainer) primary() *containerServlet {
+	if len(c.servlets) == 0 {
+		return nil
+	}
+
+	first := c.servlets[0]
+	for _, s := range c.servlets[1:] {
+		if s.loadOnStartup >= 0 && (first.loadOnStartup < 0 || s.loadOnStartup < first.loadOnStartup) {
+			first = s
+		}
+	}
+	return first
+}
+
+// AddFilter 增加容器的过滤器，在部署描述文件中按命令匹配的过滤器之后执行
+func (c *ServletContainer) AddFilter(filter Filter, patterns ...string) {
+	c.filters = addFilterMapping(c.filters, filter, patterns)
+}
+
+// SetErrorHandler 设置容器的错误处理，只用于过滤器的错误和没有对应servlet的命令
+func (c *ServletContainer) SetErrorHandler(handler ErrorHandler) {
+	c.errorHandler = handler
+}
@@ -0,0 +1,191 @@
+package servlet
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDescriptor = `<?xml version="1.0" encoding="UTF-8" ?>
+<web-app>
+    <servlet>
+        <servlet-name>social</servlet-name>
+        <servlet-class>test.module</servlet-class>
+        <init-param><param-name>module</param-name><param-value>social</param-value></init-param>
+        <load-on-startup>2</load-on-startup>
+    </servlet>
+    <servlet>
+        <servlet-name>battle</servlet-name>
+        <servlet-class>test.module</servlet-class>
+        <init-param><param-name>module</param-name><param-value>battle</param-value></init-param>
+        <init-param><param-name>compress</param-name><param-value>true</param-value></init-param>
+        <load-on-startup>1</load-on-startup>
+    </servlet>
+    <servlet>
+        <servlet-name>admin</servlet-name>
+        <servlet-class>test.module</servlet-class>
+        <init-param><param-name>module</param-name><param-value>admin</param-value></init-param>
+    </servlet>
+    <servlet-mapping><servlet-name>battle</servlet-name><command-pattern>battle.**</command-pattern></servlet-mapping>
+    <servlet-mapping>
+        <servlet-name>social</servlet-name>
+        <command-pattern>social.**</command-pattern>
+        <command-pattern>battle.chat</command-pattern>
+    </servlet-mapping>
+    <servlet-mapping><servlet-name>admin</servlet-name><command-pattern>admin.*</command-pattern></servlet-mapping>
+    <filter>
+        <filter-name>tag</filter-name>
+        <filter-class>test.tag</filter-class>
+        <init-param><param-name>tag</param-name><param-value>audit</param-value></init-param>
+    </filter>
+    <filter-mapping><filter-name>tag</filter-name><servlet-name>admin</servlet-name></filter-mapping>
+</web-app>
+`
+
+// moduleServlet 每个模块在Init中注册自己的handler
+type moduleServlet struct {
+	DispatchServlet
+}
+
+var initOrder []string
+
+func (m *moduleServlet) Init(config ServletConfig, context ServletContext) {
+	m.DispatchServlet.Init(config, context)
+	module := config.GetString("module", "")
+	initOrder = append(initOrder, module)
+	m.AddHandler(module+".**", func(request Request, response Response) {
+		response.Write([]byte(module + ":" + request.Command()))
+	})
+}
+
+// brokenServlet Init时panic
+type brokenServlet struct {
+	DispatchServlet
+}
+
+var brokenInits int
+
+func (b *brokenServlet) Init(config ServletConfig, context ServletContext) {
+	brokenInits++
+	panic("broken")
+}
+
+func init() {
+	RegisterServletFactory("test.module", func() Servlet { return &moduleServlet{} })
+	RegisterServletFactory("test.broken", func() Servlet { return &brokenServlet{} })
+	RegisterFilterFactory("test.tag", func(config ServletConfig) (Filter, error) {
+		tag := config.GetString("tag", "")
+		return FilterFunc(func(request Request, response Response, chain FilterChain) error {
+			response.Write([]byte(tag))
+			return chain.DoFilter(request, response)
+		}), nil
+	})
+}
+
+func TestServletContainer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "web.xml")
+	if err := ioutil.WriteFile(path, []byte(testDescriptor), 0644); err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := LoadDescriptor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := NewServletContainer(descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initOrder = nil
+	config := NewLayeredServletConfig()
+	config.SetDefault("compress", false)
+	container.Init(config, NewServletContext())
+	if strings.Join(initOrder, ",") != "battle,social" {
+		t.Fatalf("load-on-startup order %v", initOrder)
+	}
+	if !container.Servlet("battle").(*moduleServlet).Compress() || container.Servlet("social").(*moduleServlet).Compress() {
+		t.Error("init-param should override the global config")
+	}
+	// battle.chat精确映射到social，但social中没有battle.chat的handler
+	for command, want := range map[string]string{"battle.attack": "battle:battle.attack", "social.friend.add": "social:social.friend.add"} {
+		conn := &recordConn{}
+		conn.SetContext(NewConnPipeline(conn))
+		if err := container.Service(NewTcpquest(conn, nil, RequestMessage{Command: command}), NewTcpResponse(conn)); err != nil {
+			t.Fatal(err)
+		}
+		if string(conn.last()) != want {
+			t.Errorf("%s: %q", command, conn.last())
+		}
+	}
+	if container.ServletFor("battle.chat") != "social" {
+		t.Error("exact mapping should win over battle.**")
+	}
+
+	// admin没有load-on-startup，第一次请求时初始化，并且经过servlet-name匹配的过滤器
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	if err := container.Service(NewTcpquest(conn, nil, RequestMessage{Command: "admin.kick"}), NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(initOrder, ",") != "battle,social,admin" || len(conn.writes) != 2 || string(conn.writes[0]) != "audit" {
+		t.Errorf("lazy servlet %v %q", initOrder, conn.writes)
+	}
+
+	err = container.Service(NewTcpquest(conn, nil, RequestMessage{Command: "shop.buy"}), NewTcpResponse(conn))
+	if servletErr := AsServletError(err); servletErr.Code != ErrorCodeUnknownCommand {
+		t.Errorf("unmapped command %v", err)
+	}
+}
+
+func TestServletContainerErrors(t *testing.T) {
+	for _, descriptor := range []*Descriptor{
+		{Servlets: []ServletDef{{Name: "a", Class: "missing"}}},
+		{Servlets: []ServletDef{{Name: "a", Class: "dispatch"}, {Name: "a", Class: "dispatch"}}},
+		{ServletMappings: []ServletMapping{{ServletName: "a", Patterns: []string{"a.*"}}}},
+		{
+			Servlets:        []ServletDef{{Name: "a", Class: "dispatch"}, {Name: "b", Class: "dispatch"}},
+			ServletMappings: []ServletMapping{{ServletName: "a", Patterns: []string{"x.**"}}, {ServletName: "b", Patterns: []string{"x.**"}}},
+		},
+		{FilterMappings: []FilterMapping{{FilterName: "missing"}}},
+		{
+			Filters:        []FilterDef{{Name: "tag", Class: "test.tag"}},
+			FilterMappings: []FilterMapping{{FilterName: "tag", Patterns: []string{"battle.**.x"}}},
+		},
+	} {
+		if _, err := NewServletContainer(descriptor); err == nil {
+			t.Errorf("expect error for %+v", descriptor)
+		}
+	}
+}
+
+func TestServletContainerInitPanic(t *testing.T) {
+	container, err := NewServletContainer(&Descriptor{
+		Servlets:        []ServletDef{{Name: "broken", Class: "test.broken"}},
+		ServletMappings: []ServletMapping{{ServletName: "broken", Patterns: []string{"broken.*"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokenInits = 0
+	container.Init(NewLayeredServletConfig(), NewServletContext())
+
+	for i := 0; i < 2; i++ {
+		conn := &recordConn{}
+		conn.SetContext(NewConnPipeline(conn))
+		err := container.Service(NewTcpquest(conn, nil, RequestMessage{Command: "broken.call"}), NewTcpResponse(conn))
+		if servletErr := AsServletError(err); servletErr.Code != ErrorCodeInternal || len(conn.writes) != 1 {
+			t.Errorf("broken servlet %v %q", err, conn.writes)
+		}
+	}
+	if brokenInits != 1 {
+		t.Errorf("init should run once, got %d", brokenInits)
+	}
+	if container.Servlet("broken") != nil || container.Router() != nil {
+		t.Error("failed servlet should not be returned")
+	}
+	if err := container.AddHandler("broken.call", func(Request, Response) {}); err == nil {
+		t.Error("expect init error")
+	}
+	container.Destroy()
+}
@@ -0,0 +1,311 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// EncryptKey 是否允许客户端在握手时协商加密
+	EncryptKey = "encrypt"
+	// EncryptRequiredKey 为true时除了握手之外拒绝没有加密的tcp、udp和websocket请求，http请求使用TLS，不受影响
+	EncryptRequiredKey = "encryptRequired"
+
+	// CipherAttr 握手协商的SessionCipher保存在连接pipeline上的属性名
+	CipherAttr = "servlet.cipher"
+
+	// HandshakeKeyParam 握手请求和响应中的X25519公钥，base64url编码，没有padding
+	HandshakeKeyParam = "key"
+	// HandshakeSessionParam 握手响应中密钥绑定的sessionId
+	HandshakeSessionParam = "session"
+
+	// counterLength 加密内容前面的计数器长度，计数器同时作为nonce以及防重放的序号
+	counterLength = 8
+	// replayWindow 允许乱序到达的计数器范围，udp的数据报可能乱序
+	replayWindow = 64
+)
+
+// encryptConfigKeys 加密使用的配置项
+var encryptConfigKeys = []ConfigKey{
+	{Key: EncryptKey, Type: ConfigTypeBool, Default: false, Description: "allow clients to negotiate payload encryption in the handshake"},
+	{Key: EncryptRequiredKey, Type: ConfigTypeBool, Default: false, Description: "reject plaintext requests other than the handshake"},
+}
+
+// EncryptOptions 加密参数，配置热加载之后整体替换
+type EncryptOptions struct {
+	Enabled  bool
+	Required bool
+}
+
+// NewEncryptOptions 从配置中读取加密参数，encryptRequired隐含encrypt
+func NewEncryptOptions(config ServletConfig) *EncryptOptions {
+	required := config.GetBool(EncryptRequiredKey, false)
+	return &EncryptOptions{Enabled: required || config.GetBool(EncryptKey, false), Required: required}
+}
+
+// SessionCipher 握手时通过X25519协商的AES-256-GCM密钥，两个方向使用不同的密钥和计数器。
+// 加密之后的内容为8字节计数器 + 密文，nonce为计数器，命令和requestId字段作为附加数据，
+// 计数器没有增加或者在窗口内重复时拒绝。密钥绑定在握手时的session上，session变化之后需要重新握手。
+// 双方的公钥都没有经过认证，只能防止被动的窃听，不能防止中间人替换公钥，需要时使用TLS(SslHandler)
+type SessionCipher struct {
+	sessionId string
+	send      cipher.AEAD
+	receive   cipher.AEAD
+	sent      uint64
+
+	mutex sync.Mutex
+	// received 收到的最大计数器，window的第i位表示received-i已经收到
+	received uint64
+	window   uint64
+}
+
+// NewSessionCipher 根据X25519的共享密钥派生两个方向的密钥，server为true时是服务端使用的cipher
+func NewSessionCipher(sessionId string, secret []byte, clientKey []byte, serverKey []byte, server bool) (*SessionCipher, error) {
+	salt := append(append([]byte{}, clientKey...), serverKey...)
+	clientAead, err := newAead(deriveKey(secret, salt, "LearnGo client "+sessionId))
+	if err != nil {
+		return nil, err
+	}
+	serverAead, err := newAead(deriveKey(secret, salt, "LearnGo server "+sessionId))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &SessionCipher{sessionId: sessionId, send: clientAead, receive: serverAead}
+	if server {
+		c.send, c.receive = serverAead, clientAead
+	}
+	return c, nil
+}
+
+// deriveKey HKDF-SHA256，只需要一个块，输出32字节
+func deriveKey(secret []byte, salt []byte, info string) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SessionId 密钥绑定的sessionId
+func (c *SessionCipher) SessionId() string {
+	return c.sessionId
+}
+
+// Seal 加密内容，command和requestIdField是消息头中的命令和包含标记的requestId字段
+func (c *SessionCipher) Seal(command string, requestIdField uint32, plaintext []byte) []byte {
+	counter := atomic.AddUint64(&c.sent, 1)
+	out := make([]byte, counterLength, counterLength+len(plaintext)+c.send.Overhead())
+	binary.BigEndian.PutUint64(out, counter)
+	return c.send.Seal(out, messageNonce(counter), plaintext, messageAad(command, requestIdField))
+}
+
+// Open 解密内容，认证失败返回NotSupport，重放的消息返回ReplayedMessage
+func (c *SessionCipher) Open(command string, requestIdField uint32, sealed []byte) ([]byte, error) {
+	if len(sealed) < counterLength+c.receive.Overhead() {
+		return nil, internalErrors.NotSupport
+	}
+	counter := binary.BigEndian.Uint64(sealed)
+	plaintext, err := c.receive.Open(nil, messageNonce(counter), sealed[counterLength:], messageAad(command, requestIdField))
+	if err != nil {
+		return nil, internalErrors.NotSupport
+	}
+	// 认证通过之后才更新窗口，伪造的消息不能推进计数器
+	if !c.accept(counter) {
+		return nil, internalErrors.ReplayedMessage
+	}
+	return plaintext, nil
+}
+
+// accept 检查计数器是否重复并记录
+func (c *SessionCipher) accept(counter uint64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if counter == 0 {
+		return false
+	}
+	if counter > c.received {
+		shift := counter - c.received
+		if shift >= replayWindow {
+			c.window = 0
+		} else {
+			c.window <<= shift
+		}
+		c.window |= 1
+		c.received = counter
+		return true
+	}
+	offset := c.received - counter
+	if offset >= replayWindow || c.window&(1<<offset) != 0 {
+		return false
+	}
+	c.window |= 1 << offset
+	return true
+}
+
+func messageNonce(counter uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// messageAad 与消息头的格式相同：32字节命令 + 4字节requestId字段
+func messageAad(command string, requestIdField uint32) []byte {
+	aad := make([]byte, commandLength+4)
+	copy(aad, command)
+	binary.BigEndian.PutUint32(aad[commandLength:], requestIdField)
+	return aad
+}
+
+// EncodePublicKey 握手参数中公钥的编码
+func EncodePublicKey(key *ecdh.PublicKey) string {
+	return base64.RawURLEncoding.EncodeToString(key.Bytes())
+}
+
+// negotiateCipher 生成服务端的临时密钥并与客户端的公钥协商SessionCipher，返回服务端的公钥。
+// 客户端的公钥没有经过认证，中间人可以分别与双方协商密钥
+func negotiateCipher(sessionId string, encodedKey string) (*SessionCipher, *ecdh.PublicKey, error) {
+	clientBytes, err := base64.RawURLEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientKey, err := ecdh.X25519().NewPublicKey(clientBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := NewSessionCipher(sessionId, secret, clientKey.Bytes(), serverKey.PublicKey().Bytes(), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, serverKey.PublicKey(), nil
+}
+
+// cipherOf 连接上协商的SessionCipher，没有时返回nil
+func cipherOf(conn Conn) *SessionCipher {
+	if conn == nil {
+		return nil
+	}
+	pipeline, ok := conn.Context().(*ConnPipeline)
+	if !ok {
+		return nil
+	}
+	c, _ := pipeline.Attr(CipherAttr).(*SessionCipher)
+	return c
+}
+
+// sealBody 按连接协商的结果压缩、加密响应或者推送的内容，返回需要设置在消息头中的标记
+func sealBody(conn Conn, command string, requestId int, body []byte) ([]byte, MessageFlags) {
+	var flags MessageFlags
+	body, compressed := compressBody(conn, body)
+	if compressed {
+		flags |= MessageFlagCompressed
+	}
+	if c := cipherOf(conn); c != nil {
+		flags |= MessageFlagEncrypted
+		body = c.Seal(command, encodeRequestId(requestId, flags), body)
+	}
+	return body, flags
+}
+
+// sealResponse 按请求所在连接协商的结果处理响应
+func sealResponse(request Request, command string, body []byte) ([]byte, MessageFlags) {
+	if r, ok := request.(connRequest); ok {
+		return sealBody(r.connection(), command, request.RequestId(), body)
+	}
+	return body, 0
+}
+
+// decrypt 内容经过加密时使用连接协商的密钥解密，请求的session必须是密钥绑定的session
+func (t *TcpRequest) decrypt() error {
+	if !t.flags.Encrypted() {
+		return nil
+	}
+	c := cipherOf(t.conn)
+	if c == nil {
+		return NewServletError(ErrorCodeBadRequest, "encryption was not negotiated")
+	}
+	if t.boundSessionId() != c.sessionId {
+		return NewServletError(ErrorCodeUnauthorized, "session changed, handshake again")
+	}
+	if manager := sessionManagerOf(t.context); manager != nil && manager.GetSession(c.sessionId) == nil {
+		return NewServletError(ErrorCodeUnauthorized, "session expired, handshake again")
+	}
+	content, err := c.Open(t.command, encodeRequestId(t.requestId, t.flags), t.content)
+	if err != nil {
+		return &ServletError{Code: ErrorCodeBadRequest, Message: "invalid encrypted content", Err: err}
+	}
+	t.content = content
+	t.parseFlag = false
+	return nil
+}
+
+// open 先解密再解压，只执行一次，之后返回第一次的结果
+func (t *TcpRequest) open() error {
+	if !t.opened {
+		t.opened = true
+		t.openErr = t.decrypt()
+		if t.openErr == nil {
+			t.openErr = t.decompress()
+		}
+	}
+	return t.openErr
+}
+
+// sealedRequest 可能带有压缩、加密内容的请求
+type sealedRequest interface {
+	open() error
+	encrypted() bool
+}
+
+func (t *TcpRequest) encrypted() bool {
+	return t.flags.Encrypted()
+}
+
+// openRequest 在过滤器和handler读取内容之前解密、解压请求
+func openRequest(request Request) error {
+	if r, ok := request.(sealedRequest); ok {
+		return r.open()
+	}
+	return nil
+}
+
+// openRequest 解密、解压请求，要求加密时拒绝握手之外的明文请求
+func (servlet *DispatchServlet) openRequest(request Request) error {
+	if err := openRequest(request); err != nil {
+		return err
+	}
+	if !servlet.EncryptOptions().Required || request.Protocol() == HTTP || request.Command() == HandshakeCommand {
+		return nil
+	}
+	if r, ok := request.(sealedRequest); ok && !r.encrypted() {
+		return NewServletError(ErrorCodeForbidden, "encryption required")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestSessionCipherReplayWindow(t *testing.T) {
+	c := &SessionCipher{}
+	for _, counter := range []uint64{1, 3, 2, 70} {
+		if !c.accept(counter) {
+			t.Fatalf("counter %d rejected", counter)
+		}
+	}
+	for _, counter := range []uint64{0, 2, 70, 6} {
+		if c.accept(counter) {
+			t.Errorf("counter %d accepted", counter)
+		}
+	}
+	if !c.accept(7) {
+		t.Error("counter 7 rejected")
+	}
+}
+
+func TestHandshakeEncrypt(t *testing.T) {
+	servlet := newCompressServlet(t, "-encryptRequired=true")
+	context := NewServletContext()
+	context.Set(SessionManagerKey, NewSessionManager(newSessionConfig()))
+	servlet.context = context
+	servlet.AddHandler("echo", func(request Request, response Response) {
+		WriteMessage(request, response, "echo", request.Content())
+	})
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	service := func(message RequestMessage) error {
+		return servlet.Service(NewTcpquest(conn, context, message), NewTcpResponse(conn))
+	}
+	var servletErr *ServletError
+	if err := service(RequestMessage{Command: "echo"}); !errors.As(err, &servletErr) || servletErr.Code != ErrorCodeForbidden {
+		t.Fatalf("plaintext request: %v", err)
+	}
+
+	clientKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	params := url.Values{HandshakeKeyParam: {EncodePublicKey(clientKey.PublicKey())}}
+	if err := service(RequestMessage{Command: HandshakeCommand, Content: []byte(params.Encode())}); err != nil {
+		t.Fatal(err)
+	}
+	reply := decodeTcpMessage(t, conn.last())
+	values, _ := url.ParseQuery(string(reply.Content))
+	serverBytes, _ := base64.RawURLEncoding.DecodeString(values.Get(HandshakeKeyParam))
+	serverKey, err := ecdh.X25519().NewPublicKey(serverBytes)
+	if err != nil || reply.Flags != 0 || values.Get(HandshakeSessionParam) == "" {
+		t.Fatalf("handshake reply %s: %v", reply.Content, err)
+	}
+	secret, _ := clientKey.ECDH(serverKey)
+	client, err := NewSessionCipher(values.Get(HandshakeSessionParam), secret, clientKey.PublicKey().Bytes(), serverBytes, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("secret=1")
+	sealed := client.Seal("echo", encodeRequestId(5, MessageFlagEncrypted), content)
+	request := RequestMessage{Command: "echo", RequestId: 5, Flags: MessageFlagEncrypted, Content: sealed}
+	if err := service(request); err != nil {
+		t.Fatal(err)
+	}
+	reply = decodeTcpMessage(t, conn.last())
+	if !reply.Flags.Encrypted() || reply.RequestId != 5 || bytes.Contains(reply.Content, content) {
+		t.Fatalf("reply %+v", reply)
+	}
+	body, err := client.Open("echo", encodeRequestId(reply.RequestId, reply.Flags), reply.Content)
+	if err != nil || !bytes.Equal(body, content) {
+		t.Fatalf("reply content %q: %v", body, err)
+	}
+
+	if err := service(request); !errors.Is(err, internalErrors.ReplayedMessage) {
+		t.Errorf("replayed request: %v", err)
+	}
+	request.Content = client.Seal("login", encodeRequestId(5, MessageFlagEncrypted), content)
+	if err := service(request); !errors.As(err, &servletErr) || servletErr.Code != ErrorCodeBadRequest {
+		t.Errorf("request with another command: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package servlet
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+)
+
+// ErrorCommand 错误响应使用的命令
+const ErrorCommand = "error"
+
+// 错误码，与http状态码保持一致，http协议下直接作为响应状态码
+const (
+	ErrorCodeBadRequest      = 400
+	ErrorCodeUnauthorized    = 401
+	ErrorCodeForbidden       = 403
+	ErrorCodeUnknownCommand  = 404
+	ErrorCodeTooManyRequests = 429
+	ErrorCodeInternal        = 500
+)
+
+// ServletError 需要返回给客户端的错误，Err是原始错误，只用于日志，不会发送给客户端
+type ServletError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// Details 附加信息，例如参数校验失败的字段
+	Details interface{} `json:"details,omitempty"`
+	Err     error       `json:"-"`
+}
+
+// NewServletError 创建错误
+func NewServletError(code int, message string) *ServletError {
+	return &ServletError{Code: code, Message: message}
+}
+
+func (e *ServletError) Error() string {
+	if e.Err != nil {
+		return strconv.Itoa(e.Code) + " " + e.Message + ": " + e.Err.Error()
+	}
+	return strconv.Itoa(e.Code) + " " + e.Message
+}
+
+func (e *ServletError) Unwrap() error {
+	return e.Err
+}
+
+// AsServletError 把任意错误转换成ServletError，BindError作为ErrorCodeBadRequest，
+// 其它不是ServletError的错误都作为内部错误
+func AsServletError(err error) *ServletError {
+	var servletErr *ServletError
+	if errors.As(err, &servletErr) {
+		return servletErr
+	}
+	var bindErr *BindError
+	if errors.As(err, &bindErr) {
+		return &ServletError{Code: ErrorCodeBadRequest, Message: "invalid parameters", Details: bindErr.Fields, Err: err}
+	}
+	return &ServletError{Code: ErrorCodeInternal, Message: "internal error", Err: err}
+}
+
+// ErrorHandler 把Service过程中的错误写成响应
+type ErrorHandler func(request Request, response Response, err error)
+
+// writtenResponse 可以判断是否已经写出过内容的响应
+type writtenResponse interface {
+	Written() bool
+}
+
+// handleError 调用handler写出错误响应。过滤器或者handler已经写出过响应时不再写错误响应，避免一个请求收到两个响应，
+// handler自身panic时只记录日志
+func handleError(handler ErrorHandler, request Request, response Response, err error) {
+	if r, ok := response.(writtenResponse); ok && r.Written() {
+		log.Println("error after response written", request.Command(), err)
+		return
+	}
+	if handler == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("error handler of %s panic: %v\n%s", request.Command(), r, debug.Stack())
+		}
+	}()
+	handler(request, response, err)
+}
+
+// DefaultErrorHandler 默认的错误响应，内容为{"code":..,"message":..}的json，
+// tcp、udp和websocket按请求相同的消息格式发送，命令为ErrorCommand，requestId与请求相同，
+// http使用错误码作为状态码
+func DefaultErrorHandler(request Request, response Response, err error) {
+	servletErr := AsServletError(err)
+	body, _ := json.Marshal(servletErr)
+
+	if response.Protocol() == HTTP {
+		status := servletErr.Code
+		if http.StatusText(status) == "" {
+			status = http.StatusInternalServerError
+		}
+		response.SetHttpStatus(status)
+		response.AddHeader("Content-Type", "application/json")
+	}
+	WriteMessage(request, response, ErrorCommand, body)
+}
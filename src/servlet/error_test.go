@@ -0,0 +1,75 @@
+package servlet
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestServicePanicAndUnknownCommand(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	servlet.AddHandler("crash", func(request Request, response Response) {
+		panic("boom")
+	})
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	for _, c := range []struct {
+		command string
+		code    int
+	}{{"crash", ErrorCodeInternal}, {"missing", ErrorCodeUnknownCommand}} {
+		err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: c.command, RequestId: 7}), NewTcpResponse(conn))
+		if AsServletError(err).Code != c.code {
+			t.Fatalf("%s: unexpected error %v", c.command, err)
+		}
+		message := decodeTcpMessage(t, conn.last())
+		var body ServletError
+		if err := json.Unmarshal(message.Content, &body); err != nil {
+			t.Fatal(err)
+		}
+		if message.Command != ErrorCommand || message.RequestId != 7 || body.Code != c.code {
+			t.Fatalf("%s: unexpected error response %+v %+v", c.command, message, body)
+		}
+	}
+
+	var handled error
+	servlet.SetErrorHandler(func(request Request, response Response, err error) {
+		handled = err
+	})
+	writes := len(conn.writes)
+	servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "missing"}), NewTcpResponse(conn))
+	if handled == nil || len(conn.writes) != writes {
+		t.Fatal("custom error handler should replace the default response")
+	}
+}
+
+func TestServiceErrorAfterResponseWritten(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	servlet.AddHandler("guarded", func(request Request, response Response) {
+		response.Write([]byte("handled"))
+	})
+	servlet.AddFilter(FilterFunc(func(request Request, response Response, chain FilterChain) error {
+		WriteMessage(request, response, ErrorCommand, []byte(`{"code":403}`))
+		return NewServletError(ErrorCodeForbidden, "denied")
+	}), "guarded")
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "guarded"}), NewTcpResponse(conn))
+	if AsServletError(err).Code != ErrorCodeForbidden {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// 过滤器已经写出了响应，不再写第二个错误响应
+	if len(conn.writes) != 1 {
+		t.Fatalf("expected 1 response, got %d", len(conn.writes))
+	}
+
+	servlet.SetErrorHandler(func(request Request, response Response, err error) {
+		panic("error handler broken")
+	})
+	err = servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "missing"}), NewTcpResponse(conn))
+	if AsServletError(err).Code != ErrorCodeUnknownCommand {
+		t.Fatalf("error handler panic should be recovered, got %v", err)
+	}
+}
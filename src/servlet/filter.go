@@ -0,0 +1,96 @@
+package servlet
+
+import (
+	"log"
+	"strings"
+)
+
+// Filter 在handler前后执行的过滤器，调用chain.DoFilter继续执行后面的过滤器和handler，
+// 不调用时请求被拦截，过滤器可以自己写出响应，也可以返回错误由errorHandler写出错误响应，
+// 已经写出过响应时返回的错误只记录日志
+type Filter interface {
+	DoFilter(request Request, response Response, chain FilterChain) error
+}
+
+// FilterFunc 函数形式的Filter
+type FilterFunc func(request Request, response Response, chain FilterChain) error
+
+func (f FilterFunc) DoFilter(request Request, response Response, chain FilterChain) error {
+	return f(request, response, chain)
+}
+
+// FilterChain 一次请求匹配到的过滤器链，最后执行handler
+type FilterChain interface {
+	DoFilter(request Request, response Response) error
+}
+
+// filterMapping 过滤器以及它匹配的命令，使用与Router和servlet-mapping相同的通配符，例如user.*、battle.**
+type filterMapping struct {
+	filter   Filter
+	patterns []*topicPattern
+}
+
+// newFilterMapping 解析过滤器匹配的命令，patterns为空时匹配所有命令
+func newFilterMapping(filter Filter, patterns []string) (*filterMapping, error) {
+	if len(patterns) == 0 {
+		patterns = []string{topicMultiWildcard}
+	}
+	mapping := &filterMapping{filter: filter}
+	for _, pattern := range patterns {
+		segments, _, err := parseTopic(pattern)
+		if err != nil {
+			return nil, err
+		}
+		mapping.patterns = append(mapping.patterns, &topicPattern{segments: segments})
+	}
+	return mapping, nil
+}
+
+// addFilterMapping 用于没有返回值的AddFilter，pattern不合法时打印日志并忽略这个过滤器
+func addFilterMapping(mappings []*filterMapping, filter Filter, patterns []string) []*filterMapping {
+	mapping, err := newFilterMapping(filter, patterns)
+	if err != nil {
+		log.Println("ignore filter:", err)
+		return mappings
+	}
+	return append(mappings, mapping)
+}
+
+func (m *filterMapping) match(command string) bool {
+	segments := strings.Split(command, topicSeparator)
+	for _, pattern := range m.patterns {
+		if pattern.match(segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterChain 按注册顺序执行匹配的过滤器，同一个filterChain只用于一次请求
+type filterChain struct {
+	filters []Filter
+	index   int
+	handler func(Request, Response) error
+}
+
+func (c *filterChain) DoFilter(request Request, response Response) error {
+	if c.index < len(c.filters) {
+		filter := c.filters[c.index]
+		c.index++
+		return filter.DoFilter(request, response, c)
+	}
+
+	return c.handler(request, response)
+}
+
+// newFilterChain 创建命令匹配的过滤器链，routeFilters在匹配的过滤器之后执行
+func newFilterChain(mappings []*filterMapping, command string, routeFilters []Filter, handler func(Request, Response) error) *filterChain {
+	chain := &filterChain{handler: handler}
+	for _, mapping := range mappings {
+		if mapping.match(command) {
+			chain.filters = append(chain.filters, mapping.filter)
+		}
+	}
+	chain.filters = append(chain.filters, routeFilters...)
+	return chain
+}
@@ -0,0 +1,81 @@
+package servlet
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFilterChain(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+
+	var trace []string
+	servlet.AddHandler("user.login", func(request Request, response Response) {
+		trace = append(trace, "login")
+	})
+	servlet.AddHandler("shop.buy", func(request Request, response Response) {
+		trace = append(trace, "buy")
+	})
+	servlet.AddFilter(FilterFunc(func(request Request, response Response, chain FilterChain) error {
+		trace = append(trace, "log:"+request.Command())
+		return chain.DoFilter(request, response)
+	}))
+	servlet.AddFilter(FilterFunc(func(request Request, response Response, chain FilterChain) error {
+		if request.GetSession(false) == nil {
+			response.Write([]byte("login required"))
+			return nil
+		}
+		return chain.DoFilter(request, response)
+	}), "shop.*")
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	for _, command := range []string{"user.login", "shop.buy"} {
+		if err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: command}), NewTcpResponse(conn)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := strings.Join(trace, ","); got != "log:user.login,login,log:shop.buy" {
+		t.Fatalf("unexpected filter order %s", got)
+	}
+	if string(conn.last()) != "login required" {
+		t.Fatalf("filter should short-circuit with its own response, got %q", conn.last())
+	}
+
+	failure := errors.New("rejected")
+	servlet.AddFilter(FilterFunc(func(request Request, response Response, chain FilterChain) error {
+		return failure
+	}), "user.login")
+	if err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "user.login"}), NewTcpResponse(conn)); err != failure {
+		t.Fatalf("filter error should be returned from Service, got %v", err)
+	}
+}
+
+func TestFilterPatterns(t *testing.T) {
+	filter := FilterFunc(func(request Request, response Response, chain FilterChain) error { return nil })
+	cases := map[string]map[string]bool{
+		"battle.*":  {"battle.attack": true, "battle.chat.send": false, "battle": false},
+		"battle.**": {"battle.attack": true, "battle.chat.send": true, "battle": false},
+		"*.login":   {"user.login": true, "admin.user.login": false},
+	}
+	for pattern, commands := range cases {
+		mapping, err := newFilterMapping(filter, []string{pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for command, want := range commands {
+			if mapping.match(command) != want {
+				t.Errorf("%s %s: expect %v", pattern, command, want)
+			}
+		}
+	}
+
+	all, _ := newFilterMapping(filter, nil)
+	if !all.match("a") || !all.match("a.b.c") {
+		t.Error("filter without patterns should match all commands")
+	}
+	if _, err := newFilterMapping(filter, []string{"battle.**.x"}); err == nil {
+		t.Error("expect invalid pattern")
+	}
+}
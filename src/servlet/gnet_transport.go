@@ -0,0 +1,83 @@
+package servlet
+
+import (
+	"LearnGo/src/graceful"
+	"context"
+	"github.com/panjf2000/gnet"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// GnetTransport 基于gnet事件循环的传输层
+type GnetTransport struct {
+	*gnet.EventServer
+	Options   []gnet.Option
+	protoAddr string
+	handler   TransportHandler
+	// connections 当前连接数，gnet的CountConnections在事件循环启动期间读取会产生数据竞争
+	connections int64
+}
+
+// NewGnetTransport 创建gnet传输层，默认开启多核，SO_REUSEPORT总是开启
+func NewGnetTransport(options ...gnet.Option) *GnetTransport {
+	if len(options) == 0 {
+		options = []gnet.Option{gnet.WithMulticore(true)}
+	}
+	return &GnetTransport{Options: options}
+}
+
+// Serve 平滑重启时子进程通过SO_REUSEPORT绑定同一端口，所以忽略Options中关闭SO_REUSEPORT的设置
+func (t *GnetTransport) Serve(protoAddr string, handler TransportHandler) error {
+	t.protoAddr = protoAddr
+	t.handler = handler
+	options := append(append([]gnet.Option{}, t.Options...), gnet.WithReusePort(true))
+	return gnet.Serve(t, protoAddr, options...)
+}
+
+// Stop 等待已有连接全部关闭或者超时后停止gnet，超时时关闭剩余的连接。
+// gnet没有关闭监听的接口，排空期间仍然会接收新连接，平滑重启时内核把新连接分给同一SO_REUSEPORT组中的父子进程
+func (t *GnetTransport) Stop(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for t.CountConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Println("drain timeout, close remaining connections")
+			return gnet.Stop(context.Background(), t.protoAddr)
+		case <-ticker.C:
+		}
+	}
+	return gnet.Stop(context.Background(), t.protoAddr)
+}
+
+func (t *GnetTransport) CountConnections() int {
+	return int(atomic.LoadInt64(&t.connections))
+}
+
+func (t *GnetTransport) OnInitComplete(svr gnet.Server) (action gnet.Action) {
+	if svr.ReusePort {
+		graceful.BindReusePort(t.protoAddr)
+	} else {
+		graceful.BindExclusive(t.protoAddr)
+	}
+	return
+}
+
+func (t *GnetTransport) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	atomic.AddInt64(&t.connections, 1)
+	t.handler.OnOpened(c)
+	return
+}
+
+func (t *GnetTransport) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	t.handler.OnClosed(c, err)
+	atomic.AddInt64(&t.connections, -1)
+	return
+}
+
+func (t *GnetTransport) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	t.handler.OnData(c, frame)
+	return
+}
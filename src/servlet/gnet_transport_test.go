@@ -0,0 +1,78 @@
+package servlet
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGnetTransportStopDrainsConnections(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	transport := NewGnetTransport()
+	server := NewTcpServer(transport)
+	server.InitConn = func(conn Conn) {
+		conn.Context().(*ConnPipeline).AddLast("echo", &echoHandler{})
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve("tcp://" + addr)
+	}()
+
+	var client net.Conn
+	for i := 0; i < 100 && client == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		client, _ = net.Dial("tcp", addr)
+	}
+	if client == nil {
+		t.Fatal("transport not listening")
+	}
+	defer client.Close()
+	echo := func() {
+		client.Write([]byte("ping"))
+		reply := make([]byte, 4)
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(client, reply); err != nil || string(reply) != "ping" {
+			t.Fatalf("unexpected reply %q %v", reply, err)
+		}
+	}
+	echo()
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- transport.Stop(ctx)
+	}()
+
+	// 排空期间已有连接仍然可以收发
+	time.Sleep(200 * time.Millisecond)
+	echo()
+	if transport.CountConnections() != 1 {
+		t.Fatal("connections", transport.CountConnections())
+	}
+	select {
+	case err := <-stopped:
+		t.Fatal("stopped before existing connections closed", err)
+	default:
+	}
+
+	client.Close()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("drain did not finish after connections closed")
+	}
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after stop")
+	}
+}
@@ -0,0 +1,78 @@
+package servlet
+
+import (
+	"net/url"
+)
+
+const (
+	// HandshakeCommand 连接建立之后客户端发送的第一个命令，协商连接上使用的压缩方式和加密密钥
+	HandshakeCommand = "handshake"
+	// HandshakeCompressParam 请求中为客户端支持的压缩方式，逗号分隔，响应中为选择的压缩方式，没有时表示不压缩
+	HandshakeCompressParam = "compress"
+)
+
+// connRequest 可以取得所在连接的请求
+type connRequest interface {
+	connection() Conn
+}
+
+func (t *TcpRequest) connection() Conn {
+	return t.conn
+}
+
+// pipelineOf 请求所在连接的pipeline，http请求以及没有pipeline的连接返回nil
+func pipelineOf(request Request) *ConnPipeline {
+	if request.Protocol() == HTTP {
+		return nil
+	}
+	r, ok := request.(connRequest)
+	if !ok || r.connection() == nil {
+		return nil
+	}
+	pipeline, _ := r.connection().Context().(*ConnPipeline)
+	return pipeline
+}
+
+// handshake 请求和响应的内容都是form格式的参数，响应本身不压缩、不加密，之后的响应和请求按协商的结果处理。
+// 请求中有key并且启用了加密时创建或者使用当前的session，响应中返回服务端的公钥和sessionId。
+// 没有启用时不选择对应的方式，重复握手时以最后一次为准，http请求不协商加密
+func (servlet *DispatchServlet) handshake(request Request, response Response) {
+	pipeline := pipelineOf(request)
+	if pipeline != nil {
+		pipeline.SetAttr(CompressAttr, nil)
+		pipeline.SetAttr(CipherAttr, nil)
+	}
+
+	reply := url.Values{}
+	var compressor *Compressor
+	options := servlet.CompressOptions()
+	if algorithm := options.negotiate(request.GetParameterValues(HandshakeCompressParam)); options.Enabled && algorithm != "" {
+		compressor = NewCompressor(algorithm, servlet.CompressOptions)
+		reply.Set(HandshakeCompressParam, algorithm)
+	}
+
+	var sessionCipher *SessionCipher
+	if key := request.GetParameterValues(HandshakeKeyParam); len(key) > 0 && pipeline != nil && servlet.EncryptOptions().Enabled {
+		session := request.GetSession(true)
+		if session == nil {
+			handleError(servlet.errorHandler, request, response, NewServletError(ErrorCodeInternal, "session is not supported"))
+			return
+		}
+		c, serverKey, err := negotiateCipher((*session).Id(), key[0])
+		if err != nil {
+			handleError(servlet.errorHandler, request, response, &ServletError{Code: ErrorCodeBadRequest, Message: "invalid handshake key", Err: err})
+			return
+		}
+		sessionCipher = c
+		reply.Set(HandshakeKeyParam, EncodePublicKey(serverKey))
+		reply.Set(HandshakeSessionParam, c.SessionId())
+	}
+	WriteMessage(request, response, HandshakeCommand, []byte(reply.Encode()))
+
+	if pipeline != nil && compressor != nil {
+		pipeline.SetAttr(CompressAttr, compressor)
+	}
+	if pipeline != nil && sessionCipher != nil {
+		pipeline.SetAttr(CipherAttr, sessionCipher)
+	}
+}
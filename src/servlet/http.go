@@ -0,0 +1,433 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SessionCookieName http请求中携带sessionId的cookie
+	SessionCookieName = "JSESSIONID"
+	// defaultMaxHeaderSize 请求行加请求头的最大长度
+	defaultMaxHeaderSize = 8192
+	// defaultMaxBodySize 请求体的最大长度
+	defaultMaxBodySize = 4 << 20
+)
+
+// HttpMessage 解码后的http请求
+type HttpMessage struct {
+	Method    string
+	URL       *url.URL
+	Proto     string
+	Header    http.Header
+	Body      []byte
+	KeepAlive bool
+}
+
+// HttpResponseMessage 待编码的http响应，Head为true时是HEAD请求的响应，只发送Content-Length不发送body
+type HttpResponseMessage struct {
+	Status    int
+	Header    http.Header
+	Body      []byte
+	KeepAlive bool
+	Head      bool
+}
+
+// HttpRequestDecoder http/1.1请求解码器，配合ByteToMessageDecoder使用，
+// 支持Content-Length和chunked请求体，同一批数据中的多个请求(pipelining)会依次输出
+type HttpRequestDecoder struct {
+	MaxHeaderSize int
+	MaxBodySize   int
+	failed        bool
+}
+
+// NewHttpRequestDecoder 创建http请求解码器
+func NewHttpRequestDecoder() *ByteToMessageDecoder {
+	return &ByteToMessageDecoder{Decoder: &HttpRequestDecoder{MaxHeaderSize: defaultMaxHeaderSize, MaxBodySize: defaultMaxBodySize}}
+}
+
+func (d *HttpRequestDecoder) CallDecode(ctx ConnHandlerContext, in *buffer.ByteBuf, output *[]interface{}) {
+	for !d.failed && in.ReadableBytes() > 0 {
+		data := in.Data[in.ReaderIndex:in.WriterIndex]
+		message, consumed, status := d.decode(data)
+		if status != 0 {
+			d.fail(ctx, in, status)
+			return
+		}
+		if message == nil {
+			return
+		}
+		in.SkipBytes(uint32(consumed))
+		*output = append(*output, message)
+		if !message.KeepAlive {
+			// 连接将要关闭，丢弃后面的数据
+			in.SkipBytes(in.ReadableBytes())
+			return
+		}
+	}
+}
+
+// decode 尝试从data中解析一个完整的请求，数据不完整时返回nil，出错时返回http状态码
+func (d *HttpRequestDecoder) decode(data []byte) (*HttpMessage, int, int) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(data) > d.MaxHeaderSize {
+			return nil, 0, http.StatusRequestHeaderFieldsTooLarge
+		}
+		return nil, 0, 0
+	}
+	if end > d.MaxHeaderSize {
+		return nil, 0, http.StatusRequestHeaderFieldsTooLarge
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(data[:end+4])))
+	line, err := reader.ReadLine()
+	if err != nil {
+		return nil, 0, http.StatusBadRequest
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+		return nil, 0, http.StatusBadRequest
+	}
+	requestURL, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return nil, 0, http.StatusBadRequest
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, 0, http.StatusBadRequest
+	}
+
+	message := &HttpMessage{Method: parts[0], URL: requestURL, Proto: parts[2], Header: http.Header(header)}
+	connection := strings.ToLower(message.Header.Get("Connection"))
+	if message.Proto == "HTTP/1.0" {
+		message.KeepAlive = connection == "keep-alive"
+	} else {
+		message.KeepAlive = connection != "close"
+	}
+
+	offset := end + 4
+	transferEncoding := message.Header.Get("Transfer-Encoding")
+	contentLength := message.Header.Get("Content-Length")
+	switch {
+	case transferEncoding != "":
+		if contentLength != "" || !strings.EqualFold(transferEncoding, "chunked") {
+			return nil, 0, http.StatusBadRequest
+		}
+		body, n, status := d.decodeChunked(data[offset:])
+		if status != 0 || n == 0 {
+			return nil, 0, status
+		}
+		message.Body = body
+		offset += n
+	case contentLength != "":
+		length, err := strconv.Atoi(contentLength)
+		if err != nil || length < 0 {
+			return nil, 0, http.StatusBadRequest
+		}
+		if length > d.MaxBodySize {
+			return nil, 0, http.StatusRequestEntityTooLarge
+		}
+		if len(data) < offset+length {
+			return nil, 0, 0
+		}
+		message.Body = make([]byte, length)
+		copy(message.Body, data[offset:offset+length])
+		offset += length
+	}
+	return message, offset, 0
+}
+
+// decodeChunked 解析chunked请求体，返回请求体和消耗的字节数，数据不完整时消耗的字节数为0
+func (d *HttpRequestDecoder) decodeChunked(data []byte) ([]byte, int, int) {
+	var body []byte
+	offset := 0
+	for {
+		end := bytes.Index(data[offset:], []byte("\r\n"))
+		if end == -1 {
+			return nil, 0, 0
+		}
+		sizeLine := string(data[offset : offset+end])
+		if index := strings.Index(sizeLine, ";"); index != -1 {
+			sizeLine = sizeLine[:index]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeLine), 16, 64)
+		if err != nil || size < 0 {
+			return nil, 0, http.StatusBadRequest
+		}
+		if size > int64(d.MaxBodySize)-int64(len(body)) {
+			return nil, 0, http.StatusRequestEntityTooLarge
+		}
+		offset += end + 2
+
+		if size == 0 {
+			// 跳过trailer，以空行结束
+			for {
+				end = bytes.Index(data[offset:], []byte("\r\n"))
+				if end == -1 {
+					return nil, 0, 0
+				}
+				offset += end + 2
+				if end == 0 {
+					if body == nil {
+						body = []byte{}
+					}
+					return body, offset, 0
+				}
+			}
+		}
+
+		if len(data) < offset+int(size)+2 {
+			return nil, 0, 0
+		}
+		body = append(body, data[offset:offset+int(size)]...)
+		offset += int(size)
+		if data[offset] != '\r' || data[offset+1] != '\n' {
+			return nil, 0, http.StatusBadRequest
+		}
+		offset += 2
+	}
+}
+
+// fail 回复错误状态码并关闭连接，解码器前面没有HttpResponseEncoder，需要自己编码
+func (d *HttpRequestDecoder) fail(ctx ConnHandlerContext, in *buffer.ByteBuf, status int) {
+	d.failed = true
+	in.SkipBytes(in.ReadableBytes())
+	ctx.FireWrite(EncodeHttpResponse(&HttpResponseMessage{Status: status, Header: http.Header{}}))
+	ctx.Pipeline.conn.Close()
+}
+
+// HttpResponseEncoder 把*HttpResponseMessage编码成http/1.1响应
+type HttpResponseEncoder struct {
+}
+
+func (e *HttpResponseEncoder) FireWrite(context ConnHandlerContext, msg interface{}) {
+	response, ok := msg.(*HttpResponseMessage)
+	if !ok {
+		context.FireWrite(msg)
+		return
+	}
+	context.FireWrite(EncodeHttpResponse(response))
+}
+
+// EncodeHttpResponse 编码http响应，Content-Length和Connection由编码器负责。
+// HEAD请求以及1xx、204、304的响应没有body，否则keep-alive连接上的下一个响应会错位
+func EncodeHttpResponse(response *HttpResponseMessage) []byte {
+	status := response.Status
+	noContent := status < 200 || status == http.StatusNoContent || status == http.StatusNotModified
+	body := response.Body
+	if response.Head || noContent {
+		body = nil
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "HTTP/1.1 %d %s\r\n", response.Status, http.StatusText(response.Status))
+
+	header := response.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Del("Content-Length")
+	header.Del("Transfer-Encoding")
+	if response.KeepAlive {
+		header.Set("Connection", "keep-alive")
+	} else {
+		header.Set("Connection", "close")
+	}
+	if header.Get("Content-Type") == "" && !noContent && len(response.Body) > 0 {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	if !noContent {
+		header.Set("Content-Length", strconv.Itoa(len(response.Body)))
+	}
+	header.Write(&out)
+
+	out.WriteString("\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
+
+// HttpDispatchHandler 把http请求交给Servlet处理，url路径作为command，
+// 例如/player/login和/player.login都对应player.login
+type HttpDispatchHandler struct {
+	InboundHandlerAdapter
+	Servlet Servlet
+	Context ServletContext
+}
+
+func (h *HttpDispatchHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	message, ok := msg.(*HttpMessage)
+	if !ok {
+		context.FireMessageRead(msg)
+		return
+	}
+
+	request := NewHttpRequest(context.Pipeline.conn, h.Context, message)
+	response := NewHttpResponse(context, message)
+	request.(*HttpRequest).response = response.(*HttpResponse)
+	if err := h.Servlet.Service(request, response); err != nil {
+		log.Println(err)
+	}
+	response.(*HttpResponse).Flush()
+}
+
+// AddHttpHandlers 按顺序添加http解码、编码和分发handler
+func AddHttpHandlers(pipeline *ConnPipeline, servlet Servlet, context ServletContext) {
+	pipeline.AddLast("httpDecoder", NewHttpRequestDecoder())
+	pipeline.AddLast("httpEncoder", &HttpResponseEncoder{})
+	pipeline.AddLast("httpDispatcher", &HttpDispatchHandler{Servlet: servlet, Context: context})
+}
+
+// HttpRequest http请求，参数来自url查询串和application/x-www-form-urlencoded请求体，
+// sessionId通过JSESSIONID cookie携带
+type HttpRequest struct {
+	TcpRequest
+	message *HttpMessage
+	// response 设置JSESSIONID cookie的响应，cookieSessionId为客户端已经持有的sessionId
+	response        *HttpResponse
+	cookieSessionId string
+}
+
+// NewHttpRequest 创建http请求，requestId取自X-Request-Id请求头
+func NewHttpRequest(conn Conn, context ServletContext, message *HttpMessage) Request {
+	var request HttpRequest
+	request.message = message
+	request.command = strings.ReplaceAll(strings.Trim(message.URL.Path, "/"), "/", ".")
+	request.requestId, _ = strconv.Atoi(message.Header.Get("X-Request-Id"))
+	request.content = message.Body
+	request.createTime = time.Now()
+	request.conn = conn
+	request.context = context
+	if cookie, err := (&http.Request{Header: message.Header}).Cookie(SessionCookieName); err == nil {
+		request.sessionId = cookie.Value
+		request.cookieSessionId = cookie.Value
+	}
+
+	request.paramMap = message.URL.Query()
+	contentType := message.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(message.Body)); err == nil {
+			for k, v := range form {
+				request.paramMap[k] = append(request.paramMap[k], v...)
+			}
+		}
+	}
+	request.parseFlag = true
+
+	return &request
+}
+
+func (h *HttpRequest) GetHeader(key string) (string, error) {
+	return h.message.Header.Get(key), nil
+}
+
+func (h *HttpRequest) Protocol() ServerProtocol {
+	return HTTP
+}
+
+// GetSession 客户端没有持有返回的session时在响应中设置JSESSIONID cookie
+func (h *HttpRequest) GetSession(allowCreate bool) *Session {
+	session := h.TcpRequest.GetSession(allowCreate)
+	if session != nil {
+		h.setSessionCookie((*session).Id())
+	}
+	return session
+}
+
+// GetNewSession 创建新的session并在响应中设置JSESSIONID cookie
+func (h *HttpRequest) GetNewSession() (*Session, error) {
+	session, err := h.TcpRequest.GetNewSession()
+	if err == nil {
+		h.setSessionCookie((*session).Id())
+	}
+	return session, err
+}
+
+func (h *HttpRequest) setSessionCookie(id string) {
+	if h.response == nil || id == h.cookieSessionId {
+		return
+	}
+	h.cookieSessionId = id
+	h.response.header.Add("Set-Cookie", (&http.Cookie{Name: SessionCookieName, Value: id, Path: "/", HttpOnly: true}).String())
+}
+
+// HttpResponse http响应，Write的内容先缓存，Flush时一次性编码发送
+type HttpResponse struct {
+	context   ConnHandlerContext
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	keepAlive bool
+	head      bool
+	written   bool
+	flushed   bool
+}
+
+// NewHttpResponse 创建request的http响应，context为分发handler的上下文，响应会经过pipeline中的编码器
+func NewHttpResponse(context ConnHandlerContext, request *HttpMessage) Response {
+	return &HttpResponse{context: context, status: http.StatusOK, header: http.Header{}, keepAlive: request.KeepAlive,
+		head: request.Method == http.MethodHead}
+}
+
+func (h *HttpResponse) Write(buff []byte) {
+	h.written = true
+	h.body.Write(buff)
+}
+
+// Written 是否已经写入过响应内容
+func (h *HttpResponse) Written() bool {
+	return h.written
+}
+
+func (h *HttpResponse) AddHeader(name string, value string) error {
+	h.header.Add(name, value)
+	return nil
+}
+
+func (h *HttpResponse) AddCookie(name string, value string) error {
+	cookie := (&http.Cookie{Name: name, Value: value, Path: "/"}).String()
+	if cookie == "" {
+		return internalErrors.NotSupport
+	}
+	h.header.Add("Set-Cookie", cookie)
+	return nil
+}
+
+func (h *HttpResponse) SetHttpStatus(status int) error {
+	if status < 100 || status > 999 {
+		return internalErrors.NotSupport
+	}
+	h.status = status
+	return nil
+}
+
+func (h *HttpResponse) Protocol() ServerProtocol {
+	return HTTP
+}
+
+// MarkClose 发送响应后关闭连接
+func (h *HttpResponse) MarkClose() {
+	h.keepAlive = false
+}
+
+// Flush 发送响应，只会发送一次
+func (h *HttpResponse) Flush() {
+	if h.flushed {
+		return
+	}
+	h.flushed = true
+	h.context.FireWrite(&HttpResponseMessage{Status: h.status, Header: h.header, Body: h.body.Bytes(), KeepAlive: h.keepAlive, Head: h.head})
+	if !h.keepAlive {
+		h.context.Pipeline.conn.Close()
+	}
+}
@@ -0,0 +1,157 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHttpPipelining(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	servlet.AddHandler("player.login", func(request Request, response Response) {
+		name := request.GetParameterValues("name")
+		response.AddCookie("JSESSIONID", "s1")
+		response.Write([]byte("hi " + strings.Join(name, ",")))
+	})
+
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	AddHttpHandlers(pipeline, servlet, nil)
+
+	data := "GET /player/login?name=a%20b HTTP/1.1\r\nHost: x\r\n\r\n" +
+		"POST /player.login HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\nConnection: close\r\n\r\n" +
+		"4\r\nname\r\n3\r\n=c+\r\n0\r\n\r\n" +
+		"GET /unknown HTTP/1.1\r\n\r\n"
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte(data[:20])})
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte(data[20:])})
+
+	if len(conn.writes) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(conn.writes))
+	}
+	first := string(conn.writes[0])
+	if !strings.HasPrefix(first, "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(first, "\r\n\r\nhi a b") ||
+		!strings.Contains(first, "Set-Cookie: JSESSIONID=s1; Path=/\r\n") || !strings.Contains(first, "Connection: keep-alive") {
+		t.Fatalf("unexpected first response %q", first)
+	}
+	second := string(conn.writes[1])
+	if !strings.HasSuffix(second, "\r\n\r\nhi c ") || !strings.Contains(second, "Connection: close") || !conn.closed {
+		t.Fatalf("unexpected second response %q", second)
+	}
+}
+
+func newHttpTestPipeline() (*recordConn, *ConnPipeline) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	servlet.AddHandler("echo", func(request Request, response Response) {
+		response.Write(request.Content())
+	})
+
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	AddHttpHandlers(pipeline, servlet, nil)
+	return conn, pipeline
+}
+
+func TestHttpMalformedRequest(t *testing.T) {
+	cases := map[string]string{
+		"GARBAGE\r\n\r\n": "HTTP/1.1 400 Bad Request\r\n",
+		"GET /echo HTTP/1.1\r\nX: " + strings.Repeat("a", defaultMaxHeaderSize): "HTTP/1.1 431 Request Header Fields Too Large\r\n",
+		"GET /echo HTTP/1.1\r\nContent-Length: -1\r\n\r\n":                      "HTTP/1.1 400 Bad Request\r\n",
+		"GET /echo HTTP/1.1\r\nContent-Length: 99999999999\r\n\r\n":             "HTTP/1.1 413 Request Entity Too Large\r\n",
+	}
+	for data, status := range cases {
+		conn, pipeline := newHttpTestPipeline()
+		pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte(data)})
+		if len(conn.writes) != 1 || !strings.HasPrefix(string(conn.last()), status) || !conn.closed {
+			t.Fatalf("%.30q: unexpected response %q", data, conn.last())
+		}
+	}
+}
+
+func TestHttpHostileChunked(t *testing.T) {
+	cases := map[string]string{
+		// 加上已有的请求体长度会溢出int64
+		"2\r\nab\r\n7fffffffffffffff\r\n": "HTTP/1.1 413 Request Entity Too Large\r\n",
+		"8000000000000000\r\n":            "HTTP/1.1 400 Bad Request\r\n",
+		"-1\r\n":                          "HTTP/1.1 400 Bad Request\r\n",
+		"zz\r\n":                          "HTTP/1.1 400 Bad Request\r\n",
+		"400001\r\n":                      "HTTP/1.1 413 Request Entity Too Large\r\n",
+		"2\r\nabcd\r\n0\r\n\r\n":          "HTTP/1.1 400 Bad Request\r\n",
+	}
+	for chunks, status := range cases {
+		conn, pipeline := newHttpTestPipeline()
+		data := "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + chunks
+		pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte(data)})
+		if len(conn.writes) != 1 || !strings.HasPrefix(string(conn.last()), status) || !conn.closed {
+			t.Fatalf("%q: unexpected response %q", chunks, conn.last())
+		}
+	}
+}
+
+func TestHttpResponseWithoutBody(t *testing.T) {
+	conn, pipeline := newHttpTestPipeline()
+	data := "HEAD /echo HTTP/1.1\r\nContent-Length: 4\r\n\r\nping" +
+		"GET /echo HTTP/1.1\r\nContent-Length: 4\r\n\r\npong"
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte(data)})
+	if len(conn.writes) != 2 {
+		t.Fatalf("expected 2 responses, got %q", conn.writes)
+	}
+	if head := string(conn.writes[0]); !strings.Contains(head, "Content-Length: 4\r\n") || !strings.HasSuffix(head, "\r\n\r\n") {
+		t.Errorf("head response %q", head)
+	}
+	if get := string(conn.writes[1]); !strings.HasSuffix(get, "\r\n\r\npong") {
+		t.Errorf("get response %q", get)
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		out := string(EncodeHttpResponse(&HttpResponseMessage{Status: status, Header: http.Header{}, Body: []byte("body"), KeepAlive: true}))
+		if strings.Contains(out, "Content-Length") || !strings.HasSuffix(out, "\r\n\r\n") {
+			t.Errorf("%d response %q", status, out)
+		}
+	}
+}
+
+func TestHttpSessionCookie(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(NewXmlServletConfig("not-exist.xml"))
+	context.Set(SessionManagerKey, manager)
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), context)
+	servlet.AddHandler("visit", func(request Request, response Response) {
+		session := *request.GetSession(true)
+		count, _ := session.Get("count").(int)
+		session.Set("count", count+1)
+		response.Write([]byte(strconv.Itoa(count + 1)))
+	})
+
+	// 每个请求使用新的连接，只能通过cookie找到session
+	visit := func(cookie string) string {
+		conn := &recordConn{}
+		pipeline := NewConnPipeline(conn)
+		conn.SetContext(pipeline)
+		AddHttpHandlers(pipeline, servlet, context)
+		pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte("GET /visit HTTP/1.1\r\n" + cookie + "\r\n")})
+		return string(conn.last())
+	}
+
+	first := visit("")
+	start := strings.Index(first, "Set-Cookie: JSESSIONID=")
+	if start < 0 || !strings.Contains(first, "; Path=/; HttpOnly\r\n") || !strings.HasSuffix(first, "\r\n\r\n1") {
+		t.Fatalf("first response %q", first)
+	}
+	cookie := first[start+len("Set-Cookie: ") : start+strings.Index(first[start:], ";")]
+
+	second := visit("Cookie: " + cookie + "\r\n")
+	if strings.Contains(second, "Set-Cookie") || !strings.HasSuffix(second, "\r\n\r\n2") {
+		t.Fatalf("second response %q", second)
+	}
+	if manager.Count() != 1 {
+		t.Errorf("sessions %d", manager.Count())
+	}
+}
@@ -0,0 +1,400 @@
+package servlet
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// EnvPrefix 环境变量配置的前缀，例如LEARNGO_SESSION_TIMEOUT_TIME对应sessionTimeoutTime
+	EnvPrefix = "LEARNGO_"
+	// ConfigXmlKey xml配置文件的路径，可以通过环境变量或者命令行参数设置
+	ConfigXmlKey = "config"
+	// ConfigJsonKey json配置文件的路径，可以通过环境变量或者命令行参数设置
+	ConfigJsonKey = "configJson"
+	// DumpConfigKey 为true时启动时输出生效的配置以及来源，例如--dumpConfig
+	DumpConfigKey = "dumpConfig"
+	// ConfigReferenceKey 为true时输出所有配置项的说明之后退出，例如--configReference
+	ConfigReferenceKey = "configReference"
+)
+
+// loaderConfigKeys 加载配置本身使用的配置项
+var loaderConfigKeys = []ConfigKey{
+	{Key: ConfigXmlKey, Type: ConfigTypeString, Default: "server.xml", Description: "path of the xml config file"},
+	{Key: ConfigJsonKey, Type: ConfigTypeString, Default: "server.json", Description: "path of the json config file"},
+	{Key: DumpConfigKey, Type: ConfigTypeBool, Default: false, Description: "print the effective config with sources at startup"},
+	{Key: ConfigReferenceKey, Type: ConfigTypeBool, Default: false, Description: "print the reference of all config keys and exit"},
+	{Key: ConfigReloadIntervalKey, Type: ConfigTypeDuration, Default: 5 * time.Second, Min: time.Duration(0), Description: "interval of checking config files for changes, 0 disables hot reload"},
+}
+
+// ConfigLayer 配置层，后面的覆盖前面的
+type ConfigLayer int
+
+const (
+	LayerDefault ConfigLayer = iota
+	LayerXml
+	LayerJson
+	LayerEnv
+	LayerFlag
+	layerCount
+)
+
+var interpolatePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(?::([^}]*))?\}`)
+
+// interpolate 把${ENV:default}替换成环境变量，环境变量不存在时使用default
+func interpolate(value string) string {
+	if !strings.Contains(value, "${") {
+		return value
+	}
+	return interpolatePattern.ReplaceAllStringFunc(value, func(s string) string {
+		match := interpolatePattern.FindStringSubmatch(s)
+		if v, ok := os.LookupEnv(match[1]); ok {
+			return v
+		}
+		return match[2]
+	})
+}
+
+type configValue struct {
+	value  interface{}
+	source string
+}
+
+// ConfigEntry 生效的一项配置以及它的来源
+type ConfigEntry struct {
+	Key    string
+	Value  interface{}
+	Source string
+}
+
+// LayeredServletConfig 按默认值、xml、json、环境变量、命令行参数的顺序叠加的配置，后面的覆盖前面的，
+// 与加载的顺序无关。环境变量和命令行参数的名字忽略大小写以及.、_、-，与其它层已有的key匹配
+type LayeredServletConfig struct {
+	configGetter
+	mutex  sync.RWMutex
+	layers [layerCount]map[string]configValue
+	merged map[string]configValue
+	// index 归一化的key到merged中key的映射，Get找不到key时使用，让没有在其它层出现过的环境变量也能被读取
+	index map[string]string
+	// files 每一层加载的配置文件，用于热加载
+	files     [layerCount]*watchedFile
+	listeners []ConfigChangeListener
+	validator func(config ServletConfig) error
+	stopWatch chan struct{}
+}
+
+// NewLayeredServletConfig 创建空的配置
+func NewLayeredServletConfig() *LayeredServletConfig {
+	config := &LayeredServletConfig{merged: make(map[string]configValue)}
+	config.get = config.Get
+	return config
+}
+
+// LoadServletConfig 加载默认的配置：server.xml、server.json、LEARNGO_*环境变量以及args中的--key=value，
+// 配置文件的路径可以通过config和configJson修改，没有指定路径的配置文件不存在时跳过
+func LoadServletConfig(args []string) (*LayeredServletConfig, error) {
+	config := NewLayeredServletConfig()
+	config.LoadSchemaDefaults()
+	config.LoadEnv(EnvPrefix, os.Environ())
+	config.LoadFlags(args)
+
+	if err := config.loadFile(ConfigXmlKey, "server.xml", config.LoadXml); err != nil {
+		return config, err
+	}
+	if err := config.loadFile(ConfigJsonKey, "server.json", config.LoadJson); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func (c *LayeredServletConfig) loadFile(key string, defaultPath string, load func(path string) error) error {
+	path := c.GetString(key, defaultPath)
+	explicit := c.Source(key) != "" && c.Source(key) != "default"
+	if err := load(path); err != nil && (explicit || !os.IsNotExist(err)) {
+		return err
+	}
+	return nil
+}
+
+func (c *LayeredServletConfig) Get(key string) interface{} {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.lookup(key).value
+}
+
+// lookup 先精确匹配key，再忽略大小写以及.、_、-匹配，需要持有读锁
+func (c *LayeredServletConfig) lookup(key string) configValue {
+	if value, ok := c.merged[key]; ok {
+		return value
+	}
+	return c.merged[c.index[normalizeConfigKey(key)]]
+}
+
+// Keys 所有生效的key
+func (c *LayeredServletConfig) Keys() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	keys := make([]string, 0, len(c.merged))
+	for key := range c.merged {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Source 配置的来源，例如default、xml:server.xml、env:LEARNGO_PORT，不存在时返回空字符串
+func (c *LayeredServletConfig) Source(key string) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.lookup(key).source
+}
+
+// SetDefault 设置默认值
+func (c *LayeredServletConfig) SetDefault(key string, value interface{}) {
+	c.mutex.Lock()
+	if c.layers[LayerDefault] == nil {
+		c.layers[LayerDefault] = make(map[string]configValue)
+	}
+	c.layers[LayerDefault][key] = configValue{value: value, source: "default"}
+	keys := c.merge()
+	listeners := c.listeners
+	c.mutex.Unlock()
+
+	fireConfigChange(listeners, keys)
+}
+
+// LoadSchemaDefaults 使用ConfigSchema中声明的Default作为默认值，前缀声明和没有Default的配置项跳过，已经通过SetDefault设置的不覆盖
+func (c *LayeredServletConfig) LoadSchemaDefaults() {
+	defaults := make(map[string]configValue)
+	for _, declared := range ConfigSchema() {
+		if _, ok := declared.prefix(); !ok && declared.Default != nil {
+			defaults[declared.Key] = configValue{value: declared.Default, source: "default"}
+		}
+	}
+
+	c.mutex.Lock()
+	for key, value := range c.layers[LayerDefault] {
+		defaults[key] = value
+	}
+	c.layers[LayerDefault] = defaults
+	keys := c.merge()
+	listeners := c.listeners
+	c.mutex.Unlock()
+
+	fireConfigChange(listeners, keys)
+}
+
+// LoadXml 加载xml配置文件，替换之前加载的xml层，解析错误时依然使用解析成功的属性
+func (c *LayeredServletConfig) LoadXml(path string) error {
+	return c.loadLayer(LayerXml, path)
+}
+
+// LoadJson 加载json配置文件，替换之前加载的json层，嵌套的对象按.展开成key，例如{"network":{"port":8010}}为network.port，
+// 整数为int，其它数字为float64，数组为[]string
+func (c *LayeredServletConfig) LoadJson(path string) error {
+	return c.loadLayer(LayerJson, path)
+}
+
+func (c *LayeredServletConfig) loadLayer(layer ConfigLayer, path string) error {
+	file, content, err := statFile(path)
+	if err != nil {
+		return err
+	}
+	values, err := parseLayer(layer, path, content)
+	if values == nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.files[layer] = file
+	c.mutex.Unlock()
+	c.setLayer(layer, values)
+	return err
+}
+
+// parseLayer 解析配置文件，xml中部分属性解析失败时依然返回解析成功的属性
+func parseLayer(layer ConfigLayer, path string, content []byte) (map[string]configValue, error) {
+	if layer == LayerXml {
+		xmlConfig := newXmlServletConfig()
+		err := xmlConfig.parseContent(path, content)
+		values := make(map[string]configValue, len(xmlConfig.config))
+		for key, value := range xmlConfig.config {
+			values[key] = configValue{value: value, source: "xml:" + path}
+		}
+		return values, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var root map[string]interface{}
+	if err := decoder.Decode(&root); err != nil {
+		line := 1
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line = lineAt(content, syntaxErr.Offset)
+		}
+		return nil, &ConfigError{File: path, Line: line, Err: err}
+	}
+
+	values := make(map[string]configValue)
+	flattenJson("", root, "json:"+path, values)
+	return values, nil
+}
+
+func flattenJson(prefix string, object map[string]interface{}, source string, values map[string]configValue) {
+	for key, value := range object {
+		key = prefix + key
+		switch v := value.(type) {
+		case nil:
+		case map[string]interface{}:
+			flattenJson(key+".", v, source, values)
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				list = append(list, interpolate(fmt.Sprint(item)))
+			}
+			values[key] = configValue{value: list, source: source}
+		case json.Number:
+			if n, err := v.Int64(); err == nil && int64(int(n)) == n {
+				values[key] = configValue{value: int(n), source: source}
+			} else if f, err := v.Float64(); err == nil {
+				values[key] = configValue{value: f, source: source}
+			}
+		case string:
+			values[key] = configValue{value: interpolate(v), source: source}
+		default:
+			values[key] = configValue{value: v, source: source}
+		}
+	}
+}
+
+// LoadEnv 加载prefix开头的环境变量，environ的格式与os.Environ相同，值都是字符串，由getter转换成需要的类型
+func (c *LayeredServletConfig) LoadEnv(prefix string, environ []string) {
+	values := make(map[string]configValue)
+	for _, env := range environ {
+		i := strings.Index(env, "=")
+		if i < 0 || !strings.HasPrefix(env[:i], prefix) || i == len(prefix) {
+			continue
+		}
+		name := env[len(prefix):i]
+		values[name] = configValue{value: interpolate(env[i+1:]), source: "env:" + env[:i]}
+	}
+	c.setLayer(LayerEnv, values)
+}
+
+// LoadFlags 加载命令行参数中的--key=value和-key=value，只有--key时只接受声明为bool的配置项，值为true。
+// 不会把后面的参数作为值，其它参数以及没有声明的--key被忽略，例如go test的-test.v
+func (c *LayeredServletConfig) LoadFlags(args []string) {
+	values := make(map[string]configValue)
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || len(strings.TrimLeft(arg, "-")) == 0 {
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		value := "true"
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if declared, ok := lookupConfigKey(name); !ok || declared.Type != ConfigTypeBool {
+			continue
+		}
+		values[name] = configValue{value: interpolate(value), source: "flag:--" + name}
+	}
+	c.setLayer(LayerFlag, values)
+}
+
+func (c *LayeredServletConfig) setLayer(layer ConfigLayer, values map[string]configValue) {
+	c.mutex.Lock()
+	c.layers[layer] = values
+	keys := c.merge()
+	listeners := c.listeners
+	c.mutex.Unlock()
+
+	fireConfigChange(listeners, keys)
+}
+
+// merge 重新计算生效的配置，返回值发生变化的key，需要持有写锁
+func (c *LayeredServletConfig) merge() []string {
+	merged := make(map[string]configValue)
+	index := make(map[string]string)
+	for layer := LayerDefault; layer < layerCount; layer++ {
+		loose := layer == LayerEnv || layer == LayerFlag
+		for name, value := range c.layers[layer] {
+			key := name
+			if loose {
+				if exists, ok := index[normalizeConfigKey(name)]; ok {
+					key = exists
+				} else if layer == LayerEnv {
+					key = strings.ToLower(strings.Replace(name, "_", ".", -1))
+				}
+			}
+			merged[key] = value
+			if _, ok := index[normalizeConfigKey(key)]; !ok {
+				index[normalizeConfigKey(key)] = key
+			}
+		}
+	}
+
+	var keys []string
+	for key, value := range merged {
+		if old, ok := c.merged[key]; !ok || !reflect.DeepEqual(old.value, value.value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range c.merged {
+		if _, ok := merged[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	c.merged = merged
+	c.index = index
+	return keys
+}
+
+// normalizeConfigKey 忽略大小写以及.、_、-
+func normalizeConfigKey(key string) string {
+	key = strings.ToLower(key)
+	return strings.NewReplacer(".", "", "_", "", "-", "").Replace(key)
+}
+
+// Effective 按key排序的生效配置
+func (c *LayeredServletConfig) Effective() []ConfigEntry {
+	c.mutex.RLock()
+	entries := make([]ConfigEntry, 0, len(c.merged))
+	for key, value := range c.merged {
+		entries = append(entries, ConfigEntry{Key: key, Value: value.value, Source: value.source})
+	}
+	c.mutex.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
+
+// Dump 输出生效的配置以及来源，key中包含password、secret或者token的值会被隐藏
+func (c *LayeredServletConfig) Dump(w io.Writer) {
+	for _, entry := range c.Effective() {
+		value := fmt.Sprint(entry.Value)
+		lower := strings.ToLower(entry.Key)
+		if strings.Contains(lower, "password") || strings.Contains(lower, "secret") || strings.Contains(lower, "token") {
+			value = "******"
+		}
+		fmt.Fprintf(w, "%s = %s (%s)\n", entry.Key, value, entry.Source)
+	}
+}
@@ -0,0 +1,106 @@
+package servlet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayeredServletConfigPrecedence(t *testing.T) {
+	os.Setenv("LEARNGO_TEST_HOST", "db.local")
+	defer os.Unsetenv("LEARNGO_TEST_HOST")
+
+	xmlPath := writeConfig(t, `<servlet><props>
+		<property name="sessionTimeoutTime" type="int">1000</property>
+		<property name="compress" type="bool">false</property>
+		<property name="dsn">mysql://${LEARNGO_TEST_HOST}:${LEARNGO_TEST_PORT:3306}/app</property>
+	</props></servlet>`)
+	jsonPath := filepath.Join(t.TempDir(), "server.json")
+	if err := ioutil.WriteFile(jsonPath, []byte(`{"sessionTimeoutTime": 2000, "network": {"port": 8010, "hosts": ["a", "b"]}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewLayeredServletConfig()
+	// 加载顺序与优先级无关
+	config.LoadFlags([]string{"--network.port=9000", "--compress", "-codec=gob", "server", "-test.v", "-pushQueueSize", "7"})
+	config.LoadEnv(EnvPrefix, []string{"LEARNGO_SESSION_TIMEOUT_TIME=3000", "LEARNGO_NETWORK_PORT=8020", "LEARNGO_PUSH_QUEUE_SIZE=5", "OTHER=1"})
+	if err := config.LoadJson(jsonPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadXml(xmlPath); err != nil {
+		t.Fatal(err)
+	}
+	config.SetDefault("sessionTickTime", 500)
+	config.SetDefault("compress", false)
+
+	if v := config.GetSessionTimeoutMillis(); v != 3000 {
+		t.Errorf("sessionTimeoutTime %d", v)
+	}
+	if v := config.GetInt("network.port", 0); v != 9000 {
+		t.Errorf("network.port %d", v)
+	}
+	if !config.GetBool("compress", false) || config.GetString("codec", "") != "gob" {
+		t.Errorf("flags %v %q", config.Get("compress"), config.GetString("codec", ""))
+	}
+	if v := config.GetSessionTickTime(); v != 500 {
+		t.Errorf("sessionTickTime %d", v)
+	}
+	// 不带=的参数不会把后面的参数作为值，没有声明为bool的--key被忽略
+	if v := config.GetInt("pushQueueSize", 0); v != 5 {
+		t.Errorf("pushQueueSize %d", v)
+	}
+	if v := config.Get("test.v"); v != nil {
+		t.Errorf("undeclared bare flag loaded: %v", v)
+	}
+	if v := config.GetStringList("network.hosts", nil); len(v) != 2 || v[1] != "b" {
+		t.Errorf("network.hosts %v", v)
+	}
+	if v := config.GetString("dsn", ""); v != "mysql://db.local:3306/app" {
+		t.Errorf("dsn %q", v)
+	}
+
+	sources := map[string]string{
+		"sessionTimeoutTime": "env:LEARNGO_SESSION_TIMEOUT_TIME",
+		"network.port":       "flag:--network.port",
+		"network.hosts":      "json:" + jsonPath,
+		"dsn":                "xml:" + xmlPath,
+		"sessionTickTime":    "default",
+	}
+	for key, source := range sources {
+		if v := config.Source(key); v != source {
+			t.Errorf("source of %s: %q", key, v)
+		}
+	}
+
+	var dump strings.Builder
+	config.Dump(&dump)
+	if !strings.Contains(dump.String(), "network.port = 9000 (flag:--network.port)\n") {
+		t.Errorf("dump %s", dump.String())
+	}
+}
+
+func TestLayeredServletConfigErrors(t *testing.T) {
+	config := NewLayeredServletConfig()
+	jsonPath := filepath.Join(t.TempDir(), "server.json")
+	ioutil.WriteFile(jsonPath, []byte("{\n\"a\": 1,\n}"), 0644)
+
+	err := config.LoadJson(jsonPath)
+	configErr, ok := err.(*ConfigError)
+	if !ok || configErr.Line != 3 {
+		t.Fatalf("json error %v", err)
+	}
+
+	xmlPath := writeConfig(t, `<servlet><props><property name="a" type="int">x</property><property name="b">ok</property></props></servlet>`)
+	if err := config.LoadXml(xmlPath); err == nil {
+		t.Fatal("expect xml error")
+	}
+	if config.GetString("b", "") != "ok" {
+		t.Error("valid properties should be kept")
+	}
+
+	if _, err := LoadServletConfig([]string{"--config=" + filepath.Join(t.TempDir(), "missing.xml")}); err == nil {
+		t.Error("explicit config file should exist")
+	}
+}
@@ -0,0 +1,181 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"log"
+	"runtime/debug"
+)
+
+// ServletContextListener ServletContext的生命周期，ContextInitialized在servlet初始化之前调用，
+// ContextDestroyed在所有servlet销毁之后按注册的相反顺序调用
+type ServletContextListener interface {
+	ContextInitialized(context ServletContext)
+	ContextDestroyed(context ServletContext)
+}
+
+// SessionListener session的生命周期，SessionDestroyed在session过期或者被移除时调用，
+// 属性被删除时newValue为nil。回调在锁外执行
+type SessionListener interface {
+	SessionCreated(session Session)
+	SessionDestroyed(session Session)
+	SessionAttributeChanged(session Session, key string, oldValue interface{}, newValue interface{})
+}
+
+// RequestListener 请求的开始和结束，err为Service返回的错误
+type RequestListener interface {
+	RequestInitialized(request Request)
+	RequestDestroyed(request Request, err error)
+}
+
+// ContextListenerFuncs 函数形式的ServletContextListener，没有设置的回调会被忽略
+type ContextListenerFuncs struct {
+	Initialized func(context ServletContext)
+	Destroyed   func(context ServletContext)
+}
+
+func (f ContextListenerFuncs) ContextInitialized(context ServletContext) {
+	if f.Initialized != nil {
+		f.Initialized(context)
+	}
+}
+
+func (f ContextListenerFuncs) ContextDestroyed(context ServletContext) {
+	if f.Destroyed != nil {
+		f.Destroyed(context)
+	}
+}
+
+// SessionListenerFuncs 函数形式的SessionListener，没有设置的回调会被忽略
+type SessionListenerFuncs struct {
+	Created          func(session Session)
+	Destroyed        func(session Session)
+	AttributeChanged func(session Session, key string, oldValue interface{}, newValue interface{})
+}
+
+func (f SessionListenerFuncs) SessionCreated(session Session) {
+	if f.Created != nil {
+		f.Created(session)
+	}
+}
+
+func (f SessionListenerFuncs) SessionDestroyed(session Session) {
+	if f.Destroyed != nil {
+		f.Destroyed(session)
+	}
+}
+
+func (f SessionListenerFuncs) SessionAttributeChanged(session Session, key string, oldValue interface{}, newValue interface{}) {
+	if f.AttributeChanged != nil {
+		f.AttributeChanged(session, key, oldValue, newValue)
+	}
+}
+
+// RequestListenerFuncs 函数形式的RequestListener，没有设置的回调会被忽略
+type RequestListenerFuncs struct {
+	Initialized func(request Request)
+	Destroyed   func(request Request, err error)
+}
+
+func (f RequestListenerFuncs) RequestInitialized(request Request) {
+	if f.Initialized != nil {
+		f.Initialized(request)
+	}
+}
+
+func (f RequestListenerFuncs) RequestDestroyed(request Request, err error) {
+	if f.Destroyed != nil {
+		f.Destroyed(request, err)
+	}
+}
+
+// Listeners 注册在服务器上的监听器，需要在启动之前注册
+type Listeners struct {
+	context []ServletContextListener
+	session []SessionListener
+	request []RequestListener
+}
+
+var serverListeners = &Listeners{}
+
+// AddListener 给StartServer启动的服务注册监听器，需要在StartServer之前调用
+func AddListener(listener interface{}) error {
+	return serverListeners.Add(listener)
+}
+
+// Add 注册监听器，listener可以同时实现多个监听器接口，一个都没有实现时返回NotSupport
+func (l *Listeners) Add(listener interface{}) error {
+	supported := false
+	if v, ok := listener.(ServletContextListener); ok {
+		l.context = append(l.context, v)
+		supported = true
+	}
+	if v, ok := listener.(SessionListener); ok {
+		l.session = append(l.session, v)
+		supported = true
+	}
+	if v, ok := listener.(RequestListener); ok {
+		l.request = append(l.request, v)
+		supported = true
+	}
+	if !supported {
+		return internalErrors.NotSupport
+	}
+	return nil
+}
+
+// bind 把session监听器注册到SessionManager
+func (l *Listeners) bind(manager *SessionManager) {
+	for _, listener := range l.session {
+		manager.AddSessionListener(listener)
+	}
+}
+
+func (l *Listeners) fireContextInitialized(context ServletContext) {
+	for _, listener := range l.context {
+		listener.ContextInitialized(context)
+	}
+}
+
+func (l *Listeners) fireContextDestroyed(context ServletContext) {
+	for i := len(l.context) - 1; i >= 0; i-- {
+		l.context[i].ContextDestroyed(context)
+	}
+}
+
+// lifecycleServlet 最外层的servlet，在Service前后触发RequestListener
+type lifecycleServlet struct {
+	Servlet
+	listeners *Listeners
+}
+
+// withListeners 有RequestListener时包装servlet
+func withListeners(servlet Servlet, listeners *Listeners) Servlet {
+	if len(listeners.request) == 0 {
+		return servlet
+	}
+	return &lifecycleServlet{Servlet: servlet, listeners: listeners}
+}
+
+func (s *lifecycleServlet) Service(request Request, response Response) (err error) {
+	s.fire(request, func(listener RequestListener) {
+		listener.RequestInitialized(request)
+	})
+	defer s.fire(request, func(listener RequestListener) {
+		listener.RequestDestroyed(request, err)
+	})
+	return s.Servlet.Service(request, response)
+}
+
+// fire 依次调用监听器，监听器的panic只打印日志，不影响其它监听器以及请求的处理
+func (s *lifecycleServlet) fire(request Request, f func(listener RequestListener)) {
+	for _, listener := range s.listeners.request {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("request listener of %s panic: %v\n%s", request.Command(), r, debug.Stack())
+				}
+			}()
+			f(listener)
+		}()
+	}
+}
@@ -0,0 +1,123 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSessionListener(t *testing.T) {
+	manager := NewSessionManager(NewXmlServletConfig("not-exist.xml"))
+	var events []string
+	manager.AddSessionListener(SessionListenerFuncs{
+		Created:   func(session Session) { events = append(events, "created") },
+		Destroyed: func(session Session) { events = append(events, "destroyed") },
+		AttributeChanged: func(session Session, key string, oldValue interface{}, newValue interface{}) {
+			events = append(events, fmt.Sprintf("%s:%v->%v", key, oldValue, newValue))
+		},
+	})
+
+	session := manager.CreateSession()
+	session.Set("level", 1)
+	session.Set("level", 2)
+	session.Delete("level")
+	session.Delete("missing")
+	manager.Remove(session.Id())
+
+	if got := strings.Join(events, ","); got != "created,level:<nil>->1,level:1->2,level:2-><nil>,destroyed" {
+		t.Fatalf("events %s", got)
+	}
+}
+
+func TestSessionListenerPanic(t *testing.T) {
+	manager := NewSessionManager(NewXmlServletConfig("not-exist.xml"))
+	var events []string
+	manager.OnDiscard(func(session Session) { panic("discard") })
+	manager.AddSessionListener(SessionListenerFuncs{
+		Created:   func(session Session) { panic("created") },
+		Destroyed: func(session Session) { panic("destroyed") },
+		AttributeChanged: func(session Session, key string, oldValue interface{}, newValue interface{}) {
+			panic("changed")
+		},
+	})
+	manager.AddSessionListener(SessionListenerFuncs{
+		Created:   func(session Session) { events = append(events, "created") },
+		Destroyed: func(session Session) { events = append(events, "destroyed") },
+		AttributeChanged: func(session Session, key string, oldValue interface{}, newValue interface{}) {
+			events = append(events, key)
+		},
+	})
+
+	session := manager.CreateSession()
+	session.Set("level", 1)
+	manager.Remove(session.Id())
+
+	if got := strings.Join(events, ","); got != "created,level,destroyed" {
+		t.Fatalf("events %s", got)
+	}
+}
+
+func TestRequestListener(t *testing.T) {
+	listeners := &Listeners{}
+	var events []string
+	if err := listeners.Add(RequestListenerFuncs{
+		Initialized: func(request Request) { events = append(events, "start:"+request.Command()) },
+		Destroyed: func(request Request, err error) {
+			events = append(events, fmt.Sprintf("end:%s:%v", request.Command(), err != nil))
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := listeners.Add(struct{}{}); err != internalErrors.NotSupport {
+		t.Errorf("expect NotSupport, got %v", err)
+	}
+
+	dispatch := &DispatchServlet{}
+	dispatch.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	dispatch.AddHandler("ping", func(Request, Response) {})
+	servlet := withListeners(dispatch, listeners)
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "ping"}), NewTcpResponse(conn))
+	servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "missing"}), NewTcpResponse(conn))
+	if got := strings.Join(events, ","); got != "start:ping,end:ping:false,start:missing,end:missing:true" {
+		t.Fatalf("events %s", got)
+	}
+}
+
+type destroyServlet struct {
+	DispatchServlet
+	name  string
+	trace *[]string
+}
+
+func (d *destroyServlet) Destroy() {
+	*d.trace = append(*d.trace, d.name)
+}
+
+func TestServletContainerDestroy(t *testing.T) {
+	var trace []string
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		RegisterServletFactory("test.destroy."+name, func() Servlet { return &destroyServlet{name: name, trace: &trace} })
+	}
+	first, second := 1, 2
+	container, err := NewServletContainer(&Descriptor{
+		Servlets: []ServletDef{
+			{Name: "a", Class: "test.destroy.a", LoadOnStartup: &second},
+			{Name: "b", Class: "test.destroy.b", LoadOnStartup: &first},
+			{Name: "c", Class: "test.destroy.c"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	container.Destroy()
+	// c没有初始化，不需要销毁
+	if got := strings.Join(trace, ","); got != "a,b" {
+		t.Fatalf("destroy order %s", got)
+	}
+}
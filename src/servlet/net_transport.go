@@ -0,0 +1,180 @@
+package servlet
+
+import (
+	"LearnGo/src/graceful"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// NetTransport 基于标准库net.Listener的传输层，每个连接一个goroutine
+type NetTransport struct {
+	// ReadBufferSize 每个连接的读缓冲大小
+	ReadBufferSize int
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[*netConn]struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// NewNetTransport 创建标准库传输层
+func NewNetTransport() *NetTransport {
+	return &NetTransport{ReadBufferSize: 4096, conns: make(map[*netConn]struct{})}
+}
+
+func (t *NetTransport) Serve(protoAddr string, handler TransportHandler) error {
+	network, address := parseProtoAddr(protoAddr)
+	ln, err := graceful.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.listener = ln
+	closed := t.closed
+	t.mutex.Unlock()
+	if closed {
+		// Stop在开始监听之前已经执行
+		ln.Close()
+		return nil
+	}
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			t.mutex.Lock()
+			closed := t.closed
+			t.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		conn := &netConn{conn: c}
+		t.mutex.Lock()
+		t.conns[conn] = struct{}{}
+		t.mutex.Unlock()
+
+		t.wg.Add(1)
+		go t.serveConn(conn, handler)
+	}
+}
+
+func (t *NetTransport) serveConn(conn *netConn, handler TransportHandler) {
+	defer t.wg.Done()
+
+	handler.OnOpened(conn)
+
+	var err error
+	buf := make([]byte, t.ReadBufferSize)
+	for {
+		var n int
+		n, err = conn.conn.Read(buf)
+		if n > 0 {
+			handler.OnData(conn, buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	conn.Close()
+
+	t.mutex.Lock()
+	delete(t.conns, conn)
+	t.mutex.Unlock()
+
+	handler.OnClosed(conn, err)
+}
+
+// Addr 监听地址，Serve开始监听之前返回nil
+func (t *NetTransport) Addr() net.Addr {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Addr()
+}
+
+func (t *NetTransport) Stop(ctx context.Context) error {
+	t.mutex.Lock()
+	t.closed = true
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	t.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		t.mutex.Lock()
+		for conn := range t.conns {
+			conn.Close()
+		}
+		t.mutex.Unlock()
+		<-finished
+	}
+	return err
+}
+
+func (t *NetTransport) CountConnections() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.conns)
+}
+
+// netConn 标准库连接适配成Conn，写操作加锁保证多个goroutine写入不会交错
+type netConn struct {
+	conn       net.Conn
+	ctx        interface{}
+	writeMutex sync.Mutex
+}
+
+func (c *netConn) Context() interface{} {
+	return c.ctx
+}
+
+func (c *netConn) SetContext(ctx interface{}) {
+	c.ctx = ctx
+}
+
+func (c *netConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *netConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *netConn) AsyncWrite(buf []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+func (c *netConn) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,177 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	// PushServiceKey PushService保存在ServletContext中的key
+	PushServiceKey = "servlet.pushService"
+	// PushAttr 连接上的推送通道保存在ConnPipeline上的属性名
+	PushAttr = "servlet.push"
+	// PingCommand 心跳推送使用的命令，内容为空
+	PingCommand = "ping"
+)
+
+// EncodeTcpMessage 编码tcp消息：4字节长度 + 32字节命令 + 4字节requestId + 内容，长度不包含自身的4个字节，
+// requestId的最高两位是MessageFlags
+func EncodeTcpMessage(command string, requestId int, content []byte) []byte {
+	return encodeTcpMessage(command, requestId, 0, content)
+}
+
+// MessageFlags 消息头requestId字段的最高两位，requestId只使用低30位
+type MessageFlags uint32
+
+const (
+	// MessageFlagCompressed 内容经过压缩
+	MessageFlagCompressed MessageFlags = 1 << 31
+	// MessageFlagEncrypted 内容经过加密，先压缩再加密
+	MessageFlagEncrypted MessageFlags = 1 << 30
+
+	messageFlagMask = MessageFlagCompressed | MessageFlagEncrypted
+)
+
+func (f MessageFlags) Compressed() bool {
+	return f&MessageFlagCompressed != 0
+}
+
+func (f MessageFlags) Encrypted() bool {
+	return f&MessageFlagEncrypted != 0
+}
+
+// DecodeRequestId 解析消息头中的requestId字段，返回requestId以及内容的标记
+func DecodeRequestId(value uint32) (int, MessageFlags) {
+	return int(value &^ uint32(messageFlagMask)), MessageFlags(value) & messageFlagMask
+}
+
+// encodeRequestId DecodeRequestId的逆操作
+func encodeRequestId(requestId int, flags MessageFlags) uint32 {
+	return uint32(requestId)&^uint32(messageFlagMask) | uint32(flags&messageFlagMask)
+}
+
+// encodeTcpMessage 编码tcp消息并在requestId字段设置flags
+func encodeTcpMessage(command string, requestId int, flags MessageFlags, content []byte) []byte {
+	data := make([]byte, 4+commandLength+4+len(content))
+	binary.BigEndian.PutUint32(data, uint32(commandLength+4+len(content)))
+	copy(data[4:4+commandLength], command)
+	binary.BigEndian.PutUint32(data[4+commandLength:], encodeRequestId(requestId, flags))
+	copy(data[4+commandLength+4:], content)
+	return data
+}
+
+// TcpPush 绑定在连接pipeline上的推送通道，推送消息的格式与请求相同，requestId为0，
+// 消息从pipeline尾部写出，会经过所有的OutboundHandler
+type TcpPush struct {
+	pipeline  *ConnPipeline
+	discarded int32
+}
+
+// NewTcpPush 创建tcp推送通道
+func NewTcpPush(pipeline *ConnPipeline) *TcpPush {
+	return &TcpPush{pipeline: pipeline}
+}
+
+func (p *TcpPush) Push(command string, bytes []byte) {
+	if !p.IsPushable() {
+		return
+	}
+	bytes, flags := sealBody(p.pipeline.conn, command, 0, bytes)
+	p.pipeline.Write(encodeTcpMessage(command, 0, flags, bytes))
+}
+
+// IsPushable 没有被丢弃并且连接还没有关闭
+func (p *TcpPush) IsPushable() bool {
+	return atomic.LoadInt32(&p.discarded) == 0 && p.pipeline.IsActive()
+}
+
+// Discard 丢弃推送通道并关闭连接
+func (p *TcpPush) Discard() {
+	if atomic.CompareAndSwapInt32(&p.discarded, 0, 1) {
+		p.pipeline.Conn().Close()
+	}
+}
+
+// Heartbeat 推送一个PingCommand
+func (p *TcpPush) Heartbeat() {
+	p.Push(PingCommand, nil)
+}
+
+func (p *TcpPush) Protocol() ServerProtocol {
+	return TCP
+}
+
+// UdpPush udp推送通道，每条推送消息作为一个数据报发送给对端
+type UdpPush struct {
+	TcpPush
+}
+
+// NewUdpPush 创建udp推送通道
+func NewUdpPush(pipeline *ConnPipeline) *UdpPush {
+	return &UdpPush{TcpPush{pipeline: pipeline}}
+}
+
+func (p *UdpPush) Protocol() ServerProtocol {
+	return UDP
+}
+
+// PushService 按sessionId把消息推送到session绑定的连接上
+type PushService struct {
+	manager *SessionManager
+}
+
+// NewPushService 创建PushService
+func NewPushService(manager *SessionManager) *PushService {
+	return &PushService{manager: manager}
+}
+
+// sessionPusher 支持离线推送的session
+type sessionPusher interface {
+	Push(command string, bytes []byte) error
+}
+
+// queuedPusher 可以区分消息是已经推送还是放入了离线队列的session
+type queuedPusher interface {
+	offer(command string, bytes []byte) (bool, error)
+}
+
+// PushTo 推送消息给session，推送通道暂时不可用时由session缓存到离线队列，
+// session不存在或者无法推送时返回错误
+func (s *PushService) PushTo(sessionId string, command string, bytes []byte) error {
+	session := s.manager.GetSession(sessionId)
+	if session == nil {
+		return internalErrors.SessionNotFound
+	}
+	_, err := pushSession(session, command, bytes)
+	return err
+}
+
+// pushSession 通过session的推送通道推送消息，支持离线推送的session由session自己处理，
+// 第一个返回值表示消息放入了离线队列
+func pushSession(session Session, command string, bytes []byte) (bool, error) {
+	if pusher, ok := session.(queuedPusher); ok {
+		return pusher.offer(command, bytes)
+	}
+	if pusher, ok := session.(sessionPusher); ok {
+		return false, pusher.Push(command, bytes)
+	}
+	push := session.GetPush()
+	if push == nil || *push == nil || !(*push).IsPushable() {
+		return false, internalErrors.NotPushable
+	}
+	(*push).Push(command, bytes)
+	return false, nil
+}
+
+func newTcpPush(pipeline *ConnPipeline) Push {
+	return NewTcpPush(pipeline)
+}
+
+func newUdpPush(pipeline *ConnPipeline) Push {
+	return NewUdpPush(pipeline)
+}
+
+func newWebSocketPush(pipeline *ConnPipeline) Push {
+	return NewWebSocketPush(pipeline.Conn())
+}
@@ -0,0 +1,166 @@
+package servlet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PushOverflowPolicy 离线推送队列满了之后的处理策略
+type PushOverflowPolicy int
+
+const (
+	// DropOldest 丢弃最早的消息
+	DropOldest PushOverflowPolicy = iota
+	// Disconnect 清空队列并丢弃session，客户端需要重新登录
+	Disconnect
+)
+
+const (
+	defaultPushQueueSize = 100
+	defaultPushQueueTTL  = 30 * time.Second
+)
+
+// PushMessage 离线队列中等待补发的推送消息
+type PushMessage struct {
+	Command string
+	Bytes   []byte
+	Expire  time.Time
+}
+
+// PushQueueMetrics 离线推送队列的统计，同一个SessionManager下的所有队列共用
+type PushQueueMetrics struct {
+	queued    int64
+	delivered int64
+	expired   int64
+	overflow  int64
+}
+
+// Queued 放入离线队列的消息数
+func (m *PushQueueMetrics) Queued() int64 {
+	return atomic.LoadInt64(&m.queued)
+}
+
+// Delivered 重连之后补发的消息数
+func (m *PushQueueMetrics) Delivered() int64 {
+	return atomic.LoadInt64(&m.delivered)
+}
+
+// Expired 超过TTL被丢弃的消息数
+func (m *PushQueueMetrics) Expired() int64 {
+	return atomic.LoadInt64(&m.expired)
+}
+
+// Overflow 队列溢出被丢弃的消息数
+func (m *PushQueueMetrics) Overflow() int64 {
+	return atomic.LoadInt64(&m.overflow)
+}
+
+// Dropped 所有被丢弃的消息数
+func (m *PushQueueMetrics) Dropped() int64 {
+	return m.Expired() + m.Overflow()
+}
+
+// PushQueue 推送通道不可用时缓存推送消息的有界队列，每条消息有独立的TTL，
+// 不是并发安全的，由所属的session加锁访问
+type PushQueue struct {
+	Size     int
+	TTL      time.Duration
+	Overflow PushOverflowPolicy
+
+	messages []PushMessage
+	dropped  int64
+	metrics  *PushQueueMetrics
+}
+
+// NewPushQueue 创建离线推送队列，metrics可以为nil
+func NewPushQueue(size int, ttl time.Duration, overflow PushOverflowPolicy, metrics *PushQueueMetrics) *PushQueue {
+	return &PushQueue{Size: size, TTL: ttl, Overflow: overflow, metrics: metrics}
+}
+
+// Offer 放入一条消息，队列满并且策略为Disconnect时清空队列并返回false
+func (q *PushQueue) Offer(command string, bytes []byte, now time.Time) bool {
+	q.expire(now)
+
+	if len(q.messages) >= q.Size {
+		if q.Overflow == Disconnect {
+			n := len(q.messages) + 1
+			q.dropped += int64(n)
+			if q.metrics != nil {
+				atomic.AddInt64(&q.metrics.overflow, int64(n))
+			}
+			q.messages = nil
+			return false
+		}
+		n := len(q.messages) - q.Size + 1
+		q.dropped += int64(n)
+		if q.metrics != nil {
+			atomic.AddInt64(&q.metrics.overflow, int64(n))
+		}
+		q.messages = q.messages[n:]
+	}
+
+	q.messages = append(q.messages, PushMessage{Command: command, Bytes: bytes, Expire: now.Add(q.TTL)})
+	if q.metrics != nil {
+		atomic.AddInt64(&q.metrics.queued, 1)
+	}
+	return true
+}
+
+// Drain 按放入的顺序取出所有没有过期的消息
+func (q *PushQueue) Drain(now time.Time) []PushMessage {
+	q.expire(now)
+
+	messages := q.messages
+	q.messages = nil
+	if q.metrics != nil {
+		atomic.AddInt64(&q.metrics.delivered, int64(len(messages)))
+	}
+	return messages
+}
+
+// Len 队列中的消息数
+func (q *PushQueue) Len() int {
+	return len(q.messages)
+}
+
+// Dropped 当前队列被丢弃的消息数
+func (q *PushQueue) Dropped() int64 {
+	return q.dropped
+}
+
+// expire 丢弃队首已经过期的消息，TTL相同所以过期的消息都在队首
+func (q *PushQueue) expire(now time.Time) {
+	n := 0
+	for n < len(q.messages) && now.After(q.messages[n].Expire) {
+		n++
+	}
+	if n > 0 {
+		q.dropped += int64(n)
+		if q.metrics != nil {
+			atomic.AddInt64(&q.metrics.expired, int64(n))
+		}
+		q.messages = q.messages[n:]
+	}
+}
+
+// pushConfigKeys 离线推送队列使用的配置项
+var pushConfigKeys = []ConfigKey{
+	{Key: "pushQueueSize", Type: ConfigTypeInt, Default: defaultPushQueueSize, Min: 0, Description: "offline push messages kept per session, 0 disables the queue"},
+	{Key: "pushQueueTTL", Type: ConfigTypeDuration, Default: defaultPushQueueTTL, Min: time.Duration(0), Description: "how long an offline push message is kept"},
+	{Key: "pushQueueOverflow", Type: ConfigTypeString, Default: "dropOldest", Enum: []string{"dropOldest", "disconnect"}, Description: "what to do when the offline push queue is full"},
+}
+
+// newPushQueueFromConfig 按配置创建离线推送队列，pushQueueSize不大于0时不缓存
+func newPushQueueFromConfig(config ServletConfig, metrics *PushQueueMetrics) *PushQueue {
+	size := config.GetInt("pushQueueSize", defaultPushQueueSize)
+	if size <= 0 {
+		return nil
+	}
+
+	ttl := config.GetDuration("pushQueueTTL", defaultPushQueueTTL)
+	overflow := DropOldest
+	if config.GetString("pushQueueOverflow", "") == "disconnect" {
+		overflow = Disconnect
+	}
+	return NewPushQueue(size, ttl, overflow, metrics)
+}
@@ -0,0 +1,140 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeTcpMessage(t *testing.T, data []byte) RequestMessage {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 {
+		t.Fatalf("bad frame length: %v", data)
+	}
+	var message RequestMessage
+	message.Command = strings.Trim(string(data[4:4+commandLength]), "\x00")
+	message.RequestId, message.Flags = DecodeRequestId(binary.BigEndian.Uint32(data[4+commandLength:]))
+	message.Content = data[4+commandLength+4:]
+	return message
+}
+
+func TestPushService(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(newSessionConfig())
+	context.Set(SessionManagerKey, manager)
+	service := NewPushService(manager)
+
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+
+	request := NewTcpquest(conn, context, RequestMessage{Command: "login", RequestId: 1})
+	session := *request.GetSession(true)
+	if err := service.PushTo(session.Id(), "chat", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	message := decodeTcpMessage(t, conn.last())
+	if message.Command != "chat" || message.RequestId != 0 || !bytes.Equal(message.Content, []byte("hello")) {
+		t.Fatalf("unexpected push message %+v", message)
+	}
+
+	(*session.GetPush()).Heartbeat()
+	if message = decodeTcpMessage(t, conn.last()); message.Command != PingCommand || len(message.Content) != 0 {
+		t.Fatalf("unexpected heartbeat %+v", message)
+	}
+
+	if err := service.PushTo("unknown", "chat", nil); err != internalErrors.SessionNotFound {
+		t.Fatalf("expected SessionNotFound, got %v", err)
+	}
+
+	pipeline.closed = true
+	manager.config.(*XmlServletConfig).config["pushQueueSize"] = 0
+	if err := service.PushTo(session.Id(), "chat", nil); err != internalErrors.NotPushable {
+		t.Fatalf("expected NotPushable after close without offline queue, got %v", err)
+	}
+}
+
+func TestDiscardSessionClosesPush(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(newSessionConfig())
+	context.Set(SessionManagerKey, manager)
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+
+	request := NewTcpquest(conn, context, RequestMessage{Command: "login"})
+	session := *request.GetSession(true)
+	if _, err := request.GetNewSession(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.closed {
+		t.Fatal("GetNewSession should keep the current connection")
+	}
+
+	renewed := *request.GetSession(false)
+	if renewed.Id() == session.Id() || !renewed.IsActive() {
+		t.Fatal("new session should be bound to the connection")
+	}
+	manager.Remove(renewed.Id())
+	if !conn.closed || renewed.IsActive() {
+		t.Fatal("discarding the session should close its push channel")
+	}
+}
+
+func TestOfflinePushReplay(t *testing.T) {
+	context := NewServletContext()
+	config := newSessionConfig()
+	config.config["pushQueueSize"] = 2
+	manager := NewSessionManager(config)
+	context.Set(SessionManagerKey, manager)
+	service := NewPushService(manager)
+
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	session := *NewTcpquest(conn, context, RequestMessage{Command: "login"}).GetSession(true)
+
+	pipeline.closed = true
+	for _, command := range []string{"a", "b", "c"} {
+		if err := service.PushTo(session.Id(), command, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue := session.(*DefaultSession).PushQueue()
+	if queue.Len() != 2 || queue.Dropped() != 1 || manager.PushMetrics().Overflow() != 1 {
+		t.Fatalf("expected drop-oldest overflow, len %d dropped %d", queue.Len(), queue.Dropped())
+	}
+
+	reconnect := &recordConn{}
+	reconnect.SetContext(NewConnPipeline(reconnect))
+	NewTcpquest(reconnect, context, RequestMessage{Command: "resume", SessionId: session.Id()}).GetSession(false)
+	if len(reconnect.writes) != 2 {
+		t.Fatalf("expected 2 replayed pushes, got %d", len(reconnect.writes))
+	}
+	for i, command := range []string{"b", "c"} {
+		if message := decodeTcpMessage(t, reconnect.writes[i]); message.Command != command {
+			t.Fatalf("replay out of order: %d %s", i, message.Command)
+		}
+	}
+	if queue.Len() != 0 || manager.PushMetrics().Delivered() != 2 {
+		t.Fatal("queue should be drained after replay")
+	}
+}
+
+func TestPushQueueExpireAndDisconnect(t *testing.T) {
+	now := time.Now()
+	queue := NewPushQueue(2, time.Second, Disconnect, nil)
+	queue.Offer("a", nil, now)
+	queue.Offer("b", nil, now.Add(500*time.Millisecond))
+	if messages := queue.Drain(now.Add(1200 * time.Millisecond)); len(messages) != 1 || messages[0].Command != "b" {
+		t.Fatalf("expected only b to survive, got %v", messages)
+	}
+
+	queue.Offer("c", nil, now)
+	queue.Offer("d", nil, now)
+	if queue.Offer("e", nil, now) || queue.Len() != 0 || queue.Dropped() != 4 {
+		t.Fatalf("expected disconnect overflow to clear queue, dropped %d", queue.Dropped())
+	}
+}
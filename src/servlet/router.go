@@ -0,0 +1,384 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RouteMeta 路由的元数据
+type RouteMeta struct {
+	// Description 命令说明
+	Description string
+	// AuthRequired 需要已经存在的session，没有时返回ErrorCodeUnauthorized
+	AuthRequired bool
+	// RateLimit 每秒允许的请求数，超过时返回ErrorCodeTooManyRequests，0表示不限制
+	RateLimit int
+	// Version 路由所属的版本，由Router.Version创建的分组自动设置
+	Version string
+}
+
+// Route 一条路由，Command为完整的命令，可以使用与topic相同的通配符：
+// *匹配一段，**放在最后匹配剩余的一段或多段
+type Route struct {
+	Command string
+	Handler func(Request, Response)
+	Meta    RouteMeta
+
+	// handle 实际执行的handler，typed handler的错误通过它返回
+	handle   func(Request, Response) error
+	group    *RouteGroup
+	pattern  *topicPattern
+	limiter  *RateLimiter
+	fallback bool
+}
+
+// RouteInfo 列出路由时返回的信息
+type RouteInfo struct {
+	Command  string
+	Meta     RouteMeta
+	Fallback bool
+}
+
+// RouteGroup 命令前缀相同的一组路由，分组上的过滤器对组内以及子分组的所有路由生效
+type RouteGroup struct {
+	router   *Router
+	parent   *RouteGroup
+	prefix   string
+	version  string
+	filters  []Filter
+	fallback *Route
+}
+
+// Router 命令路由，按精确匹配、通配符、去掉版本后重新匹配、分组的fallback的顺序查找，
+// 通配符路由中固定的段越多越优先
+type Router struct {
+	RouteGroup
+	mutex    sync.RWMutex
+	exact    map[string]*Route
+	patterns []*Route
+	groups   []*RouteGroup
+	versions map[string]bool
+	// rateLimit 计算路由实际使用的限流，declared为RouteMeta.RateLimit
+	rateLimit func(command string, declared int) int
+	// errorHandler typed路由的Handler被直接调用时写出错误响应
+	errorHandler ErrorHandler
+}
+
+// NewRouter 创建Router
+func NewRouter() *Router {
+	router := &Router{exact: make(map[string]*Route), versions: make(map[string]bool)}
+	router.RouteGroup.router = router
+	return router
+}
+
+// Group 创建子分组，prefix直接拼接在当前前缀之后，例如Group("player.")
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	return &RouteGroup{router: g.router, parent: g, prefix: g.prefix + prefix, version: g.version}
+}
+
+// Prefix 分组的完整前缀
+func (g *RouteGroup) Prefix() string {
+	return g.prefix
+}
+
+// Use 给分组增加过滤器，在DispatchServlet的过滤器之后执行
+func (g *RouteGroup) Use(filters ...Filter) {
+	g.router.mutex.Lock()
+	defer g.router.mutex.Unlock()
+
+	g.filters = append(g.filters, filters...)
+}
+
+// Handle 增加路由，command会加上分组的前缀，meta最多使用一个
+func (g *RouteGroup) Handle(command string, handler func(Request, Response), meta ...RouteMeta) (*Route, error) {
+	return g.addRoute(command, handler, handleFunc(handler), meta)
+}
+
+// addRoute 创建完整的路由之后再发布，路由被Match返回之后不再修改
+func (g *RouteGroup) addRoute(command string, handler func(Request, Response), handle func(Request, Response) error, meta []RouteMeta) (*Route, error) {
+	full := g.prefix + command
+	segments, wildcard, err := parseTopic(full)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &Route{Command: full, Handler: handler, handle: handle, group: g}
+	if len(meta) > 0 {
+		route.Meta = meta[0]
+	}
+	route.Meta.Version = g.version
+	route.limiter = NewRateLimiter(route.Meta.RateLimit)
+	if wildcard {
+		route.pattern = &topicPattern{segments: segments}
+	}
+	return route, g.router.add(route)
+}
+
+// Fallback 设置分组的fallback，分组前缀下没有匹配的路由时使用
+func (g *RouteGroup) Fallback(handler func(Request, Response)) {
+	g.router.mutex.Lock()
+	defer g.router.mutex.Unlock()
+
+	if g.fallback == nil {
+		g.router.groups = append(g.router.groups, g)
+		// 前缀越长越优先
+		sort.SliceStable(g.router.groups, func(i, j int) bool {
+			return len(g.router.groups[i].prefix) > len(g.router.groups[j].prefix)
+		})
+	}
+	g.fallback = &Route{Command: g.prefix + topicMultiWildcard, Handler: handler, handle: handleFunc(handler), group: g, limiter: NewRateLimiter(0), fallback: true}
+	g.fallback.Meta.Version = g.version
+}
+
+// Version 创建版本分组，版本作为命令的第一段，例如v2.player.login，
+// 版本中没有的命令会使用去掉版本之后的路由
+func (r *Router) Version(version string) *RouteGroup {
+	r.mutex.Lock()
+	r.versions[version] = true
+	r.mutex.Unlock()
+
+	group := r.Group(version + topicSeparator)
+	group.version = version
+	return group
+}
+
+// SetErrorHandler 设置typed路由的Handler被直接调用时使用的错误处理，DispatchServlet会同步设置
+func (r *Router) SetErrorHandler(handler ErrorHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.errorHandler = handler
+}
+
+// ErrorHandler typed路由的Handler使用的错误处理，没有设置时为DefaultErrorHandler
+func (r *Router) ErrorHandler() ErrorHandler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.errorHandler == nil {
+		return DefaultErrorHandler
+	}
+	return r.errorHandler
+}
+
+// ApplyRateLimits 使用rateLimit重新计算所有路由的限流，之后增加的路由也会使用它，
+// 返回值不大于0时不限流
+func (r *Router) ApplyRateLimits(rateLimit func(command string, declared int) int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rateLimit = rateLimit
+	for _, route := range r.exact {
+		r.applyRateLimit(route)
+	}
+	for _, route := range r.patterns {
+		r.applyRateLimit(route)
+	}
+}
+
+func (r *Router) applyRateLimit(route *Route) {
+	if r.rateLimit != nil {
+		route.limiter.SetRate(r.rateLimit(route.Command, route.Meta.RateLimit))
+	}
+}
+
+func (r *Router) add(route *Route) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.applyRateLimit(route)
+
+	if route.pattern == nil {
+		if _, ok := r.exact[route.Command]; ok {
+			return internalErrors.HandleAlreadyExists
+		}
+		r.exact[route.Command] = route
+		return nil
+	}
+
+	for _, exists := range r.patterns {
+		if exists.Command == route.Command {
+			return internalErrors.HandleAlreadyExists
+		}
+	}
+	r.patterns = append(r.patterns, route)
+	sort.SliceStable(r.patterns, func(i, j int) bool {
+		return r.patterns[i].pattern.specificity() > r.patterns[j].pattern.specificity()
+	})
+	return nil
+}
+
+// Match 查找命令对应的路由，没有时返回nil
+func (r *Router) Match(command string) *Route {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if route := r.match(command); route != nil {
+		return route
+	}
+	if i := strings.Index(command, topicSeparator); i > 0 && r.versions[command[:i]] {
+		if route := r.match(command[i+1:]); route != nil {
+			return route
+		}
+	}
+	for _, group := range r.groups {
+		if strings.HasPrefix(command, group.prefix) {
+			return group.fallback
+		}
+	}
+	return nil
+}
+
+func (r *Router) match(command string) *Route {
+	if route, ok := r.exact[command]; ok {
+		return route
+	}
+	if len(r.patterns) == 0 {
+		return nil
+	}
+
+	segments := strings.Split(command, topicSeparator)
+	for _, route := range r.patterns {
+		if route.pattern.match(segments) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Routes 按命令排序列出所有路由，包括分组的fallback
+func (r *Router) Routes() []RouteInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	routes := make([]RouteInfo, 0, len(r.exact)+len(r.patterns)+len(r.groups))
+	for _, route := range r.exact {
+		routes = append(routes, route.info())
+	}
+	for _, route := range r.patterns {
+		routes = append(routes, route.info())
+	}
+	for _, group := range r.groups {
+		routes = append(routes, group.fallback.info())
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Command < routes[j].Command
+	})
+	return routes
+}
+
+func handleFunc(handler func(Request, Response)) func(Request, Response) error {
+	return func(request Request, response Response) error {
+		handler(request, response)
+		return nil
+	}
+}
+
+func (route *Route) info() RouteInfo {
+	return RouteInfo{Command: route.Command, Meta: route.Meta, Fallback: route.fallback}
+}
+
+// filters 路由所在分组以及上级分组的过滤器，上级分组的先执行，最后检查路由的元数据
+func (route *Route) filters() []Filter {
+	route.group.router.mutex.RLock()
+	var filters []Filter
+	for group := route.group; group != nil; group = group.parent {
+		filters = append(append([]Filter{}, group.filters...), filters...)
+	}
+	route.group.router.mutex.RUnlock()
+
+	if route.limiter.Rate() > 0 || route.Meta.AuthRequired {
+		filters = append(filters, FilterFunc(route.checkMeta))
+	}
+	return filters
+}
+
+func (route *Route) checkMeta(request Request, response Response, chain FilterChain) error {
+	if !route.limiter.Allow() {
+		return NewServletError(ErrorCodeTooManyRequests, "too many requests")
+	}
+	if route.Meta.AuthRequired && request.GetSession(false) == nil {
+		return NewServletError(ErrorCodeUnauthorized, "login required")
+	}
+	return chain.DoFilter(request, response)
+}
+
+// specificity 固定的段越多越优先，*比**优先
+func (t *topicPattern) specificity() int {
+	score := 0
+	for _, segment := range t.segments {
+		switch segment {
+		case topicMultiWildcard:
+		case topicWildcard:
+			score++
+		default:
+			score += len(t.segments) + 1
+		}
+	}
+	return score
+}
+
+// RateLimiter 令牌桶限流，每秒补充rate个令牌，最多累积rate个
+type RateLimiter struct {
+	mutex  sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter 创建每秒允许rate个请求的限流器
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate 修改每秒允许的请求数，不大于0时不限制
+func (l *RateLimiter) SetRate(rate int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 && rate > 0 {
+		// 从不限制变成限制时令牌桶是满的
+		l.tokens, l.last = float64(rate), time.Now()
+	}
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// Rate 每秒允许的请求数
+func (l *RateLimiter) Rate() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rate
+}
+
+// Allow 是否允许一个请求通过
+func (l *RateLimiter) Allow() bool {
+	return l.allowAt(time.Now())
+}
+
+func (l *RateLimiter) allowAt(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,95 @@
+package servlet
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouterMatch(t *testing.T) {
+	router := NewRouter()
+	handled := ""
+	handler := func(name string) func(Request, Response) {
+		return func(Request, Response) { handled = name }
+	}
+
+	player := router.Group("player.")
+	player.Handle("login", handler("login"), RouteMeta{Description: "登录"})
+	player.Handle("*", handler("player.*"))
+	player.Fallback(handler("player fallback"))
+	router.Handle("guild.**", handler("guild.**"))
+	router.Version("v2").Handle("player.login", handler("v2 login"))
+	if _, err := player.Handle("login", handler("dup")); err == nil {
+		t.Fatal("duplicate route should be rejected")
+	}
+
+	for command, expected := range map[string]string{
+		"player.login":     "login",
+		"player.info":      "player.*",
+		"player.bag.items": "player fallback",
+		"guild.1.join":     "guild.**",
+		"v2.player.login":  "v2 login",
+		"v2.player.info":   "player.*",
+		"shop.buy":         "",
+	} {
+		handled = ""
+		route := router.Match(command)
+		if route != nil {
+			route.Handler(nil, nil)
+		}
+		if handled != expected {
+			t.Fatalf("%s: expected %q, got %q", command, expected, handled)
+		}
+	}
+
+	var commands []string
+	for _, route := range router.Routes() {
+		commands = append(commands, route.Command)
+	}
+	if got := strings.Join(commands, ","); got != "guild.**,player.*,player.**,player.login,v2.player.login" {
+		t.Fatalf("unexpected routes %s", got)
+	}
+}
+
+func TestRouterGroupFiltersAndMeta(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+
+	var trace []string
+	guild := servlet.Router().Group("guild.")
+	guild.Use(FilterFunc(func(request Request, response Response, chain FilterChain) error {
+		trace = append(trace, "guild filter")
+		return chain.DoFilter(request, response)
+	}))
+	guild.Handle("join", func(Request, Response) { trace = append(trace, "join") }, RouteMeta{RateLimit: 1})
+	servlet.Router().Handle("bag", func(Request, Response) {}, RouteMeta{AuthRequired: true})
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	if err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "guild.join"}), NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(trace, ",") != "guild filter,join" {
+		t.Fatalf("unexpected trace %v", trace)
+	}
+	err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "guild.join"}), NewTcpResponse(conn))
+	if AsServletError(err).Code != ErrorCodeTooManyRequests {
+		t.Fatalf("expected rate limit, got %v", err)
+	}
+	err = servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "bag"}), NewTcpResponse(conn))
+	if AsServletError(err).Code != ErrorCodeUnauthorized {
+		t.Fatalf("expected auth required, got %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(2)
+	limiter.last = now
+	if !limiter.allowAt(now) || !limiter.allowAt(now) || limiter.allowAt(now) {
+		t.Fatal("expected burst of 2")
+	}
+	if !limiter.allowAt(now.Add(500 * time.Millisecond)) {
+		t.Fatal("tokens should refill over time")
+	}
+}
@@ -2,21 +2,28 @@ package servlet
 
 import (
 	internalErrors "LearnGo/src/errors"
-	"encoding/xml"
-	"errors"
+	"crypto/x509"
 	"fmt"
-	"github.com/panjf2000/gnet"
-	"io/ioutil"
-	"strconv"
-	"strings"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// ActionCompress 是否启用压缩了
 	ActionCompress string = "compress"
+	// RateLimitKeyPrefix 路由限流的配置前缀，例如rateLimit.player.login
+	RateLimitKeyPrefix = "rateLimit."
 )
 
+// servletConfigKeys DispatchServlet使用的配置项
+var servletConfigKeys = []ConfigKey{
+	{Key: ActionCompress, Type: ConfigTypeBool, Default: false, Description: "compress responses"},
+	{Key: CodecKey, Type: ConfigTypeString, Default: "json", Description: "codec of typed handlers, json, gob, binary or a registered codec"},
+	{Key: RateLimitKeyPrefix + "*", Type: ConfigTypeInt, Min: 0, Description: "requests per second of a command, overrides RouteMeta.RateLimit"},
+}
+
 type ServerProtocol int
 
 const (
@@ -29,6 +36,15 @@ const (
 // ServletConfig Servlet配置接口
 type ServletConfig interface {
 	Get(key string) interface{}
+	GetString(key string, defaultValue string) string
+	GetInt(key string, defaultValue int) int
+	GetInt64(key string, defaultValue int64) int64
+	GetFloat(key string, defaultValue float64) float64
+	GetBool(key string, defaultValue bool) bool
+	GetDuration(key string, defaultValue time.Duration) time.Duration
+	GetSize(key string, defaultValue int64) int64
+	GetStringList(key string, defaultValue []string) []string
+	GetStringMap(key string, defaultValue map[string]string) map[string]string
 	GetSessionTickTime() int
 	GetSessionTimeoutMillis() int
 	GetSessionEmptyTimeoutMillis() int
@@ -41,6 +57,12 @@ type ServletContext interface {
 	Get(key string, defaultValue interface{}) interface{}
 	Set(key string, value interface{})
 	Delete(key string)
+	GetString(key string, defaultValue string) string
+	GetInt(key string, defaultValue int) int
+	GetInt64(key string, defaultValue int64) int64
+	GetFloat64(key string, defaultValue float64) float64
+	GetBool(key string, defaultValue bool) bool
+	GetDuration(key string, defaultValue time.Duration) time.Duration
 }
 
 // Request 请求Request接口
@@ -57,6 +79,8 @@ type Request interface {
 	Protocol() ServerProtocol
 	GetSession(allowCreate bool) *Session
 	GetNewSession() (*Session, error)
+	// PeerCertificate 使用TLS并且客户端提供了证书时为客户端的证书，否则为nil
+	PeerCertificate() *x509.Certificate
 }
 
 // Response 请求Response接口
@@ -107,173 +131,168 @@ type Servlet interface {
 
 	// AddHandler 增加handler
 	AddHandler(command string, handler func(Request, Response)) error
+
+	// AddTypedHandler 增加typed handler，签名为func(ctx Request, in *T) (*R, error)，使用配置的codec编解码
+	AddTypedHandler(command string, handler interface{}) error
+
+	// Router 命令路由，可以创建分组、设置fallback和元数据
+	Router() *Router
+
+	// AddFilter 增加过滤器，按增加的顺序执行，patterns使用与Router相同的通配符，为空时匹配所有命令
+	AddFilter(filter Filter, patterns ...string)
+
+	// SetErrorHandler 设置错误响应的处理方式
+	SetErrorHandler(handler ErrorHandler)
+
+	// Destroy 服务停止时释放资源，之后不会再调用Service
+	Destroy()
 }
 
 type DispatchServlet struct {
-	config    ServletConfig
-	context   ServletContext
-	handleMap map[string]func(Request, Response)
-	compress  bool
+	config       ServletConfig
+	context      ServletContext
+	router       *Router
+	filters      []*filterMapping
+	errorHandler ErrorHandler
+	codec        Codec
+	// compressOptions *CompressOptions，encryptOptions *EncryptOptions，配置热加载时在其它goroutine中替换
+	compressOptions atomic.Value
+	encryptOptions  atomic.Value
 }
 
 func (servlet *DispatchServlet) Init(config ServletConfig, context ServletContext) {
 	servlet.config = config
 	servlet.context = context
-	servlet.handleMap = make(map[string]func(Request, Response))
+	servlet.router = NewRouter()
+	servlet.errorHandler = DefaultErrorHandler
+	servlet.router.SetErrorHandler(servlet.errorHandler)
 
 	servlet.initCompress()
-}
-
-func (servlet *DispatchServlet) AddHandler(command string, handler func(Request, Response)) (err error) {
-	_, ok := servlet.handleMap[command]
-	if ok {
-		return internalErrors.HandleAlreadyExists
+	servlet.initEncrypt()
+	servlet.initCodec()
+	servlet.router.ApplyRateLimits(servlet.rateLimit)
+	servlet.router.Handle(HandshakeCommand, servlet.handshake, RouteMeta{Description: "negotiate compression and encryption of the connection"})
+	if watcher, ok := config.(ConfigWatcher); ok {
+		watcher.OnConfigChange(servlet.configChanged)
 	}
+}
 
-	servlet.handleMap[command] = handler
-	return nil
+// Destroy DispatchServlet本身没有需要释放的资源，嵌入DispatchServlet的servlet可以覆盖它
+func (servlet *DispatchServlet) Destroy() {
 }
 
-func (servlet *DispatchServlet) Service(request Request, response Response) (err error) {
-	command := request.Command()
-	handler, ok := servlet.handleMap[command]
-	if ok {
-		handler(request, response)
-		return nil
+// configChanged 配置热加载之后更新压缩参数和路由的限流
+func (servlet *DispatchServlet) configChanged(keys []string) {
+	// compress前缀同时包括compressAlgorithms、compressThreshold和compressLevel
+	if configPrefixChanged(keys, ActionCompress) || configKeyChanged(keys, MaxDecompressedSizeKey) {
+		servlet.initCompress()
+	}
+	// encrypt前缀同时包括encryptRequired
+	if configPrefixChanged(keys, EncryptKey) {
+		servlet.initEncrypt()
 	}
+	if configPrefixChanged(keys, RateLimitKeyPrefix) {
+		servlet.router.ApplyRateLimits(servlet.rateLimit)
+	}
+}
 
-	return errors.New(fmt.Sprintf("%s does not hava handler", command))
+// rateLimit 路由的限流，配置中的rateLimit.<命令>覆盖RouteMeta.RateLimit
+func (servlet *DispatchServlet) rateLimit(command string, declared int) int {
+	return servlet.config.GetInt(RateLimitKeyPrefix+command, declared)
 }
 
-func (servlet *DispatchServlet) initCompress() {
-	value := servlet.config.Get(ActionCompress)
-	if value != "" {
-		servlet.compress = "true" == value
-	}
+func (servlet *DispatchServlet) AddHandler(command string, handler func(Request, Response)) (err error) {
+	_, err = servlet.router.Handle(command, handler)
+	return err
 }
 
-// XmlServletConfig xml类型配置文件
-type XmlServletConfig struct {
-	config map[string]interface{}
+func (servlet *DispatchServlet) AddTypedHandler(command string, handler interface{}) error {
+	_, err := servlet.router.HandleTyped(command, handler, servlet.codec)
+	return err
 }
 
-// NewXmlServletConfig 创建新的xml配置文件
-func NewXmlServletConfig(path string) *XmlServletConfig {
-	config := XmlServletConfig{}
-	config.config = make(map[string]interface{})
-	config.parse(path)
+// Codec typed handler使用的编码方式
+func (servlet *DispatchServlet) Codec() Codec {
+	return servlet.codec
+}
 
-	return &config
+func (servlet *DispatchServlet) Router() *Router {
+	return servlet.router
 }
 
-func (servlet *XmlServletConfig) parse(path string) error {
-	content, err := ioutil.ReadFile(path)
-	if err != nil {
-		return err
-	}
+func (servlet *DispatchServlet) AddFilter(filter Filter, patterns ...string) {
+	servlet.filters = addFilterMapping(servlet.filters, filter, patterns)
+}
 
-	type Property struct {
-		XMLName xml.Name `xml:"property"`
-		Name    string   `xml:"name,attr"`
-		Type    string   `xml:"type,attr"`
-		Value   string   `xml:",chardata"`
-	}
-	type InitParam struct {
-		Props []Property `xml:"props>property"`
-	}
+func (servlet *DispatchServlet) SetErrorHandler(handler ErrorHandler) {
+	servlet.errorHandler = handler
+	servlet.router.SetErrorHandler(handler)
+}
 
-	type Params struct {
-		XMLName   xml.Name  `xml:"servlet"`
-		InitParam InitParam `xml:"init-param"`
-	}
+// Service 执行过滤器和handler，handler的panic会被恢复，
+// 所有错误都通过errorHandler写成错误响应之后再返回，已经写出过响应时只记录日志
+func (servlet *DispatchServlet) Service(request Request, response Response) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("handle %s panic: %v\n%s", request.Command(), r, debug.Stack())
+			err = &ServletError{Code: ErrorCodeInternal, Message: "internal error", Err: fmt.Errorf("panic: %v", r)}
+		}
+		if err != nil {
+			handleError(servlet.errorHandler, request, response, err)
+		}
+	}()
 
-	params := Params{}
-	err = xml.Unmarshal(content, &params)
-	if err != nil {
+	if err := servlet.openRequest(request); err != nil {
 		return err
 	}
 
-	for _, p := range params.InitParam.Props {
-		switch p.Type {
-		case "bool":
-			v, err := strconv.ParseBool(p.Value)
-			if err == nil {
-				servlet.config[p.Name] = v
-			}
-		case "string":
-			servlet.config[p.Name] = p.Value
-		case "int":
-			v, err := strconv.Atoi(p.Value)
-			if err == nil {
-				servlet.config[p.Name] = v
-			}
-		}
+	command := request.Command()
+	route := servlet.router.Match(command)
+	if route == nil {
+		return NewServletError(ErrorCodeUnknownCommand, fmt.Sprintf("%s does not hava handler", command))
 	}
 
-	return nil
-}
-
-func (servlet *XmlServletConfig) Get(key string) interface{} {
-	v, ok := servlet.config[key]
-	if ok {
-		return v
-	}
-	return nil
-}
-func (servlet *XmlServletConfig) GetSessionTickTime() int {
-	v := servlet.Get("sessionTickTime")
-	if v != nil {
-		return v.(int)
-	}
-	return 20000
-}
-func (servlet *XmlServletConfig) GetSessionTimeoutMillis() int {
-	v := servlet.Get("sessionTimeoutTime")
-	if v != nil {
-		return v.(int)
+	routeFilters := route.filters()
+	if len(servlet.filters) == 0 && len(routeFilters) == 0 {
+		return route.handle(request, response)
 	}
-	return 180000
+	return newFilterChain(servlet.filters, command, routeFilters, route.handle).DoFilter(request, response)
 }
-func (servlet *XmlServletConfig) GetSessionEmptyTimeoutMillis() int {
-	v := servlet.Get("sessionEmptyTimeoutTime")
-	if v != nil {
-		return v.(int)
+
+func (servlet *DispatchServlet) initCodec() {
+	servlet.codec = JsonCodec{}
+	name := servlet.config.GetString(CodecKey, "")
+	if name == "" {
+		return
 	}
-	return 40000
-}
-func (servlet *XmlServletConfig) GetSessionInvalidateMillis() int {
-	v := servlet.Get("sessionInvalidateMillis")
-	if v != nil {
-		return v.(int)
+	if codec := CodecByName(name); codec != nil {
+		servlet.codec = codec
+	} else {
+		log.Println("unknown codec", name)
 	}
-	return 86400000
 }
-func (servlet *XmlServletConfig) GetSessionNextDayInvalidateMillis() int {
-	v := servlet.Get("sessionNextDayInvalidateMillis")
-	if v != nil {
-		return v.(int)
-	}
-	return 1800000
+
+func (servlet *DispatchServlet) initCompress() {
+	servlet.compressOptions.Store(NewCompressOptions(servlet.config))
 }
 
-type DefaultServletContext struct {
-	contextMap map[string]interface{}
+// Compress 是否启用了压缩
+func (servlet *DispatchServlet) Compress() bool {
+	return servlet.CompressOptions().Enabled
 }
 
-func (d *DefaultServletContext) Get(key string, defaultValue interface{}) interface{} {
-	value, ok := d.contextMap[key]
-	if ok {
-		return value
-	}
-	return defaultValue
+// CompressOptions 当前的压缩参数
+func (servlet *DispatchServlet) CompressOptions() *CompressOptions {
+	return servlet.compressOptions.Load().(*CompressOptions)
 }
 
-func (d *DefaultServletContext) Set(key string, value interface{}) {
-	d.contextMap[key] = value
+func (servlet *DispatchServlet) initEncrypt() {
+	servlet.encryptOptions.Store(NewEncryptOptions(servlet.config))
 }
 
-func (d *DefaultServletContext) Delete(key string) {
-	delete(d.contextMap, key)
+// EncryptOptions 当前的加密参数
+func (servlet *DispatchServlet) EncryptOptions() *EncryptOptions {
+	return servlet.encryptOptions.Load().(*EncryptOptions)
 }
 
 // RequestMessage 请求消息
@@ -282,6 +301,8 @@ type RequestMessage struct {
 	Command string
 	Content []byte
 	SessionId string
+	// Flags 内容的压缩、加密标记，使用连接握手时协商的方式解密、解压
+	Flags MessageFlags
 }
 
 // TcpRequest tcp请求
@@ -291,9 +312,16 @@ type TcpRequest struct {
 	content []byte
 	createTime time.Time
 	sessionId string
+	flags MessageFlags
+	// opened 已经解密、解压过内容，openErr为结果
+	opened bool
+	openErr error
 	parseFlag bool
 	paramMap map[string][]string
-	conn gnet.Conn
+	conn Conn
+	context ServletContext
+	// newPush 创建连接上的推送通道，为nil时不支持推送
+	newPush func(pipeline *ConnPipeline) Push
 }
 
 func (t *TcpRequest) Command() string {
@@ -334,9 +362,64 @@ func (t *TcpRequest) GetHeader(key string) (string, error) {
 	return "", internalErrors.HandleAlreadyExists
 }
 
+// SetSessionId 把session绑定到当前连接，之后同一连接上的请求不需要再携带sessionId
 func (t *TcpRequest) SetSessionId(key string) {
 	t.sessionId = key
-	t.conn.SetContext(key)
+	pipeline, ok := t.conn.Context().(*ConnPipeline)
+	if ok {
+		pipeline.SetAttr(SessionIdAttr, key)
+	} else {
+		t.conn.SetContext(key)
+	}
+
+	if manager := sessionManagerOf(t.context); manager != nil {
+		if session := manager.GetSession(key); session != nil {
+			t.bindPush(session)
+		}
+	}
+}
+
+// connPush 当前连接上的推送通道，第一次使用时创建并保存在pipeline上
+func (t *TcpRequest) connPush() Push {
+	if t.newPush == nil {
+		return nil
+	}
+	pipeline, ok := t.conn.Context().(*ConnPipeline)
+	if !ok {
+		return nil
+	}
+	if push, ok := pipeline.Attr(PushAttr).(Push); ok {
+		return push
+	}
+	push := t.newPush(pipeline)
+	pipeline.SetAttr(PushAttr, push)
+	return push
+}
+
+// bindPush 把当前连接的推送通道设置到session上
+func (t *TcpRequest) bindPush(session Session) {
+	push := t.connPush()
+	if push == nil {
+		return
+	}
+	if current := session.GetPush(); current != nil && *current == push {
+		return
+	}
+	session.SetPush(&push)
+	session.ReActive()
+}
+
+// boundSessionId 请求携带的sessionId，没有时使用连接上绑定的sessionId
+func (t *TcpRequest) boundSessionId() string {
+	if t.sessionId != "" {
+		return t.sessionId
+	}
+	pipeline, ok := t.conn.Context().(*ConnPipeline)
+	if ok {
+		id, _ := pipeline.Attr(SessionIdAttr).(string)
+		return id
+	}
+	return ""
 }
 
 func (t *TcpRequest) Protocol() ServerProtocol {
@@ -344,80 +427,91 @@ func (t *TcpRequest) Protocol() ServerProtocol {
 }
 
 func (t *TcpRequest) GetSession(allowCreate bool) *Session {
-	return nil
+	manager := sessionManagerOf(t.context)
+	if manager == nil {
+		return nil
+	}
+
+	session := manager.GetSession(t.boundSessionId())
+	if session != nil {
+		session.Access()
+		t.bindPush(session)
+		return &session
+	}
+	if !allowCreate {
+		return nil
+	}
+
+	session = manager.CreateSession()
+	t.SetSessionId(session.Id())
+	return &session
 }
 
+// GetNewSession 丢弃当前的session并创建新的session
 func (t *TcpRequest) GetNewSession() (*Session, error) {
-	return nil, internalErrors.NotSupport
+	manager := sessionManagerOf(t.context)
+	if manager == nil {
+		return nil, internalErrors.NotSupport
+	}
+
+	if id := t.boundSessionId(); id != "" {
+		// 先解除当前连接的推送通道，避免丢弃旧session时关闭当前连接
+		if old := manager.GetSession(id); old != nil {
+			if current := old.GetPush(); current != nil && *current == t.connPush() {
+				old.SetPush(nil)
+			}
+		}
+		manager.Remove(id)
+	}
+	session := manager.CreateSession()
+	t.SetSessionId(session.Id())
+	return &session, nil
 }
 
 func (t *TcpRequest) parseParam() {
 	if t.parseFlag {
 		return
 	}
+	t.parseFlag = true
 
-	if t.content == nil {
-		return
-	}
-
-	str := string(t.content)
-	defer func() {
-		if err := recover(); err != nil {
-			// 打印异常，关闭资源，退出此函数
-			fmt.Println(err)
-			// Ignore 忽略
-		}
-	}()
-	t.parseParamInternal(str)
-}
-
-func (t *TcpRequest) parseParamInternal(content string)  {
-	paramMap := make(map[string][]string)
-	strs := strings.Split(content, "&")
-	for _, value := range strs {
-		index := strings.Index(value, "=")
-		if index == -1 {
-			paramMap[value] = nil
-		} else {
-			k := value[:index]
-			v := value[index + 1:]
-			tmpValue, ok := paramMap[k]
-			if ok {
-				if tmpValue == nil || len(tmpValue) == 0 {
-					paramMap[k] = []string {v}
-				} else {
-					tmpValue = append(tmpValue, v)
-					paramMap[k] = tmpValue
-				}
-			} else {
-				paramMap[k] = []string {v}
-			}
-		}
+	paramMap, err := ParseForm(string(t.content))
+	if err != nil {
+		log.Println("parse param failed", t.command, err)
 	}
 	t.paramMap = paramMap
 }
 
-func NewTcpquest(conn gnet.Conn, context ServletContext, message RequestMessage) Request  {
+func NewTcpquest(conn Conn, context ServletContext, message RequestMessage) Request  {
 	var request TcpRequest
 	request.requestId = message.RequestId
 	request.command = message.Command
 	request.content = message.Content
 	request.sessionId = message.SessionId
+	request.flags = message.Flags
 	request.createTime = time.Now()
 	request.conn = conn
+	request.context = context
+	request.newPush = newTcpPush
 
 	return &request
 }
 
 type TcpResponse struct {
-	conn gnet.Conn
+	conn Conn
 	closeFlag bool
+	written bool
 }
 
 func (t *TcpResponse) Write(buff []byte) {
+	t.written = true
 	t.conn.AsyncWrite(buff)
 }
 
+// Written 是否已经写出过响应
+func (t *TcpResponse) Written() bool {
+	return t.written
+}
+
 func (t *TcpResponse) AddHeader(name string, value string) error {
 	return internalErrors.NotSupport
 }
@@ -438,7 +532,7 @@ func (t *TcpResponse) MarkClose() {
 	t.closeFlag = true
 }
 
-func NewTcpResponse(conn gnet.Conn) Response {
+func NewTcpResponse(conn Conn) Response {
 	var response TcpResponse
 
 	response.conn = conn
@@ -0,0 +1,619 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+const (
+	// SessionManagerKey SessionManager保存在ServletContext中的key
+	SessionManagerKey = "servlet.sessionManager"
+	// SessionIdAttr 连接绑定的sessionId保存在ConnPipeline上的属性名
+	SessionIdAttr = "servlet.sessionId"
+)
+
+// DefaultSession Session的默认实现，过期相关的时间配置每次检查时从ServletConfig读取
+type DefaultSession struct {
+	id         string
+	manager    *SessionManager
+	mutex      sync.RWMutex
+	attributes map[string]interface{}
+	createTime time.Time
+	accessTime time.Time
+	push       *Push
+	discard    bool
+	// pushMutex 保证推送和离线消息补发的顺序
+	pushMutex sync.Mutex
+	queue     *PushQueue
+	// dirty 属性有修改，需要完整保存到SessionStore
+	dirty bool
+	// persisted 是否已经保存过，persistTime为上一次持久化时的访问时间
+	persisted   bool
+	persistTime time.Time
+}
+
+func newDefaultSession(id string, manager *SessionManager) *DefaultSession {
+	now := time.Now()
+	return &DefaultSession{
+		id:         id,
+		manager:    manager,
+		attributes: make(map[string]interface{}),
+		createTime: now,
+		accessTime: now,
+	}
+}
+
+func (s *DefaultSession) Id() string {
+	return s.id
+}
+
+func (s *DefaultSession) Get(key string) interface{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.attributes[key]
+}
+
+func (s *DefaultSession) Set(key string, value interface{}) {
+	s.mutex.Lock()
+	old := s.attributes[key]
+	s.attributes[key] = value
+	s.dirty = true
+	s.mutex.Unlock()
+
+	if s.manager != nil {
+		s.manager.fireAttributeChanged(s, key, old, value)
+	}
+}
+
+func (s *DefaultSession) Delete(key string) {
+	s.mutex.Lock()
+	old, ok := s.attributes[key]
+	delete(s.attributes, key)
+	s.dirty = true
+	s.mutex.Unlock()
+
+	if ok && s.manager != nil {
+		s.manager.fireAttributeChanged(s, key, old, nil)
+	}
+}
+
+// Access 刷新最后访问时间
+func (s *DefaultSession) Access() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.accessTime = time.Now()
+}
+
+// IsValid 没有被丢弃，也没有到达强制失效时间
+func (s *DefaultSession) IsValid() bool {
+	s.mutex.RLock()
+	discard := s.discard
+	s.mutex.RUnlock()
+
+	return !discard && !s.IsInvalidate()
+}
+
+// IsExpire 超过sessionTimeoutTime没有访问，空session使用sessionEmptyTimeoutTime
+func (s *DefaultSession) IsExpire() bool {
+	return s.isExpireAt(time.Now())
+}
+
+func (s *DefaultSession) isExpireAt(now time.Time) bool {
+	config := s.manager.config
+	timeout := config.GetSessionTimeoutMillis()
+	if s.IsEmpty() {
+		timeout = config.GetSessionEmptyTimeoutMillis()
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return now.Sub(s.accessTime) > time.Duration(timeout)*time.Millisecond
+}
+
+// IsActive 是否有可用的推送通道
+func (s *DefaultSession) IsActive() bool {
+	push := s.GetPush()
+	return push != nil && *push != nil && (*push).IsPushable()
+}
+
+// IsInvalidate 创建超过sessionInvalidateMillis，
+// 或者已经跨天并且超过第二天零点之后sessionNextDayInvalidateMillis
+func (s *DefaultSession) IsInvalidate() bool {
+	return s.isInvalidateAt(time.Now())
+}
+
+func (s *DefaultSession) isInvalidateAt(now time.Time) bool {
+	config := s.manager.config
+	if now.Sub(s.createTime) > time.Duration(config.GetSessionInvalidateMillis())*time.Millisecond {
+		return true
+	}
+
+	year, month, day := s.createTime.Date()
+	nextDay := time.Date(year, month, day+1, 0, 0, 0, 0, s.createTime.Location())
+	return now.After(nextDay.Add(time.Duration(config.GetSessionNextDayInvalidateMillis()) * time.Millisecond))
+}
+
+// ReActive 客户端重新连上之后恢复session，并按顺序补发离线队列中的消息
+func (s *DefaultSession) ReActive() {
+	s.Access()
+
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+
+	if push := s.pushable(); push != nil {
+		s.replay(push)
+	}
+}
+
+// Push 推送消息，推送通道不可用时放入离线队列，等ReActive时补发；
+// 离线队列溢出并且策略为Disconnect时丢弃session并返回错误
+func (s *DefaultSession) Push(command string, bytes []byte) error {
+	_, err := s.offer(command, bytes)
+	return err
+}
+
+// offer 与Push相同，第一个返回值表示消息放入了离线队列而不是已经推送
+func (s *DefaultSession) offer(command string, bytes []byte) (bool, error) {
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+
+	if push := s.pushable(); push != nil {
+		s.replay(push)
+		push.Push(command, bytes)
+		return false, nil
+	}
+
+	if s.queue == nil {
+		s.queue = newPushQueueFromConfig(s.manager.config, &s.manager.pushMetrics)
+		if s.queue == nil {
+			return false, internalErrors.NotPushable
+		}
+	}
+	if !s.queue.Offer(command, bytes, time.Now()) {
+		s.MarkDiscard()
+		return false, internalErrors.PushQueueOverflow
+	}
+	return true, nil
+}
+
+// PushQueue 离线推送队列，还没有缓存过消息时返回nil
+func (s *DefaultSession) PushQueue() *PushQueue {
+	s.pushMutex.Lock()
+	defer s.pushMutex.Unlock()
+
+	return s.queue
+}
+
+func (s *DefaultSession) pushable() Push {
+	push := s.GetPush()
+	if push == nil || *push == nil || !(*push).IsPushable() {
+		return nil
+	}
+	return *push
+}
+
+func (s *DefaultSession) replay(push Push) {
+	if s.queue == nil {
+		return
+	}
+	for _, message := range s.queue.Drain(time.Now()) {
+		push.Push(message.Command, message.Bytes)
+	}
+}
+
+func (s *DefaultSession) IsEmpty() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.attributes) == 0
+}
+
+// CheckAlive session是否还需要保留
+func (s *DefaultSession) CheckAlive() bool {
+	return s.checkAliveAt(time.Now())
+}
+
+func (s *DefaultSession) checkAliveAt(now time.Time) bool {
+	s.mutex.RLock()
+	discard := s.discard
+	s.mutex.RUnlock()
+
+	return !discard && !s.isInvalidateAt(now) && !s.isExpireAt(now)
+}
+
+func (s *DefaultSession) SetPush(push *Push) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.push = push
+}
+
+func (s *DefaultSession) GetPush() *Push {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.push
+}
+
+// MarkDiscard 标记丢弃，下次清理时移除，第一次标记时同时丢弃推送通道
+func (s *DefaultSession) MarkDiscard() {
+	s.mutex.Lock()
+	discarded := s.discard
+	s.discard = true
+	push := s.push
+	s.mutex.Unlock()
+
+	if !discarded && push != nil && *push != nil {
+		(*push).Discard()
+	}
+}
+
+// SessionManager 管理所有session，按sessionTickTime定时清理失效的session，
+// 设置了SessionStore时同时把修改持久化到存储中
+type SessionManager struct {
+	config   ServletConfig
+	store    SessionStore
+	mutex    sync.RWMutex
+	sessions map[string]*DefaultSession
+	stop     chan struct{}
+	// resetTick sessionTickTime热加载之后让定时清理使用新的间隔
+	resetTick chan struct{}
+	// pushMetrics 所有session离线推送队列的统计
+	pushMetrics PushQueueMetrics
+	// discardListeners session被移除时的回调
+	discardListeners []func(session Session)
+	listeners        []SessionListener
+}
+
+// sessionConfigKeys SessionManager使用的配置项，时间都是毫秒
+var sessionConfigKeys = []ConfigKey{
+	{Key: "sessionTickTime", Type: ConfigTypeInt, Default: 20000, Min: 1, Description: "interval in milliseconds of sweeping expired sessions"},
+	{Key: "sessionTimeoutTime", Type: ConfigTypeInt, Default: 180000, Min: 1, Description: "milliseconds before an idle session expires"},
+	{Key: "sessionEmptyTimeoutTime", Type: ConfigTypeInt, Default: 40000, Min: 1, Description: "milliseconds before an idle session without attributes expires"},
+	{Key: "sessionInvalidateMillis", Type: ConfigTypeInt, Default: 86400000, Min: 1, Description: "maximum lifetime in milliseconds of a session"},
+	{Key: "sessionNextDayInvalidateMillis", Type: ConfigTypeInt, Default: 1800000, Min: 0, Description: "milliseconds after midnight when sessions created the day before expire"},
+}
+
+// NewSessionManager 创建SessionManager，需要调用Start开始定时清理
+func NewSessionManager(config ServletConfig) *SessionManager {
+	manager := &SessionManager{config: config, sessions: make(map[string]*DefaultSession), resetTick: make(chan struct{}, 1)}
+	if watcher, ok := config.(ConfigWatcher); ok {
+		watcher.OnConfigChange(manager.configChanged)
+	}
+	return manager
+}
+
+// configChanged 超时时间每次检查时都会重新读取，只有定时清理的间隔需要重新开始计时
+func (m *SessionManager) configChanged(keys []string) {
+	if configKeyChanged(keys, "sessionTickTime") {
+		select {
+		case m.resetTick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// OnDiscard 增加session被移除时的回调，需要在Start之前调用
+func (m *SessionManager) OnDiscard(listener func(session Session)) {
+	m.discardListeners = append(m.discardListeners, listener)
+}
+
+// AddSessionListener 增加session生命周期的监听器，需要在Start之前调用
+func (m *SessionManager) AddSessionListener(listener SessionListener) {
+	m.listeners = append(m.listeners, listener)
+}
+
+func (m *SessionManager) fireDiscard(session Session) {
+	for _, listener := range m.discardListeners {
+		func() {
+			defer recoverSessionListener(session)
+			listener(session)
+		}()
+	}
+	m.fire(session, func(listener SessionListener) {
+		listener.SessionDestroyed(session)
+	})
+}
+
+func (m *SessionManager) fireAttributeChanged(session Session, key string, oldValue interface{}, newValue interface{}) {
+	m.fire(session, func(listener SessionListener) {
+		listener.SessionAttributeChanged(session, key, oldValue, newValue)
+	})
+}
+
+// fire 依次调用监听器，监听器的panic只打印日志，不影响其它监听器以及session的处理
+func (m *SessionManager) fire(session Session, f func(listener SessionListener)) {
+	for _, listener := range m.listeners {
+		func() {
+			defer recoverSessionListener(session)
+			f(listener)
+		}()
+	}
+}
+
+func recoverSessionListener(session Session) {
+	if r := recover(); r != nil {
+		log.Printf("session listener of %s panic: %v\n%s", session.Id(), r, debug.Stack())
+	}
+}
+
+// SetStore 设置session存储，需要在Start之前调用
+func (m *SessionManager) SetStore(store SessionStore) {
+	m.store = store
+}
+
+// CreateSession 创建新的session
+func (m *SessionManager) CreateSession() Session {
+	session := newDefaultSession(newSessionId(), m)
+
+	m.mutex.Lock()
+	m.sessions[session.id] = session
+	m.mutex.Unlock()
+
+	if m.store != nil {
+		m.persist(session)
+	}
+	m.fire(session, func(listener SessionListener) {
+		listener.SessionCreated(session)
+	})
+	return session
+}
+
+// GetSession 获取有效的session，不在内存中时从SessionStore加载，不存在或者已经失效时返回nil
+func (m *SessionManager) GetSession(id string) Session {
+	if id == "" {
+		return nil
+	}
+
+	m.mutex.RLock()
+	session, ok := m.sessions[id]
+	m.mutex.RUnlock()
+
+	if !ok {
+		session = m.load(id)
+		if session == nil {
+			return nil
+		}
+	}
+	if !session.CheckAlive() {
+		return nil
+	}
+	return session
+}
+
+func (m *SessionManager) load(id string) *DefaultSession {
+	if m.store == nil {
+		return nil
+	}
+	data, err := m.store.Load(id)
+	if err != nil {
+		log.Println("load session failed", id, err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if session, ok := m.sessions[id]; ok {
+		return session
+	}
+	session := restoreSession(data, m)
+	m.sessions[id] = session
+	return session
+}
+
+// persist 有属性修改时完整保存，否则只在访问时间变化时更新访问时间。
+// 保存之前先清除标记，保存期间的修改会在下一轮保存；保存失败时恢复标记，下一轮重试
+func (m *SessionManager) persist(session *DefaultSession) {
+	session.mutex.Lock()
+	persisted := session.persisted
+	dirty := session.dirty || !persisted
+	persistTime := session.persistTime
+	accessTime := session.accessTime
+	touched := !accessTime.Equal(persistTime)
+	session.dirty = false
+	session.persisted = true
+	session.persistTime = accessTime
+	session.mutex.Unlock()
+
+	var err error
+	if dirty {
+		err = m.store.Save(session.snapshot())
+	} else if touched {
+		err = m.store.Touch(session.id, accessTime)
+	}
+	if err == nil {
+		return
+	}
+	log.Println("persist session failed", session.id, err)
+
+	session.mutex.Lock()
+	if dirty {
+		session.dirty = true
+		session.persisted = session.persisted && persisted
+	}
+	if session.persistTime.Equal(accessTime) {
+		session.persistTime = persistTime
+	}
+	session.mutex.Unlock()
+}
+
+// Flush 把所有session的修改写入SessionStore
+func (m *SessionManager) Flush() {
+	if m.store == nil {
+		return
+	}
+
+	m.mutex.RLock()
+	sessions := make([]*DefaultSession, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	m.mutex.RUnlock()
+
+	for _, session := range sessions {
+		m.persist(session)
+	}
+	if flusher, ok := m.store.(SessionStoreFlusher); ok {
+		if err := flusher.Flush(); err != nil {
+			log.Println("flush session store failed", err)
+		}
+	}
+}
+
+// Touch 刷新session的访问时间
+func (m *SessionManager) Touch(id string) bool {
+	session := m.GetSession(id)
+	if session == nil {
+		return false
+	}
+	session.Access()
+	return true
+}
+
+// Remove 立即移除session
+func (m *SessionManager) Remove(id string) {
+	m.mutex.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mutex.Unlock()
+
+	if ok {
+		session.MarkDiscard()
+		m.fireDiscard(session)
+	}
+	if m.store != nil {
+		if err := m.store.Delete(id); err != nil {
+			log.Println("delete session failed", id, err)
+		}
+	}
+}
+
+// PushMetrics 离线推送队列的统计
+func (m *SessionManager) PushMetrics() *PushQueueMetrics {
+	return &m.pushMetrics
+}
+
+// Count 当前session数量
+func (m *SessionManager) Count() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.sessions)
+}
+
+// Sweep 移除所有失效的session
+func (m *SessionManager) Sweep(now time.Time) []Session {
+	var expired []Session
+
+	m.mutex.Lock()
+	for id, session := range m.sessions {
+		if !session.checkAliveAt(now) {
+			delete(m.sessions, id)
+			expired = append(expired, session)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, session := range expired {
+		session.MarkDiscard()
+		m.fireDiscard(session)
+	}
+	if m.store != nil {
+		m.sweepStore(now, expired)
+	}
+	return expired
+}
+
+// sweepStore 删除存储中已经过期的session，包括没有加载到内存中的session
+func (m *SessionManager) sweepStore(now time.Time, expired []Session) {
+	for _, session := range expired {
+		if err := m.store.Delete(session.Id()); err != nil {
+			log.Println("delete session failed", session.Id(), err)
+		}
+	}
+
+	timeout := time.Duration(m.config.GetSessionTimeoutMillis()) * time.Millisecond
+	ids, err := m.store.ScanExpired(now.Add(-timeout))
+	if err != nil {
+		log.Println("scan expired session failed", err)
+		return
+	}
+	for _, id := range ids {
+		m.mutex.RLock()
+		_, ok := m.sessions[id]
+		m.mutex.RUnlock()
+		if ok {
+			continue
+		}
+		if err = m.store.Delete(id); err != nil {
+			log.Println("delete session failed", id, err)
+		}
+	}
+}
+
+// Start 开始按sessionTickTime定时清理，每一轮都重新读取配置
+func (m *SessionManager) Start() {
+	m.mutex.Lock()
+	if m.stop != nil {
+		m.mutex.Unlock()
+		return
+	}
+	m.stop = make(chan struct{})
+	stop := m.stop
+	m.mutex.Unlock()
+
+	go func() {
+		for {
+			timer := time.NewTimer(time.Duration(m.config.GetSessionTickTime()) * time.Millisecond)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-m.resetTick:
+				timer.Stop()
+			case now := <-timer.C:
+				m.Sweep(now)
+				m.Flush()
+			}
+		}
+	}()
+}
+
+// Stop 停止定时清理，并把所有修改写入SessionStore
+func (m *SessionManager) Stop() {
+	m.mutex.Lock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+	m.mutex.Unlock()
+
+	m.Flush()
+}
+
+func newSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sessionManagerOf 从ServletContext中获取SessionManager
+func sessionManagerOf(context ServletContext) *SessionManager {
+	if context == nil {
+		return nil
+	}
+	manager, _ := context.Get(SessionManagerKey, nil).(*SessionManager)
+	return manager
+}
@@ -0,0 +1,427 @@
+package servlet
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// SessionData session持久化的内容，属性值已经由AttributeSerializer序列化
+type SessionData struct {
+	Id         string
+	CreateTime time.Time
+	AccessTime time.Time
+	Attributes map[string][]byte
+}
+
+// SessionStore session存储，SessionManager在创建、修改、访问和过期时调用
+type SessionStore interface {
+	// Load 加载session，不存在时返回nil, nil
+	Load(id string) (*SessionData, error)
+
+	// Save 保存完整的session
+	Save(data *SessionData) error
+
+	// Delete 删除session
+	Delete(id string) error
+
+	// Touch 只更新访问时间
+	Touch(id string, accessTime time.Time) error
+
+	// ScanExpired 返回访问时间早于accessBefore的sessionId
+	ScanExpired(accessBefore time.Time) ([]string, error)
+}
+
+// SessionStoreFlusher 需要批量落地的存储实现该接口，SessionManager每轮持久化之后调用Flush
+type SessionStoreFlusher interface {
+	Flush() error
+}
+
+// AttributeSerializer session属性值的序列化方式，没有注册序列化方式的属性不会被持久化
+type AttributeSerializer interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+var (
+	serializerMutex sync.RWMutex
+	serializers     = make(map[string]AttributeSerializer)
+)
+
+// RegisterAttributeSerializer 注册属性key对应的序列化方式
+func RegisterAttributeSerializer(key string, serializer AttributeSerializer) {
+	serializerMutex.Lock()
+	defer serializerMutex.Unlock()
+
+	serializers[key] = serializer
+}
+
+func attributeSerializer(key string) AttributeSerializer {
+	serializerMutex.RLock()
+	defer serializerMutex.RUnlock()
+
+	return serializers[key]
+}
+
+// JsonSerializer 使用json序列化，New返回反序列化目标的指针，例如func() interface{} { return new(Player) }
+type JsonSerializer struct {
+	New func() interface{}
+}
+
+func (j *JsonSerializer) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (j *JsonSerializer) Unmarshal(data []byte) (interface{}, error) {
+	ptr := j.New()
+	if err := json.Unmarshal(data, ptr); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(ptr).Elem().Interface(), nil
+}
+
+// GobSerializer 使用gob序列化，New的含义与JsonSerializer相同
+type GobSerializer struct {
+	New func() interface{}
+}
+
+func (g *GobSerializer) Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(value)
+	return buf.Bytes(), err
+}
+
+func (g *GobSerializer) Unmarshal(data []byte) (interface{}, error) {
+	ptr := g.New()
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(ptr); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(ptr).Elem().Interface(), nil
+}
+
+func copySessionData(data *SessionData) *SessionData {
+	c := *data
+	c.Attributes = make(map[string][]byte, len(data.Attributes))
+	for k, v := range data.Attributes {
+		c.Attributes[k] = v
+	}
+	return &c
+}
+
+// MemorySessionStore 内存存储，进程重启后丢失
+type MemorySessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[string]*SessionData
+}
+
+// NewMemorySessionStore 创建内存存储
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]*SessionData)}
+}
+
+func (m *MemorySessionStore) Load(id string) (*SessionData, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	data, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	return copySessionData(data), nil
+}
+
+func (m *MemorySessionStore) Save(data *SessionData) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sessions[data.Id] = copySessionData(data)
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MemorySessionStore) Touch(id string, accessTime time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if data, ok := m.sessions[id]; ok {
+		data.AccessTime = accessTime
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) ScanExpired(accessBefore time.Time) ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var ids []string
+	for id, data := range m.sessions {
+		if data.AccessTime.Before(accessBefore) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// FileSessionStore 文件存储，所有session保存在内存中，Flush时以gob快照的方式整体写入文件
+type FileSessionStore struct {
+	*MemorySessionStore
+	path  string
+	mutex sync.Mutex
+	dirty bool
+}
+
+// NewFileSessionStore 创建文件存储，文件存在时加载其中的快照
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	store := &FileSessionStore{MemorySessionStore: NewMemorySessionStore(), path: path}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err = gob.NewDecoder(file).Decode(&store.sessions); err != nil {
+		return nil, fmt.Errorf("load session snapshot %s: %v", path, err)
+	}
+	return store, nil
+}
+
+func (f *FileSessionStore) Save(data *SessionData) error {
+	f.markDirty()
+	return f.MemorySessionStore.Save(data)
+}
+
+func (f *FileSessionStore) Delete(id string) error {
+	f.markDirty()
+	return f.MemorySessionStore.Delete(id)
+}
+
+func (f *FileSessionStore) Touch(id string, accessTime time.Time) error {
+	f.markDirty()
+	return f.MemorySessionStore.Touch(id, accessTime)
+}
+
+func (f *FileSessionStore) markDirty() {
+	f.mutex.Lock()
+	f.dirty = true
+	f.mutex.Unlock()
+}
+
+// Flush 有修改时把快照写入临时文件再替换，保证文件始终是完整的
+func (f *FileSessionStore) Flush() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !f.dirty {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	f.MemorySessionStore.mutex.RLock()
+	err := gob.NewEncoder(&buf).Encode(f.sessions)
+	f.MemorySessionStore.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err = os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+// sessionStoreConfigKeys NewSessionStoreFromConfig使用的配置项
+var sessionStoreConfigKeys = []ConfigKey{
+	{Key: "sessionStore", Type: ConfigTypeString, Default: "memory", Enum: []string{"memory", "file"}, Description: "where sessions are stored"},
+	{Key: "sessionStoreFile", Type: ConfigTypeString, Default: "sessions.gob", Description: "snapshot path of the file session store"},
+}
+
+// NewSessionStoreFromConfig 根据sessionStore配置创建存储: memory(默认)或者file，
+// file使用sessionStoreFile作为快照路径；数据库存储需要连接，只能通过SessionManager.SetStore设置
+func NewSessionStoreFromConfig(config ServletConfig) (SessionStore, error) {
+	kind := config.GetString("sessionStore", "memory")
+	switch kind {
+	case "", "memory":
+		return NewMemorySessionStore(), nil
+	case "file":
+		return NewFileSessionStore(config.GetString("sessionStoreFile", "sessions.gob"))
+	}
+	return nil, errors.New("unknown session store: " + kind)
+}
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SqlSessionStore 数据库存储，可以使用deploy.DBUtils.DB()返回的连接，多个节点可以共享同一张表。
+// SQL使用?占位符和BLOB类型，只支持MySQL和SQLite，PostgreSQL等数据库需要自己实现SessionStore
+type SqlSessionStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSqlSessionStore 创建数据库存储，table只能包含字母数字和下划线
+func NewSqlSessionStore(db *sql.DB, table string) (*SqlSessionStore, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errors.New("invalid session table name: " + table)
+	}
+	return &SqlSessionStore{db: db, table: table}, nil
+}
+
+// CreateTable 创建session表
+func (s *SqlSessionStore) CreateTable() error {
+	_, err := s.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"id VARCHAR(64) NOT NULL PRIMARY KEY, "+
+		"create_time BIGINT NOT NULL, "+
+		"access_time BIGINT NOT NULL, "+
+		"attributes BLOB)", s.table))
+	return err
+}
+
+func (s *SqlSessionStore) Load(id string) (*SessionData, error) {
+	row := s.db.QueryRow(fmt.Sprintf("SELECT create_time, access_time, attributes FROM %s WHERE id = ?", s.table), id)
+
+	var createTime, accessTime int64
+	var attributes []byte
+	err := row.Scan(&createTime, &accessTime, &attributes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data := &SessionData{Id: id, CreateTime: time.Unix(0, createTime*int64(time.Millisecond)),
+		AccessTime: time.Unix(0, accessTime*int64(time.Millisecond))}
+	if len(attributes) > 0 {
+		if err = gob.NewDecoder(bytes.NewReader(attributes)).Decode(&data.Attributes); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Save 在事务中先删除再插入，不使用MySQL特有的REPLACE INTO，SQLite也可以使用
+func (s *SqlSessionStore) Save(data *SessionData) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(data.Attributes); err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table), data.Id)
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (id, create_time, access_time, attributes) VALUES (?, ?, ?, ?)", s.table),
+			data.Id, toMillis(data.CreateTime), toMillis(data.AccessTime), buf.Bytes())
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SqlSessionStore) Delete(id string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", s.table), id)
+	return err
+}
+
+func (s *SqlSessionStore) Touch(id string, accessTime time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf("UPDATE %s SET access_time = ? WHERE id = ?", s.table), toMillis(accessTime), id)
+	return err
+}
+
+func (s *SqlSessionStore) ScanExpired(accessBefore time.Time) ([]string, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT id FROM %s WHERE access_time < ?", s.table), toMillis(accessBefore))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// snapshot 序列化session，没有注册序列化方式的属性被跳过
+func (s *DefaultSession) snapshot() *SessionData {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data := &SessionData{Id: s.id, CreateTime: s.createTime, AccessTime: s.accessTime,
+		Attributes: make(map[string][]byte, len(s.attributes))}
+	for key, value := range s.attributes {
+		serializer := attributeSerializer(key)
+		if serializer == nil {
+			continue
+		}
+		raw, err := serializer.Marshal(value)
+		if err != nil {
+			log.Println("serialize session attribute failed", key, err)
+			continue
+		}
+		data.Attributes[key] = raw
+	}
+	return data
+}
+
+// restoreSession 从存储的数据恢复session，无法反序列化的属性被丢弃
+func restoreSession(data *SessionData, manager *SessionManager) *DefaultSession {
+	session := newDefaultSession(data.Id, manager)
+	session.createTime = data.CreateTime
+	session.accessTime = data.AccessTime
+	session.persisted = true
+	session.persistTime = data.AccessTime
+	for key, raw := range data.Attributes {
+		serializer := attributeSerializer(key)
+		if serializer == nil {
+			continue
+		}
+		value, err := serializer.Unmarshal(raw)
+		if err != nil {
+			log.Println("deserialize session attribute failed", key, err)
+			continue
+		}
+		session.attributes[key] = value
+	}
+	return session
+}
@@ -0,0 +1,375 @@
+package servlet
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newSessionConfig() *XmlServletConfig {
+	config := NewXmlServletConfig("not-exist.xml")
+	config.config["sessionTimeoutTime"] = 1000
+	config.config["sessionEmptyTimeoutTime"] = 100
+	config.config["sessionInvalidateMillis"] = 10000
+	config.config["sessionNextDayInvalidateMillis"] = 0
+	return config
+}
+
+func TestSessionManagerSweep(t *testing.T) {
+	manager := NewSessionManager(newSessionConfig())
+	empty := manager.CreateSession()
+	used := manager.CreateSession()
+	used.Set("player", 1)
+
+	now := time.Now()
+	if expired := manager.Sweep(now.Add(500 * time.Millisecond)); len(expired) != 1 || expired[0] != empty {
+		t.Fatalf("expected only the empty session to expire, got %v", expired)
+	}
+	if manager.GetSession(used.Id()) == nil || manager.GetSession(empty.Id()) != nil {
+		t.Fatal("unexpected sessions after sweep")
+	}
+
+	used.(*DefaultSession).createTime = now.Add(-20 * time.Second)
+	if !used.IsInvalidate() || manager.GetSession(used.Id()) != nil {
+		t.Fatal("session should be invalidated after sessionInvalidateMillis")
+	}
+	manager.Sweep(now)
+	if manager.Count() != 0 {
+		t.Fatalf("expected no sessions, got %d", manager.Count())
+	}
+}
+
+func TestSessionNextDayInvalidate(t *testing.T) {
+	manager := NewSessionManager(newSessionConfig())
+	session := manager.CreateSession().(*DefaultSession)
+	session.createTime = time.Date(2021, 7, 1, 23, 59, 59, 0, time.Local)
+
+	if session.isInvalidateAt(time.Date(2021, 7, 1, 23, 59, 59, 500, time.Local)) {
+		t.Fatal("session should be valid on the same day")
+	}
+	if !session.isInvalidateAt(time.Date(2021, 7, 2, 0, 0, 1, 0, time.Local)) {
+		t.Fatal("session should be invalidated on the next day")
+	}
+}
+
+func TestRequestSessionBinding(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(newSessionConfig())
+	context.Set(SessionManagerKey, manager)
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	first := NewTcpquest(conn, context, RequestMessage{Command: "login"})
+	if first.GetSession(false) != nil {
+		t.Fatal("session should not be created")
+	}
+	session := *first.GetSession(true)
+
+	second := NewTcpquest(conn, context, RequestMessage{Command: "info"})
+	if got := second.GetSession(false); got == nil || *got != session {
+		t.Fatal("session should be bound to the connection")
+	}
+	if _, ok := conn.Context().(*ConnPipeline); !ok {
+		t.Fatal("SetSessionId must not replace the pipeline")
+	}
+}
+
+type sessionPlayer struct {
+	Name  string
+	Level int
+}
+
+func TestFileSessionStoreRestore(t *testing.T) {
+	RegisterAttributeSerializer("player", &JsonSerializer{New: func() interface{} { return new(sessionPlayer) }})
+	path := filepath.Join(t.TempDir(), "sessions.gob")
+
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewSessionManager(newSessionConfig())
+	manager.SetStore(store)
+	session := manager.CreateSession()
+	session.Set("player", sessionPlayer{Name: "will", Level: 3})
+	session.Set("conn", &recordConn{})
+	manager.Stop()
+
+	// 模拟重启
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager = NewSessionManager(newSessionConfig())
+	manager.SetStore(store)
+	restored := manager.GetSession(session.Id())
+	if restored == nil {
+		t.Fatal("session should be restored from file")
+	}
+	if player, ok := restored.Get("player").(sessionPlayer); !ok || player.Level != 3 {
+		t.Fatalf("unexpected player %v", restored.Get("player"))
+	}
+	if restored.Get("conn") != nil {
+		t.Fatal("attributes without serializer should not be persisted")
+	}
+
+	manager.Remove(session.Id())
+	if data, _ := store.Load(session.Id()); data != nil {
+		t.Fatal("removed session should be deleted from store")
+	}
+}
+
+// failingStore Save和Touch按fail返回错误的存储
+type failingStore struct {
+	*MemorySessionStore
+	fail  bool
+	saves int
+}
+
+func (s *failingStore) Save(data *SessionData) error {
+	s.saves++
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	return s.MemorySessionStore.Save(data)
+}
+
+func (s *failingStore) Touch(id string, accessTime time.Time) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	return s.MemorySessionStore.Touch(id, accessTime)
+}
+
+func TestSessionPersistRetry(t *testing.T) {
+	store := &failingStore{MemorySessionStore: NewMemorySessionStore(), fail: true}
+	manager := NewSessionManager(newSessionConfig())
+	manager.SetStore(store)
+	// 创建时保存失败，之后每一轮都重试
+	session := manager.CreateSession()
+	manager.Flush()
+	if store.saves != 2 {
+		t.Fatalf("failed save not retried, got %d saves", store.saves)
+	}
+	store.fail = false
+	manager.Flush()
+	if store.saves != 3 {
+		t.Fatalf("failed save not retried, got %d saves", store.saves)
+	}
+	if data, _ := store.Load(session.Id()); data == nil {
+		t.Fatal("session not saved after retry")
+	}
+	manager.Flush()
+	if store.saves != 3 {
+		t.Fatal("saved session saved again without changes")
+	}
+}
+
+// fakeDriver 只支持SqlSessionStore使用的语句的内存数据库，事务回滚时恢复开始时的数据
+type fakeDriver struct {
+	mutex   sync.Mutex
+	rows    map[string][]driver.Value
+	failing string
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+	backup map[string][]driver.Value
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{driver: d}, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.driver.mutex.Lock()
+	defer c.driver.mutex.Unlock()
+
+	c.backup = make(map[string][]driver.Value, len(c.driver.rows))
+	for id, row := range c.driver.rows {
+		c.backup[id] = row
+	}
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.backup = nil
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.driver.mutex.Lock()
+	defer c.driver.mutex.Unlock()
+
+	c.driver.rows = c.backup
+	c.backup = nil
+	return nil
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return strings.Count(s.query, "?")
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	d := s.conn.driver
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.failing != "" && strings.HasPrefix(s.query, d.failing) {
+		return nil, errors.New("fake failure: " + s.query)
+	}
+	switch {
+	case strings.HasPrefix(s.query, "CREATE"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "DELETE"):
+		_, ok := d.rows[args[0].(string)]
+		delete(d.rows, args[0].(string))
+		if ok {
+			return driver.RowsAffected(1), nil
+		}
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT"):
+		if _, ok := d.rows[args[0].(string)]; ok {
+			return nil, errors.New("duplicate key " + args[0].(string))
+		}
+		d.rows[args[0].(string)] = args[1:]
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		row, ok := d.rows[args[1].(string)]
+		if !ok {
+			return driver.RowsAffected(0), nil
+		}
+		d.rows[args[1].(string)] = []driver.Value{row[0], args[0], row[2]}
+		return driver.RowsAffected(1), nil
+	}
+	return nil, errors.New("unsupported statement: " + s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.conn.driver
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	rows := &fakeRows{}
+	switch {
+	case strings.HasPrefix(s.query, "SELECT create_time"):
+		rows.columns = []string{"create_time", "access_time", "attributes"}
+		if row, ok := d.rows[args[0].(string)]; ok {
+			rows.values = append(rows.values, row)
+		}
+	case strings.HasPrefix(s.query, "SELECT id"):
+		rows.columns = []string{"id"}
+		for id, row := range d.rows {
+			if row[1].(int64) < args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{id})
+			}
+		}
+	default:
+		return nil, errors.New("unsupported query: " + s.query)
+	}
+	return rows, nil
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var fakeSql = &fakeDriver{rows: make(map[string][]driver.Value)}
+
+func init() {
+	sql.Register("fakesql", fakeSql)
+}
+
+func TestSqlSessionStore(t *testing.T) {
+	db, err := sql.Open("fakesql", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := NewSqlSessionStore(db, "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = store.CreateTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	data := &SessionData{Id: "s1", CreateTime: now, AccessTime: now, Attributes: map[string][]byte{"player": []byte("1")}}
+	if err = store.Save(data); err != nil {
+		t.Fatal(err)
+	}
+	// 已经存在的session再次保存时覆盖
+	data.Attributes["player"] = []byte("2")
+	if err = store.Save(data); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load("s1")
+	if err != nil || loaded == nil || string(loaded.Attributes["player"]) != "2" {
+		t.Fatalf("unexpected session %v %v", loaded, err)
+	}
+
+	// 插入失败时回滚删除，原来的数据保留
+	fakeSql.failing = "INSERT"
+	data.Attributes["player"] = []byte("3")
+	if err = store.Save(data); err == nil {
+		t.Fatal("expected save to fail")
+	}
+	fakeSql.failing = ""
+	if loaded, _ = store.Load("s1"); loaded == nil || string(loaded.Attributes["player"]) != "2" {
+		t.Fatalf("failed save should be rolled back, got %v", loaded)
+	}
+
+	if err = store.Touch("s1", now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := store.ScanExpired(now.Add(-time.Minute)); err != nil || len(ids) != 1 || ids[0] != "s1" {
+		t.Fatalf("unexpected expired sessions %v %v", ids, err)
+	}
+	if err = store.Delete("s1"); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, _ = store.Load("s1"); loaded != nil {
+		t.Fatal("deleted session loaded")
+	}
+}
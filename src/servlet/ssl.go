@@ -0,0 +1,451 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SslCertFileKey     = "sslCertFile"
+	SslKeyFileKey      = "sslKeyFile"
+	SslClientAuthKey   = "sslClientAuth"
+	SslClientCAFileKey = "sslClientCAFile"
+	SslMinVersionKey   = "sslMinVersion"
+	// SslHandshakeTimeoutKey 连接建立之后完成TLS握手的期限，超时时关闭连接
+	SslHandshakeTimeoutKey = "sslHandshakeTimeout"
+	// SslMaxPendingSizeKey 握手完成之前等待加密写出的数据的上限，超过时关闭连接
+	SslMaxPendingSizeKey = "sslMaxPendingSize"
+
+	// SslClientAuthNone 不请求客户端证书
+	SslClientAuthNone = "none"
+	// SslClientAuthRequest 客户端提供证书时校验
+	SslClientAuthRequest = "request"
+	// SslClientAuthRequire 客户端必须提供能够通过校验的证书
+	SslClientAuthRequire = "require"
+
+	// SslContextKey SslContext保存在ServletContext中的key
+	SslContextKey = "servlet.sslContext"
+	// SslAttr 连接上的SslHandler保存在ConnPipeline上的属性名
+	SslAttr = "servlet.ssl"
+	// SslHandlerName SslHandler在pipeline中的名字
+	SslHandlerName = "ssl"
+)
+
+// sslConfigKeys TLS使用的配置项，配置了证书时tcp服务启用TLS
+var sslConfigKeys = []ConfigKey{
+	{Key: SslCertFileKey, Type: ConfigTypeString, Description: "PEM certificate chain, enables TLS on tcp servers"},
+	{Key: SslKeyFileKey, Type: ConfigTypeString, Description: "PEM private key of the certificate"},
+	{Key: SslClientAuthKey, Type: ConfigTypeString, Default: SslClientAuthNone, Enum: []string{SslClientAuthNone, SslClientAuthRequest, SslClientAuthRequire}, Description: "client certificate authentication"},
+	{Key: SslClientCAFileKey, Type: ConfigTypeString, Description: "PEM CA certificates to verify client certificates"},
+	{Key: SslMinVersionKey, Type: ConfigTypeString, Default: "1.2", Enum: []string{"1.2", "1.3"}, Description: "minimum TLS version"},
+	{Key: SslHandshakeTimeoutKey, Type: ConfigTypeDuration, Default: 10 * time.Second, Min: time.Duration(0), Description: "close connections that do not finish the TLS handshake in time, 0 disables"},
+	{Key: SslMaxPendingSizeKey, Type: ConfigTypeSize, Default: "1MB", Min: int64(1), Description: "max size of writes buffered before the TLS handshake finishes"},
+}
+
+// SslContext 服务器的TLS配置，证书文件修改之后在下一次握手时重新加载，已经建立的连接不受影响。
+// 检查文件的间隔为configReloadInterval，ssl开头的配置项变化时立即重新加载
+type SslContext struct {
+	config    ServletConfig
+	interval  time.Duration
+	tlsConfig atomic.Value
+
+	mutex   sync.Mutex
+	files   []*watchedFile
+	checked time.Time
+}
+
+// NewSslContext 从配置中加载证书，证书、私钥或者客户端CA无法加载时返回错误
+func NewSslContext(config ServletConfig) (*SslContext, error) {
+	s := &SslContext{config: config, interval: config.GetDuration(ConfigReloadIntervalKey, 5*time.Second)}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	if watcher, ok := config.(ConfigWatcher); ok {
+		watcher.OnConfigChange(s.configChanged)
+	}
+	return s, nil
+}
+
+func (s *SslContext) configChanged(keys []string) {
+	if !configPrefixChanged(keys, "ssl") {
+		return
+	}
+	if err := s.Reload(); err != nil {
+		log.Println("reject ssl reload:", err)
+	}
+}
+
+// Reload 重新读取证书、私钥和客户端CA，任意一个失败时保留原来的配置并返回错误。
+// 没有配置sslKeyFile时私钥和证书在同一个文件中
+func (s *SslContext) Reload() error {
+	certFile := s.config.GetString(SslCertFileKey, "")
+	keyFile := s.config.GetString(SslKeyFileKey, "")
+	if certFile == "" {
+		return fmt.Errorf("%s is not configured", SslCertFileKey)
+	}
+	if keyFile == "" {
+		keyFile = certFile
+	}
+
+	certInfo, certPem, err := statFile(certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, keyPem, err := statFile(keyFile)
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return fmt.Errorf("%s: %w", certFile, err)
+	}
+	files := []*watchedFile{certInfo, keyInfo}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if s.config.GetString(SslMinVersionKey, "1.2") == "1.3" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	switch clientAuth := s.config.GetString(SslClientAuthKey, SslClientAuthNone); clientAuth {
+	case SslClientAuthNone:
+	case SslClientAuthRequest, SslClientAuthRequire:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if clientAuth == SslClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		caFile := s.config.GetString(SslClientCAFileKey, "")
+		if caFile == "" {
+			return fmt.Errorf("%s is required when %s is %s", SslClientCAFileKey, SslClientAuthKey, clientAuth)
+		}
+		caInfo, caPem, err := statFile(caFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("%s: no certificates found", caFile)
+		}
+		files = append(files, caInfo)
+	default:
+		return fmt.Errorf("%s: unknown value %q", SslClientAuthKey, clientAuth)
+	}
+
+	s.mutex.Lock()
+	s.files = files
+	s.checked = time.Now()
+	s.tlsConfig.Store(tlsConfig)
+	s.mutex.Unlock()
+	return nil
+}
+
+// current 当前的tls.Config，距离上次检查超过interval时先检查证书文件是否修改
+func (s *SslContext) current() *tls.Config {
+	s.mutex.Lock()
+	check := s.interval > 0 && time.Since(s.checked) >= s.interval
+	files := s.files
+	if check {
+		s.checked = time.Now()
+	}
+	s.mutex.Unlock()
+
+	if check {
+		for _, file := range files {
+			if modified, err := file.modified(); err != nil || modified {
+				if err := s.Reload(); err != nil {
+					log.Println("reject ssl reload:", err)
+				} else {
+					log.Println("ssl certificates reloaded")
+				}
+				break
+			}
+		}
+	}
+	return s.tlsConfig.Load().(*tls.Config)
+}
+
+// handshakeTimeout 握手的期限，不大于0时不限制
+func (s *SslContext) handshakeTimeout() time.Duration {
+	return s.config.GetDuration(SslHandshakeTimeoutKey, 10*time.Second)
+}
+
+// maxPendingSize 握手完成之前缓存的写出数据的上限
+func (s *SslContext) maxPendingSize() int64 {
+	return s.config.GetSize(SslMaxPendingSizeKey, 1<<20)
+}
+
+// TLSConfig 给tls.Server使用的配置，每次握手时取最新的证书
+func (s *SslContext) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return s.current(), nil
+		},
+	}
+}
+
+// sslEvent 读goroutine交给事件循环的结果，drained表示已经读完收到的数据
+type sslEvent struct {
+	data    []byte
+	err     error
+	drained bool
+}
+
+// SslHandler 连接上的TLS，需要是pipeline中的第一个handler，每个连接创建一个。
+// crypto/tls只支持阻塞的net.Conn，所以在单独的goroutine中通过内存中的memoryConn驱动tls.Conn，
+// 事件循环收到数据之后等待它处理完，解密出的数据仍然在事件循环中交给之后的handler。
+// 连接建立时把pipeline的Conn替换成sslConn，之后所有写出的数据都会加密，包括直接调用Conn.AsyncWrite的响应。
+// memoryConn的deadline不起作用，握手超过sslHandshakeTimeout时直接关闭连接，客户端发送close_notify之后也关闭连接
+type SslHandler struct {
+	InboundHandlerAdapter
+	context *SslContext
+	raw     Conn
+	tlsConn *tls.Conn
+
+	input   chan []byte
+	events  chan sslEvent
+	closing chan struct{}
+	done    chan struct{}
+	once    sync.Once
+
+	mutex sync.Mutex
+	// handshaked之前写出的数据先保存在pending中，握手完成之后再加密写出
+	handshaked  bool
+	pending     [][]byte
+	pendingSize int64
+	state       tls.ConnectionState
+}
+
+// NewSslHandler 创建连接上的SslHandler
+func NewSslHandler(context *SslContext) *SslHandler {
+	return &SslHandler{
+		context: context,
+		input:   make(chan []byte),
+		events:  make(chan sslEvent),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (h *SslHandler) FireConnOpen(context ConnHandlerContext) {
+	pipeline := context.Pipeline
+	h.raw = pipeline.conn
+	h.tlsConn = tls.Server(&memoryConn{handler: h}, h.context.TLSConfig())
+	pipeline.conn = &sslConn{Conn: h.raw, handler: h}
+	pipeline.SetAttr(SslAttr, h)
+
+	go h.read()
+	context.FireConnOpen()
+}
+
+// FireMessageRead 把收到的密文交给读goroutine，直到它需要更多数据时才返回
+func (h *SslHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	v, ok := msg.(*buffer.ByteBuffer)
+	if !ok {
+		context.FireMessageRead(msg)
+		return
+	}
+
+	select {
+	case h.input <- v.Data:
+	case <-h.done:
+		return
+	}
+	for {
+		select {
+		case event := <-h.events:
+			if event.drained {
+				return
+			}
+			if event.err != nil {
+				if event.err != io.EOF {
+					log.Println("ssl failed", h.raw.RemoteAddr(), event.err)
+				}
+				h.raw.Close()
+				return
+			}
+			context.FireMessageRead(&buffer.ByteBuffer{Data: event.data})
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *SslHandler) FireConnClose(context ConnHandlerContext, err error) {
+	h.once.Do(func() {
+		close(h.closing)
+	})
+	context.FireConnClose(err)
+}
+
+// ConnectionState 握手完成之后的连接状态，握手完成之前为零值
+func (h *SslHandler) ConnectionState() tls.ConnectionState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.state
+}
+
+// read 读goroutine，先完成握手，之后不断解密数据，读到EOF时也交给事件循环关闭连接
+func (h *SslHandler) read() {
+	defer close(h.done)
+
+	if timeout := h.context.handshakeTimeout(); timeout > 0 {
+		// 关闭连接之后FireConnClose关闭closing，memoryConn.Read返回EOF，握手随之失败
+		timer := time.AfterFunc(timeout, func() {
+			log.Println("ssl handshake timeout", h.raw.RemoteAddr())
+			h.raw.Close()
+		})
+		defer timer.Stop()
+	}
+	if err := h.tlsConn.Handshake(); err != nil {
+		h.send(sslEvent{err: err})
+		return
+	}
+	h.mutex.Lock()
+	h.handshaked = true
+	h.state = h.tlsConn.ConnectionState()
+	pending := h.pending
+	h.pending = nil
+	h.pendingSize = 0
+	for _, buf := range pending {
+		h.tlsConn.Write(buf)
+	}
+	h.mutex.Unlock()
+
+	buf := make([]byte, 16<<10)
+	for {
+		n, err := h.tlsConn.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if !h.send(sslEvent{data: data}) {
+				return
+			}
+		}
+		if err != nil {
+			h.send(sslEvent{err: err})
+			return
+		}
+	}
+}
+
+// send 把结果交给事件循环，连接已经关闭时返回false
+func (h *SslHandler) send(event sslEvent) bool {
+	select {
+	case h.events <- event:
+		return true
+	case <-h.closing:
+		return false
+	}
+}
+
+// write 加密写出，握手完成之前先保存起来，超过sslMaxPendingSize时关闭连接并返回SslPendingOverflow
+func (h *SslHandler) write(buf []byte) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.handshaked {
+		if h.pendingSize+int64(len(buf)) > h.context.maxPendingSize() {
+			h.raw.Close()
+			return internalErrors.SslPendingOverflow
+		}
+		h.pending = append(h.pending, append([]byte{}, buf...))
+		h.pendingSize += int64(len(buf))
+		return nil
+	}
+	_, err := h.tlsConn.Write(buf)
+	return err
+}
+
+// sslConn 替换pipeline上的Conn，写出的数据先经过TLS加密
+type sslConn struct {
+	Conn
+	handler *SslHandler
+}
+
+func (c *sslConn) AsyncWrite(buf []byte) error {
+	return c.handler.write(buf)
+}
+
+// memoryConn tls.Conn使用的内存连接，Read读取事件循环交过来的数据，Write直接写到传输层的连接
+type memoryConn struct {
+	handler *SslHandler
+	data    []byte
+	// fed 正在处理事件循环交过来的数据，读完时需要通知事件循环
+	fed bool
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		if c.fed {
+			c.fed = false
+			if !c.handler.send(sslEvent{drained: true}) {
+				return 0, io.EOF
+			}
+		}
+		select {
+		case data := <-c.handler.input:
+			c.data, c.fed = data, true
+		case <-c.handler.closing:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+// Write tls.Conn会复用写缓冲区，AsyncWrite之前需要复制
+func (c *memoryConn) Write(p []byte) (int, error) {
+	if err := c.handler.raw.AsyncWrite(append([]byte{}, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *memoryConn) Close() error {
+	return c.handler.raw.Close()
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.handler.raw.LocalAddr()
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.handler.raw.RemoteAddr()
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// PeerCertificate 请求所在连接上客户端的证书，没有使用TLS或者客户端没有提供证书时返回nil
+func (t *TcpRequest) PeerCertificate() *x509.Certificate {
+	pipeline, ok := t.conn.Context().(*ConnPipeline)
+	if !ok {
+		return nil
+	}
+	handler, ok := pipeline.Attr(SslAttr).(*SslHandler)
+	if !ok {
+		return nil
+	}
+	if certificates := handler.ConnectionState().PeerCertificates; len(certificates) > 0 {
+		return certificates[0]
+	}
+	return nil
+}
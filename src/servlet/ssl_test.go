@@ -0,0 +1,254 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+	tls  tls.Certificate
+}
+
+// newTestCert 创建证书，parent为nil时是自签名的CA
+func newTestCert(t *testing.T, name string, parent *testCert, serial int64) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	pair, _ := tls.X509KeyPair(certPem, keyPem)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: append(certPem, keyPem...), tls: pair}
+}
+
+// pipeConn 把写出的数据按顺序写到net.Pipe的一端，不阻塞调用方，Close时关闭net.Pipe
+type pipeConn struct {
+	recordConn
+	server net.Conn
+	out    chan []byte
+}
+
+func (c *pipeConn) AsyncWrite(buf []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.out <- buf
+	return nil
+}
+
+func (c *pipeConn) Close() error {
+	c.server.Close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+	return nil
+}
+
+// serveSsl 启动一个使用SslHandler的pipeline，回复请求所在连接上客户端证书的CommonName
+func serveSsl(t *testing.T, sslContext *SslContext) net.Conn {
+	server, client := net.Pipe()
+	conn := &pipeConn{server: server, out: make(chan []byte, 64)}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	pipeline.AddFirst(SslHandlerName, NewSslHandler(sslContext))
+	pipeline.AddLast("whoami", &whoamiHandler{})
+	pipeline.Head.FireConnOpen()
+
+	go func() {
+		for buf := range conn.out {
+			server.Write(buf)
+		}
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				pipeline.Head.FireConnClose(err)
+				conn.Close()
+				return
+			}
+			pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: buf[:n]})
+		}
+	}()
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return client
+}
+
+type whoamiHandler struct {
+	InboundHandlerAdapter
+}
+
+func (h *whoamiHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	conn := context.Pipeline.Conn()
+	name := "anonymous"
+	if cert := NewTcpquest(conn, nil, RequestMessage{}).PeerCertificate(); cert != nil {
+		name = cert.Subject.CommonName
+	}
+	NewTcpResponse(conn).Write([]byte(name))
+}
+
+func TestSslHandler(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, 1)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "server.pem")
+	ioutil.WriteFile(caFile, ca.pem, 0600)
+	ioutil.WriteFile(certFile, newTestCert(t, "server", ca, 2).pem, 0600)
+
+	config := NewLayeredServletConfig()
+	flags := []string{"-sslCertFile=" + certFile, "-sslClientCAFile=" + caFile, "-configReloadInterval=0"}
+	config.LoadFlags(append(flags, "-sslClientAuth=request"))
+	sslContext, err := NewSslContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	call := func(certificates []tls.Certificate) (string, string, error) {
+		client := tls.Client(serveSsl(t, sslContext), &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certificates})
+		if _, err := client.Write([]byte("hello")); err != nil {
+			return "", "", err
+		}
+		buf := make([]byte, 64)
+		n, err := client.Read(buf)
+		if err != nil {
+			return "", "", err
+		}
+		return string(buf[:n]), client.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+
+	if name, server, err := call([]tls.Certificate{newTestCert(t, "player", ca, 3).tls}); err != nil || name != "player" || server != "server" {
+		t.Fatalf("client certificate: %q %q %v", name, server, err)
+	}
+	if name, _, err := call(nil); err != nil || name != "anonymous" {
+		t.Fatalf("without client certificate: %q %v", name, err)
+	}
+
+	ioutil.WriteFile(certFile, newTestCert(t, "reloaded", ca, 4).pem, 0600)
+	config.LoadFlags(append(flags, "-sslClientAuth=require"))
+	if _, server, err := call([]tls.Certificate{newTestCert(t, "player", ca, 5).tls}); err != nil || server != "reloaded" {
+		t.Fatalf("reloaded certificate: %q %v", server, err)
+	}
+	if _, _, err := call(nil); err == nil {
+		t.Error("handshake without required client certificate succeeded")
+	}
+}
+
+// newTestSslContext 使用自签名CA签发的服务端证书，返回信任该CA的证书池
+func newTestSslContext(t *testing.T, flags ...string) (*SslContext, *x509.CertPool) {
+	ca := newTestCert(t, "ca", nil, 1)
+	certFile := filepath.Join(t.TempDir(), "server.pem")
+	ioutil.WriteFile(certFile, newTestCert(t, "server", ca, 2).pem, 0600)
+
+	config := NewLayeredServletConfig()
+	config.LoadFlags(append(flags, "-sslCertFile="+certFile, "-configReloadInterval=0"))
+	sslContext, err := NewSslContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return sslContext, roots
+}
+
+// expectClosed 连接应该在超时之前被服务端关闭
+func expectClosed(t *testing.T, client net.Conn, read func([]byte) (int, error)) {
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	for {
+		_, err := read(buf)
+		if err == nil {
+			continue
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			t.Fatal("connection should be closed by the server")
+		}
+		return
+	}
+}
+
+func TestSslHandshakeTimeout(t *testing.T) {
+	sslContext, _ := newTestSslContext(t, "-sslHandshakeTimeout=100ms")
+	client := serveSsl(t, sslContext)
+	expectClosed(t, client, client.Read)
+}
+
+func TestSslCloseNotify(t *testing.T) {
+	sslContext, roots := newTestSslContext(t)
+	raw := serveSsl(t, sslContext)
+	client := tls.Client(raw, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "anonymous" {
+		t.Fatalf("reply %q %v", buf[:n], err)
+	}
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, raw, client.Read)
+}
+
+func TestSslPendingOverflow(t *testing.T) {
+	sslContext, _ := newTestSslContext(t, "-sslMaxPendingSize=1KB")
+	handler := NewSslHandler(sslContext)
+	raw := &recordConn{}
+	handler.raw = raw
+
+	if err := handler.write(make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	if err := handler.write(make([]byte, 600)); err != internalErrors.SslPendingOverflow || !raw.closed {
+		t.Errorf("expect overflow, got %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"errors"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// PubSubKey PubSub保存在ServletContext中的key
+	PubSubKey = "servlet.pubSub"
+
+	// topicSeparator topic按.分段，例如guild.1001.chat
+	topicSeparator = "."
+	// topicWildcard 匹配任意一段
+	topicWildcard = "*"
+	// topicMultiWildcard 只能出现在最后，匹配剩余的一段或多段
+	topicMultiWildcard = "**"
+
+	// fanOutThreshold 订阅者超过这个数量时分组并发推送
+	fanOutThreshold = 64
+)
+
+// PubSub 按topic发布消息给订阅的session，
+// 订阅可以使用通配符：*匹配一段，**放在最后匹配剩余的一段或多段，
+// session被移除时自动取消它的所有订阅
+type PubSub struct {
+	manager *SessionManager
+	mutex   sync.RWMutex
+	// topics 普通topic的订阅者
+	topics map[string]map[string]struct{}
+	// patterns 带通配符topic的订阅者
+	patterns map[string]*topicPattern
+	// sessions 每个session订阅的所有topic
+	sessions map[string]map[string]struct{}
+	// Workers 并发推送的goroutine数量，默认与gnet多核模式下的event loop数量一致
+	Workers int
+}
+
+type topicPattern struct {
+	segments    []string
+	subscribers map[string]struct{}
+}
+
+// NewPubSub 创建PubSub，并在session被移除时取消订阅
+func NewPubSub(manager *SessionManager) *PubSub {
+	pubSub := &PubSub{
+		manager:  manager,
+		topics:   make(map[string]map[string]struct{}),
+		patterns: make(map[string]*topicPattern),
+		sessions: make(map[string]map[string]struct{}),
+		Workers:  runtime.NumCPU(),
+	}
+	manager.OnDiscard(func(session Session) {
+		pubSub.UnsubscribeAll(session.Id())
+	})
+	return pubSub
+}
+
+// Subscribe session订阅topic，session不存在或者已经失效时返回SessionNotFound
+func (p *PubSub) Subscribe(sessionId string, topic string) error {
+	segments, wildcard, err := parseTopic(topic)
+	if err != nil {
+		return err
+	}
+	if p.manager.GetSession(sessionId) == nil {
+		return internalErrors.SessionNotFound
+	}
+
+	p.subscribe(sessionId, topic, segments, wildcard)
+	// 订阅期间session被移除时，OnDiscard可能在加入订阅之前就已经执行
+	if p.manager.GetSession(sessionId) == nil {
+		p.Unsubscribe(sessionId, topic)
+		return internalErrors.SessionNotFound
+	}
+	return nil
+}
+
+func (p *PubSub) subscribe(sessionId string, topic string, segments []string, wildcard bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if wildcard {
+		pattern, ok := p.patterns[topic]
+		if !ok {
+			pattern = &topicPattern{segments: segments, subscribers: make(map[string]struct{})}
+			p.patterns[topic] = pattern
+		}
+		pattern.subscribers[sessionId] = struct{}{}
+	} else {
+		subscribers, ok := p.topics[topic]
+		if !ok {
+			subscribers = make(map[string]struct{})
+			p.topics[topic] = subscribers
+		}
+		subscribers[sessionId] = struct{}{}
+	}
+
+	topics, ok := p.sessions[sessionId]
+	if !ok {
+		topics = make(map[string]struct{})
+		p.sessions[sessionId] = topics
+	}
+	topics[topic] = struct{}{}
+}
+
+// Unsubscribe session取消订阅topic，topic需要与订阅时相同
+func (p *PubSub) Unsubscribe(sessionId string, topic string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.unsubscribe(sessionId, topic)
+	if topics, ok := p.sessions[sessionId]; ok {
+		delete(topics, topic)
+		if len(topics) == 0 {
+			delete(p.sessions, sessionId)
+		}
+	}
+}
+
+// UnsubscribeAll 取消session的所有订阅
+func (p *PubSub) UnsubscribeAll(sessionId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for topic := range p.sessions[sessionId] {
+		p.unsubscribe(sessionId, topic)
+	}
+	delete(p.sessions, sessionId)
+}
+
+func (p *PubSub) unsubscribe(sessionId string, topic string) {
+	if subscribers, ok := p.topics[topic]; ok {
+		delete(subscribers, sessionId)
+		if len(subscribers) == 0 {
+			delete(p.topics, topic)
+		}
+	}
+	if pattern, ok := p.patterns[topic]; ok {
+		delete(pattern.subscribers, sessionId)
+		if len(pattern.subscribers) == 0 {
+			delete(p.patterns, topic)
+		}
+	}
+}
+
+// Topics session订阅的所有topic
+func (p *PubSub) Topics(sessionId string) []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	topics := make([]string, 0, len(p.sessions[sessionId]))
+	for topic := range p.sessions[sessionId] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Subscribers 匹配topic的所有session，同一个session只出现一次
+func (p *PubSub) Subscribers(topic string) []string {
+	segments := strings.Split(topic, topicSeparator)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	matched := make(map[string]struct{}, len(p.topics[topic]))
+	for sessionId := range p.topics[topic] {
+		matched[sessionId] = struct{}{}
+	}
+	for _, pattern := range p.patterns {
+		if !pattern.match(segments) {
+			continue
+		}
+		for sessionId := range pattern.subscribers {
+			matched[sessionId] = struct{}{}
+		}
+	}
+
+	sessionIds := make([]string, 0, len(matched))
+	for sessionId := range matched {
+		sessionIds = append(sessionIds, sessionId)
+	}
+	return sessionIds
+}
+
+// Publish 把消息推送给所有订阅了topic的session，返回已经推送的数量和放入离线队列的数量，
+// 推送通道暂时不可用的session会放入离线队列，等重连之后补发。订阅者较多时按Workers分组并发推送，
+// 每个连接的写入最终由它所在的gnet event loop执行
+func (p *PubSub) Publish(topic string, command string, bytes []byte) (delivered int, queued int) {
+	sessionIds := p.Subscribers(topic)
+	if len(sessionIds) < fanOutThreshold || p.Workers <= 1 {
+		return p.deliver(sessionIds, command, bytes)
+	}
+
+	workers := p.Workers
+	size := (len(sessionIds) + workers - 1) / workers
+	counts := make(chan [2]int, workers)
+	var wg sync.WaitGroup
+	for start := 0; start < len(sessionIds); start += size {
+		end := start + size
+		if end > len(sessionIds) {
+			end = len(sessionIds)
+		}
+		wg.Add(1)
+		go func(sessionIds []string) {
+			defer wg.Done()
+			delivered, queued := p.deliver(sessionIds, command, bytes)
+			counts <- [2]int{delivered, queued}
+		}(sessionIds[start:end])
+	}
+	wg.Wait()
+	close(counts)
+
+	for count := range counts {
+		delivered += count[0]
+		queued += count[1]
+	}
+	return delivered, queued
+}
+
+func (p *PubSub) deliver(sessionIds []string, command string, bytes []byte) (delivered int, queued int) {
+	for _, sessionId := range sessionIds {
+		session := p.manager.GetSession(sessionId)
+		if session == nil {
+			continue
+		}
+		offline, err := pushSession(session, command, bytes)
+		switch {
+		case err != nil:
+		case offline:
+			queued++
+		default:
+			delivered++
+		}
+	}
+	return delivered, queued
+}
+
+func (t *topicPattern) match(segments []string) bool {
+	for i, segment := range t.segments {
+		if segment == topicMultiWildcard {
+			return len(segments) > i
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if segment != topicWildcard && segment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(t.segments)
+}
+
+// parseTopic 检查topic格式，返回分段以及是否包含通配符
+func parseTopic(topic string) ([]string, bool, error) {
+	if topic == "" {
+		return nil, false, errors.New("empty topic")
+	}
+
+	segments := strings.Split(topic, topicSeparator)
+	wildcard := false
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+			return nil, false, errors.New("empty segment in topic " + topic)
+		case segment == topicMultiWildcard:
+			if i != len(segments)-1 {
+				return nil, false, errors.New("** must be the last segment in topic " + topic)
+			}
+			wildcard = true
+		case segment == topicWildcard:
+			wildcard = true
+		case strings.Contains(segment, topicWildcard):
+			return nil, false, errors.New("wildcard must be a whole segment in topic " + topic)
+		}
+	}
+	return segments, wildcard, nil
+}
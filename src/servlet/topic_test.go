@@ -0,0 +1,104 @@
+package servlet
+
+import (
+	internalErrors "LearnGo/src/errors"
+	"sort"
+	"testing"
+)
+
+func newPubSubSession(context ServletContext) (*recordConn, Session) {
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	return conn, *NewTcpquest(conn, context, RequestMessage{Command: "login"}).GetSession(true)
+}
+
+func TestPubSubWildcard(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(newSessionConfig())
+	context.Set(SessionManagerKey, manager)
+	pubSub := NewPubSub(manager)
+
+	worldConn, world := newPubSubSession(context)
+	guildConn, guild := newPubSubSession(context)
+	pubSub.Subscribe(world.Id(), "chat.world")
+	pubSub.Subscribe(guild.Id(), "chat.*")
+	pubSub.Subscribe(guild.Id(), "guild.1001.**")
+
+	if n, _ := pubSub.Publish("chat.world", "chat", []byte("hi")); n != 2 {
+		t.Fatalf("expected 2 deliveries, got %d", n)
+	}
+	if decodeTcpMessage(t, worldConn.last()).Command != "chat" || len(guildConn.writes) != 1 {
+		t.Fatal("both subscribers should receive chat.world")
+	}
+	if n, _ := pubSub.Publish("guild.1001.notice.new", "notice", nil); n != 1 {
+		t.Fatalf("expected ** to match, got %d", n)
+	}
+	if n, _ := pubSub.Publish("guild.1001", "notice", nil); n != 0 {
+		t.Fatalf("** should need at least one segment, got %d", n)
+	}
+	if err := pubSub.Subscribe(world.Id(), "chat.**.x"); err == nil {
+		t.Fatal("** in the middle should be rejected")
+	}
+
+	manager.Remove(guild.Id())
+	if topics := pubSub.Topics(guild.Id()); len(topics) != 0 {
+		t.Fatalf("subscriptions should be removed with the session, got %v", topics)
+	}
+	for _, id := range []string{guild.Id(), "unknown"} {
+		if err := pubSub.Subscribe(id, "chat.world"); err != internalErrors.SessionNotFound || len(pubSub.Topics(id)) != 0 {
+			t.Fatalf("%s: expected SessionNotFound, got %v", id, err)
+		}
+	}
+	subscribers := pubSub.Subscribers("chat.world")
+	sort.Strings(subscribers)
+	if len(subscribers) != 1 || subscribers[0] != world.Id() {
+		t.Fatalf("unexpected subscribers %v", subscribers)
+	}
+}
+
+func TestPubSubFanOut(t *testing.T) {
+	context := NewServletContext()
+	manager := NewSessionManager(newSessionConfig())
+	context.Set(SessionManagerKey, manager)
+	pubSub := NewPubSub(manager)
+	pubSub.Workers = 4
+
+	conns := make([]*recordConn, fanOutThreshold*2)
+	for i := range conns {
+		var session Session
+		conns[i], session = newPubSubSession(context)
+		pubSub.Subscribe(session.Id(), "announce")
+	}
+	if n, _ := pubSub.Publish("announce", "announce", []byte("maintenance")); n != len(conns) {
+		t.Fatalf("expected %d deliveries, got %d", len(conns), n)
+	}
+	for _, conn := range conns {
+		if decodeTcpMessage(t, conn.last()).Command != "announce" {
+			t.Fatal("every subscriber should receive the announcement")
+		}
+	}
+}
+
+func TestPubSubQueuedOffline(t *testing.T) {
+	context := NewServletContext()
+	config := newSessionConfig()
+	config.config["pushQueueSize"] = 4
+	manager := NewSessionManager(config)
+	context.Set(SessionManagerKey, manager)
+	pubSub := NewPubSub(manager)
+
+	onlineConn, online := newPubSubSession(context)
+	offlineConn, offline := newPubSubSession(context)
+	pubSub.Subscribe(online.Id(), "chat.world")
+	pubSub.Subscribe(offline.Id(), "chat.world")
+	offlineConn.Context().(*ConnPipeline).closed = true
+
+	// 放入离线队列的消息不算作已经推送
+	delivered, queued := pubSub.Publish("chat.world", "chat", []byte("hi"))
+	if delivered != 1 || queued != 1 {
+		t.Fatalf("expected 1 delivered and 1 queued, got %d %d", delivered, queued)
+	}
+	if len(onlineConn.writes) != 1 || offline.(*DefaultSession).PushQueue().Len() != 1 {
+		t.Fatal("offline subscriber should get the message queued")
+	}
+}
@@ -0,0 +1,63 @@
+package servlet
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Conn 传输层连接，gnet.Conn可以直接作为Conn使用
+type Conn interface {
+	// Context 连接上绑定的用户数据
+	Context() (ctx interface{})
+
+	// SetContext 设置连接上绑定的用户数据
+	SetContext(ctx interface{})
+
+	// LocalAddr 本地地址
+	LocalAddr() (addr net.Addr)
+
+	// RemoteAddr 对端地址
+	RemoteAddr() (addr net.Addr)
+
+	// AsyncWrite 写数据，可以在任意goroutine中调用
+	AsyncWrite(buf []byte) error
+
+	// Close 关闭连接
+	Close() error
+}
+
+// TransportHandler 传输层事件回调，同一个连接上的事件保证串行触发
+type TransportHandler interface {
+	// OnOpened 新连接建立
+	OnOpened(conn Conn)
+
+	// OnData 收到数据，data只在回调期间有效
+	OnData(conn Conn, data []byte)
+
+	// OnClosed 连接关闭
+	OnClosed(conn Conn, err error)
+}
+
+// Transport 传输层实现，负责监听端口并把连接事件交给TransportHandler
+type Transport interface {
+	// Serve 监听protoAddr(例如tcp://:9000)并阻塞到服务停止
+	Serve(protoAddr string, handler TransportHandler) error
+
+	// Stop 停止接收新连接，等待已有连接关闭，ctx结束后强制关闭剩余连接
+	Stop(ctx context.Context) error
+
+	// CountConnections 当前连接数
+	CountConnections() int
+}
+
+// parseProtoAddr 把tcp://:9000拆分成network和address
+func parseProtoAddr(protoAddr string) (network string, address string) {
+	network = "tcp"
+	address = protoAddr
+	if index := strings.Index(protoAddr, "://"); index != -1 {
+		network = strings.ToLower(protoAddr[:index])
+		address = protoAddr[index+3:]
+	}
+	return
+}
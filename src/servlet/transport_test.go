@@ -0,0 +1,84 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type echoHandler struct {
+	InboundHandlerAdapter
+}
+
+func (e *echoHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	v, ok := msg.(*buffer.ByteBuffer)
+	if ok {
+		data := make([]byte, len(v.Data))
+		copy(data, v.Data)
+		context.FireWrite(data)
+	}
+}
+
+func TestNetTransportPipeline(t *testing.T) {
+	transport := NewNetTransport()
+	server := NewTcpServer(transport)
+	server.InitConn = func(conn Conn) {
+		conn.Context().(*ConnPipeline).AddLast("echo", &echoHandler{})
+	}
+
+	go server.Serve("tcp://127.0.0.1:0")
+	var addr net.Addr
+	for i := 0; i < 100 && addr == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addr = transport.Addr()
+	}
+	if addr == nil {
+		t.Fatal("transport not listening")
+	}
+
+	client, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "ping" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	transport.Stop(ctx)
+	if transport.CountConnections() != 0 {
+		t.Fatal("connections not closed after stop")
+	}
+}
+
+func TestNetTransportStopBeforeServe(t *testing.T) {
+	transport := NewNetTransport()
+	if err := transport.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- transport.Serve("tcp://127.0.0.1:0", nil)
+	}()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("serve should return when the transport is already stopped")
+	}
+}
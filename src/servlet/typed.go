@@ -0,0 +1,109 @@
+package servlet
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var (
+	requestType = reflect.TypeOf((*Request)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// typedHandler 通过反射调用的handler，签名为func(ctx Request, in *T) (*R, error)
+type typedHandler struct {
+	fn     reflect.Value
+	inType reflect.Type
+	codec  Codec
+}
+
+// newTypedHandler 检查handler的签名
+func newTypedHandler(handler interface{}, codec Codec) (*typedHandler, error) {
+	if codec == nil {
+		return nil, errors.New("typed handler needs a codec")
+	}
+
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("typed handler must be a func, got %s", t)
+	}
+	if t.NumIn() != 2 || t.In(0) != requestType || t.In(1).Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("typed handler %s must accept (servlet.Request, *T)", t)
+	}
+	if t.NumOut() != 2 || t.Out(1) != errorType {
+		return nil, fmt.Errorf("typed handler %s must return (R, error)", t)
+	}
+	return &typedHandler{fn: fn, inType: t.In(1).Elem(), codec: codec}, nil
+}
+
+// handle 解码请求内容，调用handler，把返回值编码之后写出，
+// 解码失败返回ErrorCodeBadRequest，handler的错误原样返回
+func (h *typedHandler) handle(request Request, response Response) error {
+	in := reflect.New(h.inType)
+	if err := h.codec.Unmarshal(request.Content(), in.Interface()); err != nil {
+		return &ServletError{Code: ErrorCodeBadRequest, Message: "bad request", Err: err}
+	}
+
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(request), in})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return err
+	}
+
+	result := out[0]
+	switch result.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+		if result.IsNil() {
+			return nil
+		}
+	}
+	body, err := h.codec.Marshal(result.Interface())
+	if err != nil {
+		return err
+	}
+	if response.Protocol() == HTTP {
+		response.AddHeader("Content-Type", contentType(h.codec))
+	}
+	WriteMessage(request, response, request.Command(), body)
+	return nil
+}
+
+// HandleTyped 增加typed handler路由，handler的签名为func(ctx Request, in *T) (*R, error)，
+// 注册时检查签名，请求内容使用codec解码成T，返回值编码之后按请求的格式写出，命令和requestId与请求相同
+func (g *RouteGroup) HandleTyped(command string, handler interface{}, codec Codec, meta ...RouteMeta) (*Route, error) {
+	typed, err := newTypedHandler(handler, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := func(request Request, response Response) {
+		if err := typed.handle(request, response); err != nil {
+			handleError(g.router.ErrorHandler(), request, response, err)
+		}
+	}
+	return g.addRoute(command, wrapped, typed.handle, meta)
+}
+
+// WriteMessage 按请求的协议写出消息：tcp和udp为带长度的消息帧，websocket为binary帧中的消息，
+// http直接作为响应内容
+func WriteMessage(request Request, response Response, command string, body []byte) {
+	switch response.Protocol() {
+	case HTTP:
+		response.Write(body)
+	case WEBSOCKET:
+		body, flags := sealResponse(request, command, body)
+		response.Write(encodeWebSocketMessage(command, request.RequestId(), flags, body))
+	default:
+		body, flags := sealResponse(request, command, body)
+		response.Write(encodeTcpMessage(command, request.RequestId(), flags, body))
+	}
+}
+
+// contentType 编码方式对应的http Content-Type
+func contentType(codec Codec) string {
+	if codec.Name() == "json" {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
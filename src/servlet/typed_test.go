@@ -0,0 +1,130 @@
+package servlet
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type loginReq struct {
+	Name string
+}
+
+type loginResp struct {
+	Welcome string
+}
+
+type positionReq struct {
+	X, Y int32
+}
+
+func TestTypedHandler(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	err := servlet.AddTypedHandler("login", func(ctx Request, in *loginReq) (*loginResp, error) {
+		if in.Name == "" {
+			return nil, NewServletError(ErrorCodeBadRequest, "name required")
+		}
+		return &loginResp{Welcome: "hi " + in.Name}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	request := NewTcpquest(conn, nil, RequestMessage{Command: "login", RequestId: 3, Content: []byte(`{"Name":"ann"}`)})
+	if err := servlet.Service(request, NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	message := decodeTcpMessage(t, conn.last())
+	var resp loginResp
+	json.Unmarshal(message.Content, &resp)
+	if message.Command != "login" || message.RequestId != 3 || resp.Welcome != "hi ann" {
+		t.Fatalf("unexpected response %+v %+v", message, resp)
+	}
+
+	for content, code := range map[string]int{`{}`: ErrorCodeBadRequest, `{bad`: ErrorCodeBadRequest} {
+		err := servlet.Service(NewTcpquest(conn, nil, RequestMessage{Command: "login", Content: []byte(content)}), NewTcpResponse(conn))
+		if AsServletError(err).Code != code || decodeTcpMessage(t, conn.last()).Command != ErrorCommand {
+			t.Fatalf("%s: unexpected error %v", content, err)
+		}
+	}
+}
+
+func TestTypedHandlerBinaryCodec(t *testing.T) {
+	var moved positionReq
+	route, err := NewRouter().HandleTyped("move", func(ctx Request, in *positionReq) (positionReq, error) {
+		moved = *in
+		return positionReq{X: in.X + 1, Y: in.Y + 1}, nil
+	}, BinaryCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, _ := BinaryCodec{}.Marshal(&positionReq{X: 1, Y: 2})
+	conn := &recordConn{}
+	if err := route.handle(NewTcpquest(conn, nil, RequestMessage{Command: "move", Content: content}), NewTcpResponse(conn)); err != nil {
+		t.Fatal(err)
+	}
+	var out positionReq
+	BinaryCodec{}.Unmarshal(decodeTcpMessage(t, conn.last()).Content, &out)
+	if moved != (positionReq{1, 2}) || out != (positionReq{2, 3}) {
+		t.Fatalf("unexpected binary round trip %v %v", moved, out)
+	}
+}
+
+func TestTypedHandlerSignature(t *testing.T) {
+	router := NewRouter()
+	for _, handler := range []interface{}{
+		"not a func",
+		func(in *loginReq) (*loginResp, error) { return nil, nil },
+		func(ctx Request, in loginReq) (*loginResp, error) { return nil, nil },
+		func(ctx Request, in *loginReq) *loginResp { return nil },
+		func(ctx Request, in *loginReq) (*loginResp, string) { return nil, "" },
+	} {
+		if _, err := router.HandleTyped("bad", handler, JsonCodec{}); err == nil {
+			t.Fatalf("signature %T should be rejected", handler)
+		}
+	}
+	if _, err := router.HandleTyped("ok", func(ctx Request, in *loginReq) (*loginResp, error) {
+		return nil, errors.New("x")
+	}, nil); err == nil {
+		t.Fatal("codec is required")
+	}
+}
+
+func TestTypedRouteHandlerUsesServletErrorHandler(t *testing.T) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	var handled error
+	servlet.SetErrorHandler(func(request Request, response Response, err error) {
+		handled = err
+	})
+
+	// 注册的同时并发查找，路由发布之后不再修改
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if route := servlet.Router().Match("login"); route != nil && route.handle == nil {
+				t.Error("route published before its handle was set")
+				return
+			}
+		}
+	}()
+	route, err := servlet.Router().HandleTyped("login", func(ctx Request, in *loginReq) (*loginResp, error) {
+		return nil, NewServletError(ErrorCodeBadRequest, "name required")
+	}, servlet.Codec())
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := &recordConn{}
+	conn.SetContext(NewConnPipeline(conn))
+	route.Handler(NewTcpquest(conn, nil, RequestMessage{Command: "login", Content: []byte(`{}`)}), NewTcpResponse(conn))
+	if AsServletError(handled).Code != ErrorCodeBadRequest || len(conn.writes) != 0 {
+		t.Fatalf("typed route should use the servlet error handler, got %v", handled)
+	}
+}
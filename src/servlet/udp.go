@@ -0,0 +1,276 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"LearnGo/src/graceful"
+	"context"
+	"github.com/panjf2000/gnet"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UdpTransport 基于gnet的UDP传输层，按对端地址维护虚拟会话，
+// 每个对端第一次发来数据报时触发OnOpened，超过Expire没有数据报时触发OnClosed
+type UdpTransport struct {
+	*gnet.EventServer
+	Options []gnet.Option
+	// Expire 虚拟会话的过期时间
+	Expire time.Duration
+
+	protoAddr string
+	handler   TransportHandler
+	localAddr net.Addr
+	mutex     sync.Mutex
+	sessions  map[string]*UdpSession
+}
+
+// UdpSession 以对端地址为key的虚拟会话，实现了Conn，写数据会直接发给对端
+type UdpSession struct {
+	transport  *UdpTransport
+	key        string
+	conn       gnet.Conn
+	connMutex  sync.RWMutex
+	remoteAddr net.Addr
+	ctx        interface{}
+	// lastActive 最后一次收到数据报的UnixNano，Tick不持有会话的锁读取
+	lastActive int64
+	closed     bool
+	// mutex 保证同一个会话上的事件串行执行
+	mutex sync.Mutex
+}
+
+// NewUdpTransport 创建UDP传输层，默认开启多核，SO_REUSEPORT和定时器总是开启
+func NewUdpTransport(options ...gnet.Option) *UdpTransport {
+	if len(options) == 0 {
+		options = []gnet.Option{gnet.WithMulticore(true)}
+	}
+	options = append(options, gnet.WithTicker(true))
+	return &UdpTransport{Options: options, Expire: time.Minute, sessions: make(map[string]*UdpSession)}
+}
+
+func (t *UdpTransport) Serve(protoAddr string, handler TransportHandler) error {
+	t.protoAddr = protoAddr
+	t.handler = handler
+	options := append(append([]gnet.Option{}, t.Options...), gnet.WithReusePort(true))
+	return gnet.Serve(t, protoAddr, options...)
+}
+
+// Stop UDP没有连接需要排空，直接停止
+func (t *UdpTransport) Stop(ctx context.Context) error {
+	return gnet.Stop(ctx, t.protoAddr)
+}
+
+func (t *UdpTransport) CountConnections() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.sessions)
+}
+
+func (t *UdpTransport) OnInitComplete(svr gnet.Server) (action gnet.Action) {
+	t.localAddr = svr.Addr
+	if svr.ReusePort {
+		graceful.BindReusePort(t.protoAddr)
+	} else {
+		graceful.BindExclusive(t.protoAddr)
+	}
+	return
+}
+
+func (t *UdpTransport) OnShutdown(svr gnet.Server) {
+	t.mutex.Lock()
+	sessions := make([]*UdpSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		sessions = append(sessions, session)
+	}
+	t.mutex.Unlock()
+
+	for _, session := range sessions {
+		t.closeSession(session, nil)
+	}
+}
+
+func (t *UdpTransport) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+	remoteAddr := c.RemoteAddr()
+	key := remoteAddr.String()
+
+	t.mutex.Lock()
+	session, ok := t.sessions[key]
+	if !ok {
+		session = &UdpSession{transport: t, key: key, remoteAddr: remoteAddr, lastActive: time.Now().UnixNano()}
+		t.sessions[key] = session
+	}
+	t.mutex.Unlock()
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return
+	}
+	// gnet的UDP连接只在React期间有效，但SendTo使用的fd和对端地址在之后依然可用
+	session.connMutex.Lock()
+	session.conn = c
+	session.connMutex.Unlock()
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+	if !ok {
+		t.handler.OnOpened(session)
+	}
+	t.handler.OnData(session, frame)
+	return
+}
+
+// Tick 定时清理过期的虚拟会话，先复制会话列表再检查，不在持有t.mutex时等待会话的锁
+func (t *UdpTransport) Tick() (delay time.Duration, action gnet.Action) {
+	t.mutex.Lock()
+	sessions := make([]*UdpSession, 0, len(t.sessions))
+	for _, session := range t.sessions {
+		sessions = append(sessions, session)
+	}
+	t.mutex.Unlock()
+
+	now := time.Now()
+	for _, session := range sessions {
+		if now.Sub(session.LastActive()) > t.Expire {
+			t.closeSession(session, nil)
+		}
+	}
+
+	delay = t.Expire / 4
+	if delay < time.Second {
+		delay = time.Second
+	}
+	return
+}
+
+func (t *UdpTransport) closeSession(session *UdpSession, err error) {
+	t.mutex.Lock()
+	if t.sessions[session.key] == session {
+		delete(t.sessions, session.key)
+	}
+	t.mutex.Unlock()
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return
+	}
+	session.closed = true
+	t.handler.OnClosed(session, err)
+}
+
+func (s *UdpSession) Context() interface{} {
+	return s.ctx
+}
+
+func (s *UdpSession) SetContext(ctx interface{}) {
+	s.ctx = ctx
+}
+
+func (s *UdpSession) LocalAddr() net.Addr {
+	return s.transport.localAddr
+}
+
+func (s *UdpSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// AsyncWrite 把数据作为一个数据报发送给对端
+func (s *UdpSession) AsyncWrite(buf []byte) error {
+	s.connMutex.RLock()
+	conn := s.conn
+	s.connMutex.RUnlock()
+
+	if conn == nil {
+		return internalErrors.NotSupport
+	}
+	return conn.SendTo(buf)
+}
+
+// Close 异步移除虚拟会话，可以在任何地方调用，包括会话自己的事件回调。返回时会话可能还没有移除，OnClosed稍后在另一个goroutine中触发
+func (s *UdpSession) Close() error {
+	go s.transport.closeSession(s, nil)
+	return nil
+}
+
+// LastActive 最后一次收到数据报的时间
+func (s *UdpSession) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+// DatagramToMessageDecoder 数据报解码器，每个数据报单独解码，
+// 不会像ByteToMessageDecoder那样跨数据报累积半包，解码剩余的字节直接丢弃
+type DatagramToMessageDecoder struct {
+	InboundHandlerAdapter
+	Decoder
+	outputList []interface{}
+}
+
+func (d *DatagramToMessageDecoder) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	v, ok := msg.(*buffer.ByteBuffer)
+	if !ok {
+		context.FireMessageRead(msg)
+		return
+	}
+
+	in := buffer.New(uint32(len(v.Data)), buffer.BigEndian)
+	in.WriteBytes(v.Data)
+	d.CallDecode(context, in, &d.outputList)
+
+	for i := 0; i < len(d.outputList); i++ {
+		context.FireMessageRead(d.outputList[i])
+	}
+	d.outputList = d.outputList[:0]
+}
+
+// UdpRequest udp请求，参数解析等行为与TcpRequest一致
+type UdpRequest struct {
+	TcpRequest
+}
+
+func (u *UdpRequest) Protocol() ServerProtocol {
+	return UDP
+}
+
+// NewUdpRequest 创建udp请求，conn为对端的UdpSession
+func NewUdpRequest(conn Conn, context ServletContext, message RequestMessage) Request {
+	var request UdpRequest
+	request.requestId = message.RequestId
+	request.command = message.Command
+	request.content = message.Content
+	request.sessionId = message.SessionId
+	request.flags = message.Flags
+	request.createTime = time.Now()
+	request.conn = conn
+	request.context = context
+	request.newPush = newUdpPush
+
+	return &request
+}
+
+// UdpResponse udp响应，每次Write发送一个数据报给请求方
+type UdpResponse struct {
+	TcpResponse
+}
+
+func (u *UdpResponse) Protocol() ServerProtocol {
+	return UDP
+}
+
+// MarkClose 丢弃对端的虚拟会话
+func (u *UdpResponse) MarkClose() {
+	u.closeFlag = true
+	u.conn.Close()
+}
+
+// NewUdpResponse 创建udp响应，conn为对端的UdpSession
+func NewUdpResponse(conn Conn) Response {
+	var response UdpResponse
+	response.conn = conn
+
+	return &response
+}
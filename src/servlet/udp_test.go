@@ -0,0 +1,154 @@
+package servlet
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEchoHandler 把请求的msg参数原样回复给请求方，msg为close时丢弃虚拟会话
+type udpEchoHandler struct {
+	opened chan Conn
+	closed chan Conn
+}
+
+func (h *udpEchoHandler) OnOpened(conn Conn) {
+	h.opened <- conn
+}
+
+func (h *udpEchoHandler) OnData(conn Conn, data []byte) {
+	request := NewUdpRequest(conn, nil, RequestMessage{Command: "echo", Content: append([]byte{}, data...)})
+	response := NewUdpResponse(conn)
+	if request.Protocol() != UDP || response.Protocol() != UDP {
+		return
+	}
+	msg := request.GetParameterValues("msg")
+	if len(msg) > 0 && msg[0] == "close" {
+		response.MarkClose()
+		return
+	}
+	if len(msg) > 0 {
+		response.Write([]byte(msg[0]))
+	}
+}
+
+func (h *udpEchoHandler) OnClosed(conn Conn, err error) {
+	h.closed <- conn
+}
+
+func startUdpTransport(t *testing.T, expire time.Duration) (*UdpTransport, *udpEchoHandler, net.Conn) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+
+	transport := NewUdpTransport()
+	transport.Expire = expire
+	handler := &udpEchoHandler{opened: make(chan Conn, 4), closed: make(chan Conn, 4)}
+	go transport.Serve("udp://"+addr, handler)
+	t.Cleanup(func() {
+		transport.Stop(context.Background())
+	})
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+	return transport, handler, client
+}
+
+// udpRoundTrip 服务启动之前的数据报会丢失，没有回复时重发
+func udpRoundTrip(t *testing.T, client net.Conn, msg string) string {
+	reply := make([]byte, 64)
+	for i := 0; i < 50; i++ {
+		client.Write([]byte("msg=" + msg))
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := client.Read(reply)
+		if err == nil {
+			return string(reply[:n])
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			// 端口还没有监听时会收到connection refused
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	t.Fatal("no reply for", msg)
+	return ""
+}
+
+func waitConn(t *testing.T, ch chan Conn, event string) Conn {
+	select {
+	case conn := <-ch:
+		return conn
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event", event)
+	}
+	return nil
+}
+
+func TestUdpTransportReply(t *testing.T) {
+	transport, handler, client := startUdpTransport(t, time.Minute)
+
+	if reply := udpRoundTrip(t, client, "hello"); reply != "hello" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	if reply := udpRoundTrip(t, client, "again"); reply != "again" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+	session := waitConn(t, handler.opened, "opened").(*UdpSession)
+	if transport.CountConnections() != 1 {
+		t.Fatal("datagrams from one peer should share a session", transport.CountConnections())
+	}
+	if session.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatal("unexpected remote addr", session.RemoteAddr())
+	}
+	if time.Since(session.LastActive()) > time.Second {
+		t.Fatal("last active not updated", session.LastActive())
+	}
+}
+
+func TestUdpTransportExpire(t *testing.T) {
+	transport, handler, client := startUdpTransport(t, 50*time.Millisecond)
+
+	udpRoundTrip(t, client, "hello")
+	session := waitConn(t, handler.opened, "opened")
+
+	transport.Tick()
+	if transport.CountConnections() != 1 {
+		t.Fatal("active session expired")
+	}
+	time.Sleep(100 * time.Millisecond)
+	transport.Tick()
+	if closed := waitConn(t, handler.closed, "closed"); closed != session {
+		t.Fatal("unexpected session closed")
+	}
+	if transport.CountConnections() != 0 {
+		t.Fatal("expired session not removed")
+	}
+
+	// 过期之后再发送数据报会创建新的会话
+	udpRoundTrip(t, client, "again")
+	if waitConn(t, handler.opened, "reopened") == session {
+		t.Fatal("expired session reused")
+	}
+}
+
+func TestUdpResponseMarkClose(t *testing.T) {
+	transport, handler, client := startUdpTransport(t, time.Minute)
+
+	udpRoundTrip(t, client, "hello")
+	session := waitConn(t, handler.opened, "opened")
+	client.Write([]byte("msg=close"))
+	if closed := waitConn(t, handler.closed, "closed"); closed != session {
+		t.Fatal("unexpected session closed")
+	}
+	if transport.CountConnections() != 0 {
+		t.Fatal("closed session not removed")
+	}
+}
@@ -0,0 +1,543 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	internalErrors "LearnGo/src/errors"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	WebSocketContinuation byte = 0x0
+	WebSocketText         byte = 0x1
+	WebSocketBinary       byte = 0x2
+	WebSocketClose        byte = 0x8
+	WebSocketPing         byte = 0x9
+	WebSocketPong         byte = 0xA
+)
+
+const (
+	// WebSocketCloseNormal 正常关闭
+	WebSocketCloseNormal = 1000
+	// WebSocketCloseProtocolError 协议错误
+	WebSocketCloseProtocolError = 1002
+	// WebSocketCloseUnsupportedData 不支持的数据类型
+	WebSocketCloseUnsupportedData = 1003
+	// WebSocketCloseInvalidData text消息不是合法的UTF-8
+	WebSocketCloseInvalidData = 1007
+	// WebSocketCloseTooBig 消息超过大小限制
+	WebSocketCloseTooBig = 1009
+)
+
+const (
+	// WebSocketHandshakeAttr 握手请求保存在ConnPipeline上的属性名
+	WebSocketHandshakeAttr = "websocket.handshake"
+	// webSocketGUID 计算Sec-WebSocket-Accept使用的固定GUID
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// maxHandshakeSize 握手请求的最大长度
+	maxHandshakeSize = 8192
+	// commandLength 消息中command字段的固定长度
+	commandLength = 32
+	// defaultMaxWebSocketFrameSize 没有配置MaxFrameSize时帧和消息的最大长度
+	defaultMaxWebSocketFrameSize = 4 << 20
+
+	// WebSocketMaxFrameSizeKey 单个帧以及合并分片之后消息的最大长度
+	WebSocketMaxFrameSizeKey = "websocketMaxFrameSize"
+)
+
+// websocketConfigKeys websocket使用的配置项，只在连接建立时读取
+var websocketConfigKeys = []ConfigKey{
+	{Key: WebSocketMaxFrameSizeKey, Type: ConfigTypeSize, Default: "4MB", Min: int64(1), Max: int64(math.MaxInt32), Description: "max size of a websocket frame or reassembled message"},
+}
+
+// WebSocketHandshake 握手请求中的路径和请求头
+type WebSocketHandshake struct {
+	Path   string
+	Header http.Header
+}
+
+// WebSocketFrame 一个完整的websocket消息，分片已经合并
+type WebSocketFrame struct {
+	Opcode  byte
+	Payload []byte
+}
+
+// WebSocketHandshakeHandler 处理http升级握手，握手完成之后的数据原样传给后面的handler，
+// 需要放在pipeline的最前面，握手响应不经过帧编码
+type WebSocketHandshakeHandler struct {
+	InboundHandlerAdapter
+	done bool
+}
+
+func (h *WebSocketHandshakeHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	v, ok := msg.(*buffer.ByteBuffer)
+	if !ok || h.done {
+		context.FireMessageRead(msg)
+		return
+	}
+
+	if h.ByteBuf == nil {
+		h.ByteBuf = buffer.New(256, buffer.BigEndian)
+	}
+	h.ByteBuf.WriteBytes(v.Data)
+
+	data := h.ByteBuf.Data[h.ByteBuf.ReaderIndex:h.ByteBuf.WriterIndex]
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end == -1 {
+		if len(data) > maxHandshakeSize {
+			h.reject(context, http.StatusRequestHeaderFieldsTooLarge, "")
+		}
+		return
+	}
+	end += 4
+
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(data[:end])))
+	if err != nil {
+		h.reject(context, http.StatusBadRequest, "")
+		return
+	}
+	if request.Method != http.MethodGet ||
+		!headerContainsToken(request.Header, "Upgrade", "websocket") ||
+		!headerContainsToken(request.Header, "Connection", "upgrade") {
+		h.reject(context, http.StatusBadRequest, "")
+		return
+	}
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		h.reject(context, http.StatusUpgradeRequired, "Sec-WebSocket-Version: 13\r\n")
+		return
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		h.reject(context, http.StatusBadRequest, "")
+		return
+	}
+
+	h.done = true
+	context.Pipeline.SetAttr(WebSocketHandshakeAttr, &WebSocketHandshake{Path: request.URL.RequestURI(), Header: request.Header})
+	context.FireWrite([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + WebSocketAcceptKey(key) + "\r\n\r\n"))
+
+	remain := data[end:]
+	h.ByteBuf = nil
+	if len(remain) > 0 {
+		context.FireMessageRead(&buffer.ByteBuffer{Data: remain})
+	}
+}
+
+func (h *WebSocketHandshakeHandler) reject(context ConnHandlerContext, status int, header string) {
+	h.ByteBuf = nil
+	context.FireWrite([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n",
+		status, http.StatusText(status), header)))
+	context.Pipeline.conn.Close()
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WebSocketAcceptKey 根据Sec-WebSocket-Key计算Sec-WebSocket-Accept
+func WebSocketAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// WebSocketFrameDecoder websocket帧解码器，配合ByteToMessageDecoder使用，
+// 合并分片后输出*WebSocketFrame，ping/close等控制帧直接在这里应答，text消息不是合法的UTF-8时关闭连接
+type WebSocketFrameDecoder struct {
+	// MaxFrameSize 单个帧以及合并分片之后消息的最大长度，不大于0时使用defaultMaxWebSocketFrameSize
+	MaxFrameSize int
+	fragments    []byte
+	fragmentCode byte
+	closed       bool
+}
+
+// NewWebSocketFrameDecoder 创建websocket帧解码器
+func NewWebSocketFrameDecoder(maxFrameSize int) *ByteToMessageDecoder {
+	return &ByteToMessageDecoder{Decoder: &WebSocketFrameDecoder{MaxFrameSize: maxFrameSize}}
+}
+
+func (d *WebSocketFrameDecoder) CallDecode(ctx ConnHandlerContext, in *buffer.ByteBuf, output *[]interface{}) {
+	for !d.closed {
+		data := in.Data[in.ReaderIndex:in.WriterIndex]
+		if len(data) < 2 {
+			return
+		}
+
+		fin := data[0]&0x80 != 0
+		opcode := data[0] & 0x0F
+		masked := data[1]&0x80 != 0
+		length := uint64(data[1] & 0x7F)
+		offset := 2
+
+		if data[0]&0x70 != 0 || !masked {
+			d.close(ctx, in, WebSocketCloseProtocolError)
+			return
+		}
+		switch length {
+		case 126:
+			if len(data) < offset+2 {
+				return
+			}
+			length = uint64(binary.BigEndian.Uint16(data[offset:]))
+			offset += 2
+		case 127:
+			if len(data) < offset+8 {
+				return
+			}
+			length = binary.BigEndian.Uint64(data[offset:])
+			offset += 8
+		}
+		if length > uint64(d.maxFrameSize()) {
+			d.close(ctx, in, WebSocketCloseTooBig)
+			return
+		}
+		if len(data) < offset+4 || length > uint64(len(data)-offset-4) {
+			return
+		}
+
+		mask := data[offset : offset+4]
+		offset += 4
+		payload := make([]byte, length)
+		copy(payload, data[offset:])
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		in.SkipBytes(uint32(offset + len(payload)))
+
+		if opcode >= WebSocketClose {
+			if !fin || length > 125 {
+				d.close(ctx, in, WebSocketCloseProtocolError)
+				return
+			}
+			d.control(ctx, in, opcode, payload)
+			continue
+		}
+
+		switch opcode {
+		case WebSocketText, WebSocketBinary:
+			if d.fragments != nil {
+				d.close(ctx, in, WebSocketCloseProtocolError)
+				return
+			}
+			if fin {
+				if !d.emit(ctx, in, output, opcode, payload) {
+					return
+				}
+				continue
+			}
+			d.fragmentCode = opcode
+			d.fragments = payload
+		case WebSocketContinuation:
+			if d.fragments == nil {
+				d.close(ctx, in, WebSocketCloseProtocolError)
+				return
+			}
+			if len(payload) > d.maxFrameSize()-len(d.fragments) {
+				d.close(ctx, in, WebSocketCloseTooBig)
+				return
+			}
+			d.fragments = append(d.fragments, payload...)
+			if fin {
+				fragments := d.fragments
+				d.fragments = nil
+				if !d.emit(ctx, in, output, d.fragmentCode, fragments) {
+					return
+				}
+			}
+		default:
+			d.close(ctx, in, WebSocketCloseProtocolError)
+			return
+		}
+	}
+}
+
+func (d *WebSocketFrameDecoder) maxFrameSize() int {
+	if d.MaxFrameSize > 0 && d.MaxFrameSize <= math.MaxInt32 {
+		return d.MaxFrameSize
+	}
+	return defaultMaxWebSocketFrameSize
+}
+
+// emit 输出一个完整的消息，text消息不是合法的UTF-8时关闭连接并返回false
+func (d *WebSocketFrameDecoder) emit(ctx ConnHandlerContext, in *buffer.ByteBuf, output *[]interface{}, opcode byte, payload []byte) bool {
+	if opcode == WebSocketText && !utf8.Valid(payload) {
+		d.close(ctx, in, WebSocketCloseInvalidData)
+		return false
+	}
+	*output = append(*output, &WebSocketFrame{Opcode: opcode, Payload: payload})
+	return true
+}
+
+func (d *WebSocketFrameDecoder) control(ctx ConnHandlerContext, in *buffer.ByteBuf, opcode byte, payload []byte) {
+	switch opcode {
+	case WebSocketPing:
+		ctx.FireWrite(EncodeWebSocketFrame(WebSocketPong, payload))
+	case WebSocketPong:
+	case WebSocketClose:
+		code := WebSocketCloseNormal
+		if len(payload) >= 2 {
+			code = int(binary.BigEndian.Uint16(payload))
+		}
+		d.close(ctx, in, code)
+	default:
+		d.close(ctx, in, WebSocketCloseProtocolError)
+	}
+}
+
+func (d *WebSocketFrameDecoder) close(ctx ConnHandlerContext, in *buffer.ByteBuf, code int) {
+	d.closed = true
+	d.fragments = nil
+	in.SkipBytes(in.ReadableBytes())
+	ctx.FireWrite(EncodeWebSocketClose(code))
+	ctx.Pipeline.conn.Close()
+}
+
+// EncodeWebSocketFrame 编码服务端发出的帧，服务端发出的帧不需要掩码
+func EncodeWebSocketFrame(opcode byte, payload []byte) []byte {
+	length := len(payload)
+	var header []byte
+	switch {
+	case length <= 125:
+		header = []byte{0x80 | opcode, byte(length)}
+	case length <= 0xFFFF:
+		header = []byte{0x80 | opcode, 126, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = make([]byte, 10)
+		header[0] = 0x80 | opcode
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	frame := make([]byte, len(header)+length)
+	copy(frame, header)
+	copy(frame[len(header):], payload)
+	return frame
+}
+
+// EncodeWebSocketClose 编码带状态码的close帧
+func EncodeWebSocketClose(code int) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	return EncodeWebSocketFrame(WebSocketClose, payload)
+}
+
+// WebSocketFrameEncoder 把写出的[]byte编码成binary帧，*WebSocketFrame按自身的opcode编码
+type WebSocketFrameEncoder struct {
+}
+
+func (e *WebSocketFrameEncoder) FireWrite(context ConnHandlerContext, msg interface{}) {
+	switch v := msg.(type) {
+	case *WebSocketFrame:
+		context.FireWrite(EncodeWebSocketFrame(v.Opcode, v.Payload))
+	case []byte:
+		context.FireWrite(EncodeWebSocketFrame(WebSocketBinary, v))
+	default:
+		context.FireWrite(msg)
+	}
+}
+
+// DecodeWebSocketMessage 解析binary帧中的请求，格式与tcp请求相同但不带长度前缀:
+// command(32字节，不足补0) + requestId(int32) + content
+func DecodeWebSocketMessage(payload []byte) (RequestMessage, error) {
+	var message RequestMessage
+	if len(payload) < commandLength+4 {
+		return message, internalErrors.NotSupport
+	}
+	message.Command = strings.Trim(string(payload[:commandLength]), "\x00")
+	message.RequestId, message.Flags = DecodeRequestId(binary.BigEndian.Uint32(payload[commandLength:]))
+	message.Content = payload[commandLength+4:]
+	return message, nil
+}
+
+// EncodeWebSocketMessage 按DecodeWebSocketMessage的格式编码消息
+func EncodeWebSocketMessage(command string, requestId int, content []byte) []byte {
+	return encodeWebSocketMessage(command, requestId, 0, content)
+}
+
+// encodeWebSocketMessage 编码消息并在requestId字段设置flags
+func encodeWebSocketMessage(command string, requestId int, flags MessageFlags, content []byte) []byte {
+	data := make([]byte, commandLength+4+len(content))
+	copy(data[:commandLength], command)
+	binary.BigEndian.PutUint32(data[commandLength:], encodeRequestId(requestId, flags))
+	copy(data[commandLength+4:], content)
+	return data
+}
+
+// WebSocketDispatchHandler 把binary帧解析成请求交给Servlet处理，
+// 与tcp共用同一个DispatchServlet
+type WebSocketDispatchHandler struct {
+	InboundHandlerAdapter
+	Servlet Servlet
+	Context ServletContext
+}
+
+func (h *WebSocketDispatchHandler) FireMessageRead(context ConnHandlerContext, msg interface{}) {
+	frame, ok := msg.(*WebSocketFrame)
+	if !ok {
+		context.FireMessageRead(msg)
+		return
+	}
+	if frame.Opcode != WebSocketBinary {
+		context.FireWrite(EncodeWebSocketClose(WebSocketCloseUnsupportedData))
+		context.Pipeline.conn.Close()
+		return
+	}
+
+	message, err := DecodeWebSocketMessage(frame.Payload)
+	if err != nil {
+		context.FireWrite(EncodeWebSocketClose(WebSocketCloseProtocolError))
+		context.Pipeline.conn.Close()
+		return
+	}
+
+	conn := context.Pipeline.conn
+	err = h.Servlet.Service(NewWebSocketRequest(conn, h.Context, message), NewWebSocketResponse(conn))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// AddWebSocketHandlers 按顺序添加握手、帧解码、帧编码和分发handler，帧的最大长度取自config的websocketMaxFrameSize，
+// config为nil时使用默认值
+func AddWebSocketHandlers(pipeline *ConnPipeline, servlet Servlet, context ServletContext, config ServletConfig) {
+	maxFrameSize := int64(defaultMaxWebSocketFrameSize)
+	if config != nil {
+		maxFrameSize = config.GetSize(WebSocketMaxFrameSizeKey, defaultMaxWebSocketFrameSize)
+	}
+	pipeline.AddLast("websocketHandshake", &WebSocketHandshakeHandler{})
+	pipeline.AddLast("websocketDecoder", NewWebSocketFrameDecoder(int(maxFrameSize)))
+	pipeline.AddLast("websocketEncoder", &WebSocketFrameEncoder{})
+	pipeline.AddLast("websocketDispatcher", &WebSocketDispatchHandler{Servlet: servlet, Context: context})
+}
+
+// WebSocketRequest websocket请求，请求头来自握手请求
+type WebSocketRequest struct {
+	TcpRequest
+}
+
+func (w *WebSocketRequest) GetHeader(key string) (string, error) {
+	pipeline, ok := w.conn.Context().(*ConnPipeline)
+	if !ok {
+		return "", internalErrors.NotSupport
+	}
+	handshake, ok := pipeline.Attr(WebSocketHandshakeAttr).(*WebSocketHandshake)
+	if !ok {
+		return "", internalErrors.NotSupport
+	}
+	return handshake.Header.Get(key), nil
+}
+
+func (w *WebSocketRequest) Protocol() ServerProtocol {
+	return WEBSOCKET
+}
+
+// NewWebSocketRequest 创建websocket请求
+func NewWebSocketRequest(conn Conn, context ServletContext, message RequestMessage) Request {
+	var request WebSocketRequest
+	request.requestId = message.RequestId
+	request.command = message.Command
+	request.content = message.Content
+	request.sessionId = message.SessionId
+	request.flags = message.Flags
+	request.createTime = time.Now()
+	request.conn = conn
+	request.context = context
+	request.newPush = newWebSocketPush
+
+	return &request
+}
+
+// WebSocketResponse websocket响应，每次Write发送一个binary帧
+type WebSocketResponse struct {
+	TcpResponse
+}
+
+func (w *WebSocketResponse) Write(buff []byte) {
+	w.written = true
+	w.conn.AsyncWrite(EncodeWebSocketFrame(WebSocketBinary, buff))
+}
+
+func (w *WebSocketResponse) Protocol() ServerProtocol {
+	return WEBSOCKET
+}
+
+// MarkClose 发送close帧并关闭连接
+func (w *WebSocketResponse) MarkClose() {
+	w.closeFlag = true
+	w.conn.AsyncWrite(EncodeWebSocketClose(WebSocketCloseNormal))
+	w.conn.Close()
+}
+
+// NewWebSocketResponse 创建websocket响应
+func NewWebSocketResponse(conn Conn) Response {
+	var response WebSocketResponse
+	response.conn = conn
+
+	return &response
+}
+
+// WebSocketPush websocket推送通道，推送消息的格式与请求相同，requestId为0
+type WebSocketPush struct {
+	conn      Conn
+	discarded int32
+}
+
+// NewWebSocketPush 创建websocket推送通道
+func NewWebSocketPush(conn Conn) *WebSocketPush {
+	return &WebSocketPush{conn: conn}
+}
+
+func (w *WebSocketPush) Push(command string, bytes []byte) {
+	if !w.IsPushable() {
+		return
+	}
+	bytes, flags := sealBody(w.conn, command, 0, bytes)
+	w.conn.AsyncWrite(EncodeWebSocketFrame(WebSocketBinary, encodeWebSocketMessage(command, 0, flags, bytes)))
+}
+
+func (w *WebSocketPush) IsPushable() bool {
+	if atomic.LoadInt32(&w.discarded) == 1 {
+		return false
+	}
+	pipeline, ok := w.conn.Context().(*ConnPipeline)
+	return !ok || pipeline.IsActive()
+}
+
+func (w *WebSocketPush) Discard() {
+	if atomic.CompareAndSwapInt32(&w.discarded, 0, 1) {
+		w.conn.AsyncWrite(EncodeWebSocketClose(WebSocketCloseNormal))
+		w.conn.Close()
+	}
+}
+
+func (w *WebSocketPush) Heartbeat() {
+	if w.IsPushable() {
+		w.conn.AsyncWrite(EncodeWebSocketFrame(WebSocketPing, nil))
+	}
+}
+
+func (w *WebSocketPush) Protocol() ServerProtocol {
+	return WEBSOCKET
+}
@@ -0,0 +1,162 @@
+package servlet
+
+import (
+	"LearnGo/src/buffer"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordConn 记录所有写出数据的Conn
+type recordConn struct {
+	mutex  sync.Mutex
+	ctx    interface{}
+	writes [][]byte
+	closed bool
+}
+
+func (c *recordConn) Context() interface{}       { return c.ctx }
+func (c *recordConn) SetContext(ctx interface{}) { c.ctx = ctx }
+func (c *recordConn) LocalAddr() net.Addr        { return &net.TCPAddr{} }
+func (c *recordConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+}
+func (c *recordConn) AsyncWrite(buf []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.writes = append(c.writes, buf)
+	return nil
+}
+func (c *recordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *recordConn) last() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.writes) == 0 {
+		return nil
+	}
+	return c.writes[len(c.writes)-1]
+}
+
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	frame := EncodeWebSocketFrame(opcode, payload)
+	if !fin {
+		frame[0] &^= 0x80
+	}
+	header := len(frame) - len(payload)
+	mask := []byte{1, 2, 3, 4}
+	out := append([]byte{}, frame[:header]...)
+	out[1] |= 0x80
+	out = append(out, mask...)
+	for i, b := range payload {
+		out = append(out, b^mask[i%4])
+	}
+	return out
+}
+
+func newWebSocketPipeline(t *testing.T, maxFrameSize int) (*recordConn, *ConnPipeline) {
+	servlet := &DispatchServlet{}
+	servlet.Init(NewXmlServletConfig("not-exist.xml"), NewServletContext())
+	servlet.AddHandler("echo", func(request Request, response Response) {
+		origin, _ := request.GetHeader("Origin")
+		response.Write(append([]byte(origin+":"), request.Content()...))
+	})
+
+	conn := &recordConn{}
+	pipeline := NewConnPipeline(conn)
+	conn.SetContext(pipeline)
+	config := NewLayeredServletConfig()
+	if maxFrameSize > 0 {
+		config.SetDefault(WebSocketMaxFrameSizeKey, int64(maxFrameSize))
+	}
+	AddWebSocketHandlers(pipeline, servlet, nil, config)
+
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: []byte("GET /ws HTTP/1.1\r\nHost: localhost\r\n" +
+		"Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\nOrigin: game\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")})
+	if !strings.Contains(string(conn.last()), "Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=") {
+		t.Fatalf("unexpected handshake response %q", conn.last())
+	}
+	return conn, pipeline
+}
+
+func TestWebSocketFragmentedMessage(t *testing.T) {
+	conn, pipeline := newWebSocketPipeline(t, 1024)
+
+	message := EncodeWebSocketMessage("echo", 7, []byte("hello"))
+	data := append(maskedFrame(false, WebSocketBinary, message[:10]), maskedFrame(true, WebSocketPing, []byte("p"))...)
+	data = append(data, maskedFrame(true, WebSocketContinuation, message[10:])...)
+	// 分两次到达，验证半包
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: data[:7]})
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: data[7:]})
+
+	if len(conn.writes) != 3 {
+		t.Fatalf("expected handshake, pong and response, got %d writes", len(conn.writes))
+	}
+	if !bytes.Equal(conn.writes[1], EncodeWebSocketFrame(WebSocketPong, []byte("p"))) {
+		t.Fatalf("unexpected pong %v", conn.writes[1])
+	}
+	if !bytes.Equal(conn.writes[2], EncodeWebSocketFrame(WebSocketBinary, []byte("game:hello"))) {
+		t.Fatalf("unexpected response %q", conn.writes[2])
+	}
+}
+
+func TestWebSocketFrameTooBig(t *testing.T) {
+	conn, pipeline := newWebSocketPipeline(t, 16)
+
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: maskedFrame(true, WebSocketBinary, make([]byte, 200))})
+	if !bytes.Equal(conn.last(), EncodeWebSocketClose(WebSocketCloseTooBig)) || !conn.closed {
+		t.Fatalf("expected close 1009, got %v", conn.last())
+	}
+}
+
+func TestWebSocketHostileLength(t *testing.T) {
+	for _, length := range []uint64{0xFFFFFFFFFFFFFFFF, 1 << 63, 1 << 32, defaultMaxWebSocketFrameSize + 1} {
+		conn, pipeline := newWebSocketPipeline(t, 0)
+
+		header := make([]byte, 14)
+		header[0] = 0x80 | WebSocketBinary
+		header[1] = 0x80 | 127
+		binary.BigEndian.PutUint64(header[2:], length)
+		pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: header})
+		if !bytes.Equal(conn.last(), EncodeWebSocketClose(WebSocketCloseTooBig)) || !conn.closed {
+			t.Fatalf("length %x: expected close 1009, got %v", length, conn.last())
+		}
+	}
+}
+
+func TestWebSocketIncompleteFrame(t *testing.T) {
+	conn, pipeline := newWebSocketPipeline(t, 0)
+
+	// 长度合法但内容还没有到达，等待后续数据
+	frame := maskedFrame(true, WebSocketBinary, make([]byte, 70000))
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: frame[:12]})
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: frame[12:1000]})
+	if len(conn.writes) != 1 || conn.closed {
+		t.Fatalf("incomplete frame should wait for more data, got %d writes", len(conn.writes))
+	}
+}
+
+func TestWebSocketInvalidUtf8(t *testing.T) {
+	conn, pipeline := newWebSocketPipeline(t, 1024)
+
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: maskedFrame(true, WebSocketText, []byte{'a', 0xff, 0xfe})})
+	if !bytes.Equal(conn.last(), EncodeWebSocketClose(WebSocketCloseInvalidData)) || !conn.closed {
+		t.Fatalf("expected close 1007, got %v", conn.last())
+	}
+
+	// 分片边界切开一个多字节字符，合并之后是合法的UTF-8
+	conn, pipeline = newWebSocketPipeline(t, 1024)
+	text := []byte("你好")
+	data := append(maskedFrame(false, WebSocketText, text[:2]), maskedFrame(true, WebSocketContinuation, text[2:])...)
+	pipeline.Head.FireMessageRead(&buffer.ByteBuffer{Data: data})
+	if bytes.Equal(conn.last(), EncodeWebSocketClose(WebSocketCloseInvalidData)) {
+		t.Fatal("valid fragmented text rejected")
+	}
+}